@@ -0,0 +1,105 @@
+package ramdisk
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"log"
+	"os"
+	"path"
+)
+
+// CacheMode selects how the kernel page cache is used for file data
+type CacheMode int
+
+const (
+	// CacheDirectIO bypasses the page cache, every read and write goes to the RAM disk.
+	// mmap(2) does not work in this mode, so executables and shared libraries are
+	// cached like in CacheKernel, unless a CacheRule says otherwise. This is the default.
+	CacheDirectIO CacheMode = iota
+	// CacheKernel lets the kernel cache file data. The cache is dropped when the file is opened,
+	// and invalidated when file data is changed in-process.
+	CacheKernel
+	// CacheKeep is like CacheKernel, but keeps cached data when the file is opened again.
+	CacheKeep
+)
+
+// CacheRule selects the cache mode for files with names matching Pattern (see path.Match)
+type CacheRule struct {
+	Pattern string
+	Mode    CacheMode
+}
+
+// cacheMode returns the cache mode of the first rule matching name, or the default
+func (o Options) cacheMode(name string, mode os.FileMode) CacheMode {
+	for _, rule := range o.CacheRules {
+		if matched, _ := path.Match(rule.Pattern, name); matched {
+			return rule.Mode
+		}
+	}
+	if o.Cache == CacheDirectIO && needsMmap(name, mode) {
+		return CacheKernel
+	}
+	return o.Cache
+}
+
+// needsMmap tells if a file is likely to be mapped into memory, because it is an executable or a shared library
+func needsMmap(name string, mode os.FileMode) bool {
+	if mode&0111 != 0 {
+		return true
+	}
+	sharedLibrary, _ := path.Match("*.so", name)
+	versionedLibrary, _ := path.Match("*.so.*", name)
+	return sharedLibrary || versionedLibrary
+}
+
+// openResponseFlags returns the flags controlling the page cache for a newly opened file
+func (o Options) openResponseFlags(name string, mode os.FileMode) fuse.OpenResponseFlags {
+	switch o.cacheMode(name, mode) {
+	case CacheKernel:
+		return 0
+	case CacheKeep:
+		return fuse.OpenKeepCache
+	default:
+		return fuse.OpenDirectIO
+	}
+}
+
+// openResponseFlags returns the flags controlling the page cache for a newly opened file.
+// the page cache would get the stream offsets of ring buffers and the changing content
+// of virtual files wrong, they always use direct IO
+func (e *FileEntry) openResponseFlags() fuse.OpenResponseFlags {
+	if e.RingSize() > 0 || e.virtual != nil {
+		return fuse.OpenDirectIO
+	}
+	return e.fs.options.openResponseFlags(e.Meta.Name(), e.Meta.Mode())
+}
+
+// SetServer tells the RAM disk which server it is served by, so that it can invalidate kernel caches.
+// MountAndServe does this on its own, call it only when serving the RAM disk with fs.New yourself.
+func (f *ramdiskFS) SetServer(server *fs.Server) {
+	f.server = server
+}
+
+// invalidate drops cached data of the file from the kernel page cache.
+// Must not be called while serving a request for the same file.
+func (f *ramdiskFS) invalidate(entry *FileEntry) {
+	if f.server == nil {
+		return
+	}
+	err := f.server.InvalidateNodeData(&entry.Meta)
+	if err != nil && err != fuse.ErrNotCached {
+		log.Printf("failed to invalidate cache of %q: %v", entry.Meta.Name(), err)
+	}
+}
+
+// invalidateEntry drops the kernel's cached lookup of name in dir, after removal in-process.
+// Must not be called while serving a request for dir.
+func (f *ramdiskFS) invalidateEntry(dir fs.Node, name string) {
+	if f.server == nil {
+		return
+	}
+	err := f.server.InvalidateEntry(dir, name)
+	if err != nil && err != fuse.ErrNotCached {
+		log.Printf("failed to invalidate lookup of %q: %v", name, err)
+	}
+}
@@ -0,0 +1,93 @@
+package ramdisk
+
+import (
+	"testing"
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs/fstestutil"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+func TestCacheRules(t *testing.T) {
+	options := Options{
+		Cache: CacheKernel,
+		CacheRules: []CacheRule{
+			{Pattern: "*.log", Mode: CacheDirectIO},
+			{Pattern: "*.so", Mode: CacheKeep},
+		},
+	}
+
+	if options.openResponseFlags("app.log", 0644) != fuse.OpenDirectIO {
+		t.Fatal("rule for *.log not applied")
+	}
+	if options.openResponseFlags("libx.so", 0644) != fuse.OpenKeepCache {
+		t.Fatal("rule for *.so not applied")
+	}
+	if options.openResponseFlags("data.bin", 0644) != 0 {
+		t.Fatal("default mode not applied")
+	}
+	if (Options{}).openResponseFlags("data.bin", 0644) != fuse.OpenDirectIO {
+		t.Fatal("direct IO is not the default")
+	}
+	if (Options{}).openResponseFlags("tool", 0755) != 0 {
+		t.Fatal("executables are not cached")
+	}
+	if (Options{}).openResponseFlags("libx.so.1", 0644) != 0 {
+		t.Fatal("shared libraries are not cached")
+	}
+}
+
+func TestInProcessReadWrite(t *testing.T) {
+	filesys := CreateRamFS()
+	entry := createFileEntry("c0.txt", filesys, permissions{mode: 0644})
+
+	entry.WriteAt([]byte("abcdef"), 0)
+	entry.WriteAt([]byte("XY"), 2)
+	if string(entry.Bytes()) != "abXYef" || entry.Meta.Size() != 6 {
+		t.Fatalf("wrong content after WriteAt: %q", entry.Bytes())
+	}
+
+	buffer := make([]byte, 4)
+	n, err := entry.ReadAt(buffer, 4)
+	if n != 2 || err != io.EOF || string(buffer[:n]) != "ef" {
+		t.Fatalf("wrong ReadAt result: %d %v %q", n, err, buffer[:n])
+	}
+
+	entry.Truncate(3)
+	if string(entry.Bytes()) != "abX" || entry.Meta.Size() != 3 {
+		t.Fatalf("wrong content after Truncate: %q", entry.Bytes())
+	}
+}
+
+func TestKernelCacheInvalidation(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{Cache: CacheKeep})
+	mnt, mntErr := fstestutil.MountedT(t, filesys, nil)
+	if mntErr != nil {
+		t.Fatal("mount failed")
+	}
+	defer mnt.Close()
+	filesys.SetServer(mnt.Server)
+
+	path := mnt.Dir + "/" + "c1.txt"
+	ioutil.WriteFile(path, []byte("old content"), 0644)
+
+	// keep the file open, so that its pages stay cached
+	reader, err := os.Open(path)
+	if err != nil {
+		t.Fatal("open failed")
+	}
+	defer reader.Close()
+	byts, _ := ioutil.ReadAll(reader)
+	if string(byts) != "old content" {
+		t.Fatalf("wrong content: %q", byts)
+	}
+
+	entry, _ := filesys.root.findEntryByName("c1.txt")
+	entry.SetData([]byte("new content, longer"))
+
+	byts, _ = ioutil.ReadFile(path)
+	if string(byts) != "new content, longer" {
+		t.Fatalf("stale content after in-process change: %q", byts)
+	}
+}
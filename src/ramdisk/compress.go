@@ -0,0 +1,112 @@
+package ramdisk
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+	"log"
+	"time"
+)
+
+// compressMinSize is the size below which compressing a file is not worth it
+const compressMinSize = 1024
+
+// IsCompressed tells if the data of the file is held compressed. Data is nil then,
+// it is decompressed when the file is opened or its data is accessed in-process with ReadAt, Bytes etc.
+func (e *FileEntry) IsCompressed() bool {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.compressed != nil
+}
+
+// compress replaces the data by its compressed form, if it is smaller. caller must hold the mutex
+func (e *FileEntry) compress() {
+	if e.compressed != nil || e.shared != nil || e.incompressible || len(e.Data) < compressMinSize {
+		return
+	}
+
+	var buffer bytes.Buffer
+	writer, _ := flate.NewWriter(&buffer, flate.BestSpeed)
+	writer.Write(e.Data)
+	writer.Close()
+	if buffer.Len() >= len(e.Data) {
+		e.incompressible = true
+		return
+	}
+
+	e.compressed = append([]byte{}, buffer.Bytes()...)
+	e.Data = nil
+	if !e.released {
+		e.fs.metrics.addPhysicalBytes(int64(len(e.compressed)) - int64(e.Meta.size))
+	}
+}
+
+// inflate restores compressed data, caller must hold the mutex
+func (e *FileEntry) inflate() {
+	if e.compressed == nil {
+		return
+	}
+
+	data, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(e.compressed)))
+	if err != nil {
+		log.Panicf("failed to decompress %q: %v", e.Meta.Name(), err)
+	}
+	if !e.released {
+		e.fs.metrics.addPhysicalBytes(int64(len(data)) - int64(len(e.compressed)))
+	}
+	e.Data = data
+	e.compressed = nil
+}
+
+// rlockInflated read-locks the mutex, with the data decompressed
+func (e *FileEntry) rlockInflated() {
+	e.mutex.RLock()
+	for e.compressed != nil {
+		e.mutex.RUnlock()
+		e.mutex.Lock()
+		e.inflate()
+		e.mutex.Unlock()
+		e.mutex.RLock()
+	}
+}
+
+// physicalSize returns the bytes held for the file data, caller must hold the mutex
+func (e *FileEntry) physicalSize() int64 {
+	if e.compressed != nil {
+		return int64(len(e.compressed))
+	}
+	if e.isInLower() {
+		return 0
+	}
+	if e.sealed != nil {
+		size := 0
+		for _, chunk := range e.sealed {
+			size += len(chunk)
+		}
+		return int64(size)
+	}
+	return int64(e.Meta.size)
+}
+
+// compressCold compresses the data of regular files not opened for Options.CompressAfter
+func (f *ramdiskFS) compressCold(now time.Time) {
+	after := f.options.CompressAfter
+	if after <= 0 {
+		return
+	}
+
+	f.root.mutex.RLock()
+	entries := append([]*FileEntry{}, f.root.entries...)
+	f.root.mutex.RUnlock()
+
+	for _, entry := range entries {
+		if !entry.regular() {
+			continue
+		}
+		entry.mutex.Lock()
+		if entry.handles == 0 && now.Sub(entry.lastUsed) >= after {
+			entry.compress()
+		}
+		entry.mutex.Unlock()
+	}
+}
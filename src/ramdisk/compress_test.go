@@ -0,0 +1,55 @@
+package ramdisk
+
+import (
+	"testing"
+	"bytes"
+	"math/rand"
+	"time"
+)
+
+func TestCompressCold(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{CompressAfter: time.Minute})
+	content := bytes.Repeat([]byte("timestamp,value\n"), 1000)
+	cold := addTestFile(filesys, "z1.csv", 0, time.Now().Add(-2*time.Minute))
+	cold.write(content, 0, false)
+	random := make([]byte, 4096)
+	rand.Read(random)
+	incompressible := addTestFile(filesys, "z2.bin", 0, time.Now().Add(-2*time.Minute))
+	incompressible.write(random, 0, false)
+	recent := addTestFile(filesys, "z3.csv", 0, time.Now())
+	recent.write(content, 0, false)
+
+	filesys.compressCold(time.Now())
+
+	if !cold.IsCompressed() || cold.Data != nil {
+		t.Fatal("cold file not compressed")
+	}
+	if incompressible.IsCompressed() || recent.IsCompressed() {
+		t.Fatal("incompressible or recent file compressed")
+	}
+	metrics := filesys.Metrics()
+	if metrics.BytesStored != int64(2*len(content)+len(random)) || metrics.BytesPhysical >= metrics.BytesStored-int64(len(content))/2 {
+		t.Fatalf("wrong logical/physical bytes %d/%d", metrics.BytesStored, metrics.BytesPhysical)
+	}
+	if cold.Meta.Size() != uint64(len(content)) {
+		t.Fatal("size not logical")
+	}
+
+	if !bytes.Equal(cold.Bytes(), content) || cold.IsCompressed() {
+		t.Fatal("data not decompressed on access")
+	}
+	if metrics := filesys.Metrics(); metrics.BytesPhysical != metrics.BytesStored {
+		t.Fatalf("physical bytes not restored: %d/%d", metrics.BytesStored, metrics.BytesPhysical)
+	}
+
+	// open files are decompressed, and stay so
+	filesys.compressCold(time.Now().Add(time.Hour))
+	cold.opened()
+	if cold.IsCompressed() {
+		t.Fatal("open file compressed")
+	}
+	filesys.compressCold(time.Now().Add(time.Hour))
+	if cold.IsCompressed() {
+		t.Fatal("open file compressed")
+	}
+}
@@ -0,0 +1,218 @@
+package ramdisk
+
+import (
+	"bazil.org/fuse"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"log"
+	"sync"
+	"syscall"
+)
+
+// sealChunkSize is the size of plaintext chunks encrypted separately, so that reads decrypt only what they need
+const sealChunkSize = 64 * 1024
+
+var errKeyWiped = errors.New("encryption key wiped")
+
+// encryption seals the data of closed files with AES-GCM
+type encryption struct {
+	enabled bool // set on creation, files stay sealed after the key is wiped
+	mutex   sync.RWMutex
+	key     []byte // the caller's key, wiped on unmount
+	aead    cipher.AEAD
+}
+
+func newEncryption(key []byte) (*encryption, error) {
+	if key == nil {
+		return &encryption{}, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &encryption{enabled: true, key: key, aead: aead}, nil
+}
+
+// wipe overwrites the key and drops the cipher. the expanded key inside crypto/aes is left to the garbage collector
+func (c *encryption) wipe() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i := range c.key {
+		c.key[i] = 0
+	}
+	c.key = nil
+	c.aead = nil
+}
+
+// additionalData binds a sealed chunk to its file and position
+func additionalData(inode uint64, index int) []byte {
+	ad := make([]byte, 16)
+	binary.LittleEndian.PutUint64(ad, inode)
+	binary.LittleEndian.PutUint64(ad[8:], uint64(index))
+	return ad
+}
+
+func (c *encryption) sealChunk(inode uint64, index int, plaintext []byte) []byte {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.aead == nil {
+		return nil
+	}
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plaintext)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		log.Panicf("no randomness for nonce: %v", err)
+	}
+	return c.aead.Seal(nonce, nonce, plaintext, additionalData(inode, index))
+}
+
+func (c *encryption) openChunk(inode uint64, index int, sealed []byte) ([]byte, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.aead == nil {
+		return nil, errKeyWiped
+	}
+	nonceSize := c.aead.NonceSize()
+	return c.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], additionalData(inode, index))
+}
+
+// sealData encrypts data in chunks of sealChunkSize, nil if the key is gone
+func (c *encryption) sealData(inode uint64, data []byte) [][]byte {
+	sealed := make([][]byte, 0, len(data)/sealChunkSize+1)
+	for index := 0; index*sealChunkSize < len(data); index++ {
+		end := (index + 1) * sealChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := c.sealChunk(inode, index, data[index*sealChunkSize:end])
+		if chunk == nil {
+			return nil
+		}
+		sealed = append(sealed, chunk)
+	}
+	return sealed
+}
+
+// openData decrypts all chunks sealed by sealData
+func (c *encryption) openData(inode uint64, sealed [][]byte, size uint64) ([]byte, error) {
+	data := make([]byte, 0, size)
+	for index, chunk := range sealed {
+		plaintext, err := c.openChunk(inode, index, chunk)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, plaintext...)
+	}
+	return data, nil
+}
+
+// seal encrypts the data, caller must hold the mutex
+func (e *FileEntry) seal() {
+	c := e.fs.encryption
+	if !c.enabled || e.sealed != nil || e.virtual != nil || e.isInLower() {
+		return
+	}
+	e.inflate()
+	sealed := c.sealData(e.Meta.inode, e.Data)
+	if sealed == nil {
+		// key is gone, keep the data as it is, still shared
+		return
+	}
+	shared := e.shared != nil
+	e.fs.dedup.unshare(e, false)
+
+	if !shared {
+		// other files and snapshots may still use shared data
+		for i := range e.Data {
+			e.Data[i] = 0
+		}
+	}
+	e.Data = nil
+	e.sealed = sealed
+	if !e.released {
+		e.fs.metrics.addPhysicalBytes(e.physicalSize() - int64(e.Meta.size))
+	}
+}
+
+// sealIfClosed encrypts the data of a file without open handles, caller must hold the mutex
+func (e *FileEntry) sealIfClosed() {
+	if e.handles == 0 {
+		e.seal()
+	}
+}
+
+// unseal decrypts the data for modification, caller must hold the mutex.
+// without the key, the file is empty afterwards
+func (e *FileEntry) unseal() {
+	if e.sealed == nil {
+		return
+	}
+
+	physical := e.physicalSize()
+	data := make([]byte, e.Meta.size)
+	n, err := e.readSealed(data, 0)
+	if err != nil {
+		log.Printf("failed to decrypt %q, its data is lost: %v", e.Meta.Name(), err)
+		n = 0
+	}
+	e.Data = data[:n]
+	e.sealed = nil
+	if !e.released {
+		e.fs.metrics.addPhysicalBytes(int64(e.Meta.size) - physical)
+	}
+	if err != nil {
+		e.setSize(0)
+	}
+}
+
+// readSealed decrypts the chunks covering p at off, caller must hold the mutex
+func (e *FileEntry) readSealed(p []byte, off int64) (n int, err error) {
+	size := int64(e.Meta.size)
+	for n < len(p) && off+int64(n) < size {
+		position := off + int64(n)
+		index := int(position / sealChunkSize)
+		plaintext, err := e.fs.encryption.openChunk(e.Meta.inode, index, e.sealed[index])
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], plaintext[position-int64(index)*sealChunkSize:])
+	}
+	return n, nil
+}
+
+// handleSealedRead serves a read of a sealed file, caller must hold the mutex
+func (e *FileEntry) handleSealedRead(req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	if req.Offset >= int64(e.Meta.size) {
+		return nil
+	}
+	buffer := resp.Data[:req.Size]
+	n, err := e.readSealed(buffer, req.Offset)
+	if err != nil {
+		log.Printf("failed to decrypt %q: %v", e.Meta.Name(), err)
+		return fuse.Errno(syscall.EIO)
+	}
+	resp.Data = buffer[:n]
+	return nil
+}
+
+// IsSealed tells if the data of the file is held encrypted. Data is nil then,
+// use ReadAt or Bytes to get the plaintext
+func (e *FileEntry) IsSealed() bool {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.sealed != nil
+}
+
+// implements fs.FSDestroyer, called when the file system is unmounted
+func (f *ramdiskFS) Destroy() {
+	f.destroyOnce.Do(func() {
+		f.encryption.wipe()
+		f.backendEvents.Unmount <- true
+	})
+}
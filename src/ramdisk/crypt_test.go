@@ -0,0 +1,98 @@
+package ramdisk
+
+import (
+	"testing"
+	"bazil.org/fuse"
+	"bytes"
+	"time"
+)
+
+func TestSealOnClose(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	filesys := CreateRamFSWithOptions(Options{EncryptionKey: key})
+	content := bytes.Repeat([]byte("secret data\n"), 10000) // several chunks
+	entry := addTestFile(filesys, "s1.txt", 0, time.Now())
+	entry.opened()
+	entry.write(content, 0, false)
+	if entry.IsSealed() {
+		t.Fatal("open file sealed")
+	}
+	entry.closed()
+
+	if !entry.IsSealed() || entry.Data != nil {
+		t.Fatal("closed file not sealed")
+	}
+	for _, chunk := range entry.sealed {
+		if bytes.Contains(chunk, []byte("secret")) {
+			t.Fatal("plaintext in sealed chunk")
+		}
+	}
+	if metrics := filesys.Metrics(); metrics.BytesStored != int64(len(content)) || metrics.BytesPhysical <= metrics.BytesStored {
+		t.Fatalf("wrong logical/physical bytes %d/%d", metrics.BytesStored, metrics.BytesPhysical)
+	}
+
+	// reads decrypt across chunk boundaries
+	p := make([]byte, 100)
+	if n, err := entry.ReadAt(p, sealChunkSize-50); n != 100 || err != nil || !bytes.Equal(p, content[sealChunkSize-50:sealChunkSize+50]) {
+		t.Fatalf("wrong read %d/%v", n, err)
+	}
+	resp := &fuse.ReadResponse{Data: make([]byte, 0, 20)}
+	if err := (Handle{entry: entry}).Read(nil, &fuse.ReadRequest{Offset: 12, Size: 20}, resp); err != nil || !bytes.Equal(resp.Data, content[12:32]) {
+		t.Fatalf("wrong handle read %q/%v", resp.Data, err)
+	}
+	if !bytes.Equal(entry.Bytes(), content) || !entry.IsSealed() {
+		t.Fatal("wrong plaintext, or unsealed by reading")
+	}
+
+	// in-process writes to a closed file keep it sealed
+	entry.write([]byte("SECRET"), 0, false)
+	entry.modifiedInProcess()
+	if !entry.IsSealed() || !bytes.HasPrefix(entry.Bytes(), []byte("SECRET data")) {
+		t.Fatal("modified file not sealed again")
+	}
+	if metrics := filesys.Metrics(); metrics.BytesStored != int64(len(content)) {
+		t.Fatalf("wrong logical bytes %d", metrics.BytesStored)
+	}
+}
+
+func TestWipeKey(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 16)
+	filesys := CreateRamFSWithOptions(Options{EncryptionKey: key})
+	entry := addTestFile(filesys, "s2.txt", 0, time.Now())
+	entry.write([]byte("secret"), 0, false)
+	entry.modifiedInProcess()
+
+	filesys.Destroy()
+	if !bytes.Equal(key, make([]byte, 16)) {
+		t.Fatal("key not wiped")
+	}
+	if _, err := entry.ReadAt(make([]byte, 6), 0); err == nil {
+		t.Fatal("data readable without key")
+	}
+	filesys.Destroy()
+
+	// modifying a file sealed with the lost key starts from empty
+	entry.write([]byte("new"), 3, false)
+	if string(entry.Data) != "\x00\x00\x00new" || entry.Meta.Size() != 6 {
+		t.Fatalf("wrong data after unsealing without key %q, size %d", entry.Data, entry.Meta.Size())
+	}
+}
+
+func TestSealWithoutKey(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{EncryptionKey: bytes.Repeat([]byte{7}, 16), Dedup: true})
+	shared := addTestFile(filesys, "s3.txt", 0, time.Now())
+	shared.write([]byte("same"), 0, false)
+	other := addTestFile(filesys, "s4.txt", 0, time.Now())
+	other.write([]byte("same"), 0, false)
+	filesys.deduplicate()
+	filesys.encryption.wipe()
+
+	// sealing fails, the data stays shared and is copied on write
+	shared.mutex.Lock()
+	shared.seal()
+	shared.mutex.Unlock()
+	shared.write([]byte("SAME"), 0, false)
+	if string(other.Bytes()) != "same" || string(shared.Bytes()) != "SAME" {
+		t.Fatalf("shared data modified %q/%q", other.Bytes(), shared.Bytes())
+	}
+}
@@ -0,0 +1,120 @@
+package ramdisk
+
+import (
+	"crypto/sha256"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// dedupTable finds files with identical content, by the SHA-256 of their data
+type dedupTable struct {
+	mutex sync.Mutex
+	blobs map[[sha256.Size]byte]*sharedData
+}
+
+// sharedData is file data shared by refs files and snapshots, it must not be modified
+type sharedData struct {
+	hash      [sha256.Size]byte // zero for data shared with snapshots only, not in the table
+	data      []byte
+	refs      int // guarded by the table's mutex
+	snapshots int // guarded by the table's mutex
+}
+
+// deduplicate shares the data of closed regular files with identical content
+func (f *ramdiskFS) deduplicate() {
+	if !f.options.Dedup {
+		return
+	}
+
+	f.root.mutex.RLock()
+	entries := append([]*FileEntry{}, f.root.entries...)
+	f.root.mutex.RUnlock()
+
+	for _, entry := range entries {
+		if !entry.regular() {
+			continue
+		}
+		entry.mutex.Lock()
+		if entry.handles == 0 && entry.shared == nil && entry.compressed == nil && len(entry.Data) > 0 {
+			f.dedup.share(entry)
+		}
+		entry.mutex.Unlock()
+	}
+}
+
+// share makes entry use the data of an identical file, or offers its own data for sharing. caller must hold entry.mutex
+func (t *dedupTable) share(entry *FileEntry) {
+	hash := sha256.Sum256(entry.Data)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.blobs == nil {
+		t.blobs = make(map[[sha256.Size]byte]*sharedData)
+	}
+	blob, found := t.blobs[hash]
+	if !found {
+		blob = &sharedData{hash: hash, data: entry.Data}
+		t.blobs[hash] = blob
+	} else {
+		entry.Data = blob.data
+		if blob.refs > 0 {
+			atomic.AddInt64(&entry.fs.metrics.bytesDeduplicated, int64(len(blob.data)))
+		}
+	}
+	blob.refs++
+	entry.shared = blob
+}
+
+// unshare stops sharing the data of entry, caller must hold entry.mutex.
+// the data is copied if other files still share it, unless keep is false
+func (t *dedupTable) unshare(entry *FileEntry, keep bool) {
+	blob := entry.shared
+	if blob == nil {
+		return
+	}
+	entry.shared = nil
+
+	t.mutex.Lock()
+	blob.refs--
+	last := blob.refs == 0 && blob.snapshots == 0
+	if blob.refs > 0 {
+		atomic.AddInt64(&entry.fs.metrics.bytesDeduplicated, -int64(len(blob.data)))
+	}
+	if last && t.blobs[blob.hash] == blob {
+		delete(t.blobs, blob.hash)
+	}
+	t.mutex.Unlock()
+
+	if !last && keep {
+		entry.Data = append([]byte{}, blob.data...)
+	}
+}
+
+// own prepares Data for modification: copied up, decrypted, decompressed, and not shared with other files. caller must hold the mutex
+func (e *FileEntry) own() {
+	if err := e.copyUp(); err != nil {
+		log.Printf("failed to copy up %q, its data is lost: %v", e.Meta.Name(), err)
+		e.Data = []byte{}
+		e.Meta.size = 0
+		e.released = false
+		atomic.StoreInt32(&e.inLower, 0)
+	}
+	e.unseal()
+	e.inflate()
+	e.fs.dedup.unshare(e, true)
+}
+
+// IsShared tells if the file shares its data with files of identical content.
+// Data must not be modified directly then, use WriteAt, SetData etc.
+func (e *FileEntry) IsShared() bool {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	if e.shared == nil {
+		return false
+	}
+	e.fs.dedup.mutex.Lock()
+	defer e.fs.dedup.mutex.Unlock()
+	return e.shared.refs > 1
+}
@@ -0,0 +1,43 @@
+package ramdisk
+
+import (
+	"testing"
+	"bytes"
+	"time"
+)
+
+func TestDedup(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{Dedup: true})
+	content := bytes.Repeat([]byte("frame"), 100)
+	first := addTestFile(filesys, "d1.jpg", 0, time.Now())
+	first.write(content, 0, false)
+	second := addTestFile(filesys, "d2.jpg", 0, time.Now())
+	second.write(content, 0, false)
+	other := addTestFile(filesys, "d3.jpg", 0, time.Now())
+	other.write([]byte("other"), 0, false)
+
+	filesys.deduplicate()
+
+	if !first.IsShared() || !second.IsShared() || other.IsShared() {
+		t.Fatal("wrong files shared")
+	}
+	if &first.Data[0] != &second.Data[0] {
+		t.Fatal("data not shared")
+	}
+	metrics := filesys.Metrics()
+	if metrics.BytesPhysical != int64(len(content))+5 || metrics.DedupRatio <= 1.9 {
+		t.Fatalf("wrong physical bytes %d, ratio %f", metrics.BytesPhysical, metrics.DedupRatio)
+	}
+
+	// copy on write
+	first.WriteAt([]byte("F"), 0)
+	if second.Data[0] != 'f' || first.Data[0] != 'F' {
+		t.Fatal("write to shared data visible in other file")
+	}
+	if first.IsShared() || second.IsShared() {
+		t.Fatal("still shared after write")
+	}
+	if metrics := filesys.Metrics(); metrics.BytesPhysical != metrics.BytesStored || metrics.DedupRatio != 1 {
+		t.Fatalf("wrong physical bytes %d/%d after copy on write", metrics.BytesStored, metrics.BytesPhysical)
+	}
+}
@@ -0,0 +1,220 @@
+package ramdisk
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+)
+
+// ErrChangeSetClosed is returned when exporting files of a change set already closed
+var ErrChangeSetClosed = errors.New("change set closed")
+
+// ChangeSet is the difference between two states of the RAM disk. It holds the data of
+// the newer state until closed, so that changed files can be exported
+type ChangeSet struct {
+	Changes []Change // ordered by name
+
+	fs      *ramdiskFS
+	to      *snapshot
+	current bool // to is the transient state of DiffCurrent, released on Close
+}
+
+// Diff compares two snapshots, listing what changed from the first to the second
+func (f *ramdiskFS) Diff(from, to SnapshotID) (*ChangeSet, error) {
+	fromSnapshot, toSnapshot := f.snapshot(from), f.snapshot(to)
+	if fromSnapshot == nil || toSnapshot == nil {
+		return nil, ErrUnknownSnapshot
+	}
+	return &ChangeSet{Changes: f.diff(fromSnapshot, toSnapshot), fs: f, to: toSnapshot}, nil
+}
+
+// DiffCurrent compares a snapshot to the current state, listing what changed since the snapshot.
+// The change set shares the data of the current files, close it when done
+func (f *ramdiskFS) DiffCurrent(from SnapshotID) (*ChangeSet, error) {
+	fromSnapshot := f.snapshot(from)
+	if fromSnapshot == nil {
+		return nil, ErrUnknownSnapshot
+	}
+	current := f.capture()
+	return &ChangeSet{Changes: f.diff(fromSnapshot, current), fs: f, to: current, current: true}, nil
+}
+
+// Close releases the data held by the change set
+func (c *ChangeSet) Close() {
+	if c.current && c.to != nil {
+		c.fs.release(c.to)
+	}
+	c.to = nil
+}
+
+// diff compares the files of two snapshots. files are identified by inode,
+// files removed and added with identical content count as renamed
+func (f *ramdiskFS) diff(from, to *snapshot) []Change {
+	fromStates := make(map[uint64]*fileState, len(from.files))
+	for _, state := range from.files {
+		fromStates[state.inode] = state
+	}
+	toStates := make(map[uint64]*fileState, len(to.files))
+	for _, state := range to.files {
+		toStates[state.inode] = state
+	}
+
+	changes := make([]Change, 0)
+	var added, removed []*fileState
+	for _, state := range to.files {
+		old, found := fromStates[state.inode]
+		switch {
+		case !found:
+			added = append(added, state)
+		case old.name != state.name:
+			changes = append(changes, Change{Name: state.name, Kind: ChangeRenamed, Size: int64(state.size), OldName: old.name, OldSize: int64(old.size)})
+		case !f.sameFile(old, state):
+			changes = append(changes, Change{Name: state.name, Kind: ChangeModified, Size: int64(state.size), OldSize: int64(old.size)})
+		}
+	}
+	for _, state := range from.files {
+		if _, found := toStates[state.inode]; !found {
+			removed = append(removed, state)
+		}
+	}
+
+	for _, state := range added {
+		renamed := -1
+		for i, old := range removed {
+			if old != nil && f.sameFile(old, state) {
+				renamed = i
+				break
+			}
+		}
+		if renamed < 0 {
+			changes = append(changes, Change{Name: state.name, Kind: ChangeAdded, Size: int64(state.size)})
+			continue
+		}
+		old := removed[renamed]
+		removed[renamed] = nil
+		changes = append(changes, Change{Name: state.name, Kind: ChangeRenamed, Size: int64(state.size), OldName: old.name, OldSize: int64(old.size)})
+	}
+	for _, state := range removed {
+		if state != nil {
+			changes = append(changes, Change{Name: state.name, Kind: ChangeRemoved, OldSize: int64(state.size)})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	return changes
+}
+
+// sameFile tells if two states of files have the same content and attributes, names aside
+func (f *ramdiskFS) sameFile(a, b *fileState) bool {
+	if a.size != b.size || a.fileType != b.fileType || a.rdev != b.rdev || a.perm != b.perm {
+		return false
+	}
+	if !reflect.DeepEqual(a.xattrs, b.xattrs) {
+		return false
+	}
+	if a.blob != nil && a.blob == b.blob || a.inLower && b.inLower && a.lower == b.lower {
+		return true
+	}
+	aData, aErr := a.bytes(f)
+	bData, bErr := b.bytes(f)
+	return aErr == nil && bErr == nil && bytes.Equal(aData, bData)
+}
+
+// WriteJSON writes the changes as a JSON array
+func (c *ChangeSet) WriteJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(c.Changes)
+}
+
+// WriteTar writes the files added, modified or renamed to a tar archive, with their content.
+// Removed files, and the old names of renamed files, are written as empty files named WhiteoutPrefix+name
+func (c *ChangeSet) WriteTar(w io.Writer) error {
+	if c.to == nil {
+		return ErrChangeSetClosed
+	}
+	states := make(map[string]*fileState, len(c.to.files))
+	for _, state := range c.to.files {
+		states[state.name] = state
+	}
+
+	archive := tar.NewWriter(w)
+	for _, change := range c.Changes {
+		whiteout := change.OldName
+		if change.Kind == ChangeRemoved {
+			whiteout = change.Name
+		}
+		if whiteout != "" {
+			header := &tar.Header{Name: WhiteoutPrefix + whiteout, Mode: 0644, Typeflag: tar.TypeReg, ModTime: c.to.taken}
+			if err := archive.WriteHeader(header); err != nil {
+				return err
+			}
+		}
+		if change.Kind == ChangeRemoved {
+			continue
+		}
+
+		state := states[change.Name]
+		if err := c.writeTarFile(archive, state); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// tarMode converts permission bits to the octal mode of tar headers
+func tarMode(mode os.FileMode) int64 {
+	tarMode := int64(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		tarMode |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		tarMode |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		tarMode |= 01000
+	}
+	return tarMode
+}
+
+func (c *ChangeSet) writeTarFile(archive *tar.Writer, state *fileState) error {
+	header := &tar.Header{
+		Name:    state.name,
+		Mode:    tarMode(state.perm.mode),
+		Uid:     int(state.perm.uid),
+		Gid:     int(state.perm.gid),
+		ModTime: state.modified,
+	}
+	switch state.fileType {
+	case 0:
+		header.Typeflag = tar.TypeReg
+		header.Size = int64(state.size)
+	case os.ModeNamedPipe:
+		header.Typeflag = tar.TypeFifo
+	case os.ModeDevice:
+		header.Typeflag = tar.TypeBlock
+	case os.ModeDevice | os.ModeCharDevice:
+		header.Typeflag = tar.TypeChar
+	default:
+		// sockets can't be archived
+		return nil
+	}
+	header.Devmajor = int64(state.rdev>>8) & 0xfff
+	header.Devminor = int64(state.rdev&0xff | state.rdev>>12&0xfff00)
+
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	if header.Typeflag != tar.TypeReg {
+		return nil
+	}
+	data, err := state.bytes(c.fs)
+	if err != nil {
+		return err
+	}
+	_, err = archive.Write(data)
+	return err
+}
@@ -0,0 +1,134 @@
+package ramdisk
+
+import (
+	"testing"
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"time"
+)
+
+func TestDiff(t *testing.T) {
+	filesys := CreateRamFS()
+	kept := addTestFile(filesys, "d1.txt", 0, time.Now())
+	kept.write([]byte("unchanged"), 0, false)
+	modified := addTestFile(filesys, "d2.txt", 0, time.Now())
+	modified.write([]byte("old"), 0, false)
+	removed := addTestFile(filesys, "d3.txt", 0, time.Now())
+	removed.write([]byte("gone"), 0, false)
+	moved := addTestFile(filesys, "d4.txt", 0, time.Now())
+	moved.write([]byte("moved content"), 0, false)
+	before := filesys.Snapshot()
+
+	modified.WriteAt([]byte("new content"), 0)
+	filesys.root.removeEntry(removed, RemovedUnlinked)
+	filesys.root.removeEntry(moved, RemovedUnlinked)
+	added := addTestFile(filesys, "d5.txt", 0, time.Now())
+	added.write([]byte("added"), 0, false)
+	renamed := addTestFile(filesys, "d6.txt", 0, time.Now())
+	renamed.write([]byte("moved content"), 0, false)
+
+	changes, err := filesys.DiffCurrent(before)
+	if err != nil {
+		t.Fatalf("diff failed: %v", err)
+	}
+	defer changes.Close()
+	expected := []Change{
+		{Name: "d2.txt", Kind: ChangeModified, Size: 11, OldSize: 3},
+		{Name: "d3.txt", Kind: ChangeRemoved, OldSize: 4},
+		{Name: "d5.txt", Kind: ChangeAdded, Size: 5},
+		{Name: "d6.txt", Kind: ChangeRenamed, Size: 13, OldName: "d4.txt", OldSize: 13},
+	}
+	if !reflect.DeepEqual(changes.Changes, expected) {
+		t.Fatalf("wrong changes %v", changes.Changes)
+	}
+
+	// the change set keeps the data it compared
+	added.WriteAt([]byte("ADDED"), 0)
+
+	var buffer bytes.Buffer
+	if err := changes.WriteJSON(&buffer); err != nil {
+		t.Fatalf("JSON failed: %v", err)
+	}
+	decoded := []Change{}
+	if err := json.Unmarshal(buffer.Bytes(), &decoded); err != nil || !reflect.DeepEqual(decoded, expected) {
+		t.Fatalf("wrong JSON %s: %v", buffer.Bytes(), err)
+	}
+
+	buffer.Reset()
+	if err := changes.WriteTar(&buffer); err != nil {
+		t.Fatalf("tar failed: %v", err)
+	}
+	archive := tar.NewReader(&buffer)
+	files := map[string]string{}
+	for {
+		header, err := archive.Next()
+		if err != nil {
+			break
+		}
+		content, _ := ioutil.ReadAll(archive)
+		files[header.Name] = string(content)
+	}
+	expectedFiles := map[string]string{
+		"d2.txt":     "new content",
+		".wh.d3.txt": "",
+		"d5.txt":     "added",
+		".wh.d4.txt": "",
+		"d6.txt":     "moved content",
+	}
+	if !reflect.DeepEqual(files, expectedFiles) {
+		t.Fatalf("wrong tar content %v", files)
+	}
+
+	// snapshot to snapshot
+	after := filesys.Snapshot()
+	if changes, err := filesys.Diff(after, after); err != nil || len(changes.Changes) != 0 {
+		t.Fatalf("snapshot differs from itself: %v", err)
+	}
+	if _, err := filesys.Diff(before, 99); err != ErrUnknownSnapshot {
+		t.Fatalf("diff to unknown snapshot: %v", err)
+	}
+}
+
+func TestDiffClosed(t *testing.T) {
+	filesys := CreateRamFS()
+	before := filesys.Snapshot()
+	addTestFile(filesys, "d7.txt", 0, time.Now()).write([]byte("after"), 0, false)
+
+	changes, err := filesys.DiffCurrent(before)
+	if err != nil {
+		t.Fatalf("diff failed: %v", err)
+	}
+	changes.Close()
+	if err := changes.WriteTar(ioutil.Discard); err != ErrChangeSetClosed {
+		t.Fatalf("expected ErrChangeSetClosed, got %v", err)
+	}
+	// the changes themselves are still there
+	if err := changes.WriteJSON(ioutil.Discard); err != nil {
+		t.Fatalf("JSON failed: %v", err)
+	}
+}
+
+func TestDiffTarMode(t *testing.T) {
+	filesys := CreateRamFS()
+	before := filesys.Snapshot()
+	entry := addTestFile(filesys, "d8", 0, time.Now())
+	entry.Meta.perm.mode = os.ModeSetuid | os.ModeSticky | 0755
+
+	changes, _ := filesys.DiffCurrent(before)
+	defer changes.Close()
+	var buffer bytes.Buffer
+	if err := changes.WriteTar(&buffer); err != nil {
+		t.Fatalf("tar failed: %v", err)
+	}
+	header, err := tar.NewReader(&buffer).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Mode != 05755 || header.FileInfo().Mode() != os.ModeSetuid|os.ModeSticky|0755 {
+		t.Fatalf("wrong mode in tar %o", header.Mode)
+	}
+}
@@ -0,0 +1,117 @@
+package ramdisk
+
+import (
+	"io"
+	"syscall"
+)
+
+// The methods below give in-process access to file data. Other than accessing Data directly,
+// they are safe against concurrent access through the mount, keep kernel caches coherent
+// and notify listeners with FileWritten.
+
+// ReadAt implements io.ReaderAt
+func (e *FileEntry) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+
+	e.rlockInflated()
+	defer e.mutex.RUnlock()
+
+	if off >= int64(e.Meta.size) {
+		return 0, io.EOF
+	}
+	var n int
+	if e.sealed != nil || e.isInLower() {
+		var err error
+		if e.sealed != nil {
+			n, err = e.readSealed(p, off)
+		} else {
+			n, err = e.readLower(p, off)
+		}
+		if err != nil {
+			return n, err
+		}
+	} else {
+		n = copy(p, e.Data[off:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Bytes returns a copy of the file data
+func (e *FileEntry) Bytes() []byte {
+	e.rlockInflated()
+	defer e.mutex.RUnlock()
+	return e.bytesLocked()
+}
+
+// bytesLocked is Bytes for callers holding the mutex, with the data inflated
+func (e *FileEntry) bytesLocked() []byte {
+	if e.sealed != nil {
+		data := make([]byte, e.Meta.size)
+		n, _ := e.readSealed(data, 0)
+		return data[:n]
+	}
+	if e.isInLower() {
+		data := make([]byte, e.Meta.size)
+		n, _ := e.readLower(data, 0)
+		return data[:n]
+	}
+	return append([]byte{}, e.Data...)
+}
+
+// WriteAt implements io.WriterAt
+func (e *FileEntry) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+
+	e.write(p, off, false)
+	e.Meta.touchModified()
+	e.modifiedInProcess()
+
+	return len(p), nil
+}
+
+// SetData replaces the file data, the file takes ownership of data
+func (e *FileEntry) SetData(data []byte) {
+	e.mutex.Lock()
+	e.unseal()
+	e.inflate()
+	e.fs.dedup.unshare(e, false)
+	e.Data = data
+	e.setSize(uint64(len(data)))
+	e.mutex.Unlock()
+
+	e.Meta.touchModified()
+	e.modifiedInProcess()
+}
+
+// Truncate cuts or zero-extends the file data to size
+func (e *FileEntry) Truncate(size uint64) {
+	e.truncate(size)
+	e.modifiedInProcess()
+}
+
+// Invalidate has to be called after modifying Data directly, instead of using WriteAt or SetData
+func (e *FileEntry) Invalidate() {
+	e.mutex.Lock()
+	e.own()
+	e.setSize(uint64(len(e.Data)))
+	e.mutex.Unlock()
+
+	e.Meta.touchModified()
+	e.modifiedInProcess()
+}
+
+func (e *FileEntry) modifiedInProcess() {
+	e.mutex.Lock()
+	e.sealIfClosed()
+	e.mutex.Unlock()
+	e.fs.evictIfNeeded()
+	e.fs.invalidate(e)
+	e.fs.backendEvents.FileWritten<-EventFileWritten{FSEvent{File: e}}
+}
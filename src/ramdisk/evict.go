@@ -0,0 +1,194 @@
+package ramdisk
+
+import (
+	"bazil.org/fuse"
+	"sort"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// EvictionPolicy selects which closed files are dropped when the RAM disk fills up
+type EvictionPolicy int
+
+const (
+	// EvictNone never drops files, writes beyond Options.Capacity fail. This is the default.
+	EvictNone EvictionPolicy = iota
+	// EvictLRU drops the least recently used file first, by last open or close.
+	EvictLRU
+	// EvictLFU drops the least frequently used file first, by number of opens.
+	EvictLFU
+	// EvictFIFO drops the oldest file first, by creation time.
+	EvictFIFO
+	// EvictOldestModified drops the file with the oldest mtime first.
+	EvictOldestModified
+)
+
+// XattrPinned protects a file from eviction while set, whatever its value
+const XattrPinned = "user.ramdisk.pinned"
+
+// RemovedEvicted is the reason of removals making room for new data, see EventFileRemoved
+const RemovedEvicted = "evicted"
+
+// Pin protects the file from eviction
+func (e *FileEntry) Pin() {
+	e.mutex.Lock()
+	e.pinned = true
+	e.mutex.Unlock()
+}
+
+// Unpin allows eviction of the file again, unless the XattrPinned attribute is set
+func (e *FileEntry) Unpin() {
+	e.mutex.Lock()
+	e.pinned = false
+	e.mutex.Unlock()
+}
+
+// Pinned tells if the file is protected from eviction, by Pin or the XattrPinned attribute
+func (e *FileEntry) Pinned() bool {
+	e.mutex.RLock()
+	pinned := e.pinned
+	e.mutex.RUnlock()
+	if pinned {
+		return true
+	}
+	_, err := e.Meta.xattrs.get(XattrPinned)
+	return err == nil
+}
+
+// evictable tells if the file may be evicted, and would free memory
+func (e *FileEntry) evictable() bool {
+	e.mutex.RLock()
+	evictable := e.handles == 0 && !e.pinned && e.Meta.size > 0
+	e.mutex.RUnlock()
+	return evictable && e.regular() && !e.Pinned()
+}
+
+// usage returns when the file was last used, and how often it was opened
+func (e *FileEntry) usage() (lastUsed time.Time, uses uint64) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.lastUsed, e.uses
+}
+
+// evictsBefore tells if policy drops a before b
+func (policy EvictionPolicy) evictsBefore(a, b *FileEntry) bool {
+	aUsed, aUses := a.usage()
+	bUsed, bUses := b.usage()
+	switch policy {
+	case EvictLFU:
+		if aUses != bUses {
+			return aUses < bUses
+		}
+		return aUsed.Before(bUsed)
+	case EvictFIFO:
+		return a.Meta.Created().Before(b.Meta.Created())
+	case EvictOldestModified:
+		return a.Meta.Modified().Before(b.Meta.Modified())
+	default:
+		return aUsed.Before(bUsed)
+	}
+}
+
+func (f *ramdiskFS) storedBytes() int64 {
+	return atomic.LoadInt64(&f.metrics.bytesStored)
+}
+
+// highWaterMark returns the stored bytes triggering eviction, zero if unlimited
+func (o Options) highWaterMark() int64 {
+	if o.HighWaterMark > 0 {
+		return o.HighWaterMark
+	}
+	return o.Capacity
+}
+
+// lowWaterMark returns the stored bytes eviction reduces to
+func (o Options) lowWaterMark() int64 {
+	if o.LowWaterMark > 0 {
+		return o.LowWaterMark
+	}
+	return o.highWaterMark()
+}
+
+// reserve makes room for growth more bytes within the capacity, evicting files if allowed.
+// The room is held until released with unreserve, once the bytes are stored or the write failed
+func (f *ramdiskFS) reserve(growth int64) error {
+	capacity := f.options.Capacity
+	if capacity <= 0 || growth <= 0 {
+		return nil
+	}
+	if f.tryReserve(growth, capacity) {
+		return nil
+	}
+	f.evict(capacity - growth - atomic.LoadInt64(&f.reserved))
+	if f.tryReserve(growth, capacity) {
+		return nil
+	}
+	return fuse.Errno(syscall.ENOSPC)
+}
+
+// tryReserve adds growth to the reserved bytes, if they fit within capacity along with the stored bytes.
+// writers add to the stored bytes before releasing their reservation, so reading the reserved bytes first never undercounts
+func (f *ramdiskFS) tryReserve(growth, capacity int64) bool {
+	for {
+		reserved := atomic.LoadInt64(&f.reserved)
+		if f.storedBytes()+reserved+growth > capacity {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&f.reserved, reserved, reserved+growth) {
+			return true
+		}
+	}
+}
+
+// unreserve releases room reserved for growth bytes
+func (f *ramdiskFS) unreserve(growth int64) {
+	if f.options.Capacity <= 0 || growth <= 0 {
+		return
+	}
+	atomic.AddInt64(&f.reserved, -growth)
+}
+
+// evictIfNeeded evicts files down to the low-water mark once the high-water mark is exceeded
+func (f *ramdiskFS) evictIfNeeded() {
+	highWaterMark := f.options.highWaterMark()
+	if highWaterMark > 0 && f.storedBytes() > highWaterMark {
+		f.evict(f.options.lowWaterMark())
+	}
+}
+
+// evict drops closed, unpinned files in the order of the eviction policy, until at most target bytes are stored
+func (f *ramdiskFS) evict(target int64) {
+	policy := f.options.Eviction
+	if policy == EvictNone {
+		return
+	}
+
+	d := f.root
+	evicted := make([]*FileEntry, 0)
+	d.mutex.Lock()
+	candidates := make([]*FileEntry, 0, len(d.entries))
+	for _, entry := range d.entries {
+		if entry.evictable() {
+			candidates = append(candidates, entry)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return policy.evictsBefore(candidates[i], candidates[j])
+	})
+	for _, entry := range candidates {
+		if f.storedBytes() <= target {
+			break
+		}
+		if entry.evictable() && d.unlinkLocked(entry) {
+			evicted = append(evicted, entry)
+		}
+	}
+	d.mutex.Unlock()
+
+	for _, entry := range evicted {
+		// eviction may happen while serving a request, invalidate asynchronously
+		go f.invalidateEntry(d, entry.Meta.Name())
+		d.removed(entry, RemovedEvicted)
+	}
+}
@@ -100,7 +100,8 @@ func main() {
 	// mount ramdisk at "/mnt/fusemnt"
 	// you can now copy files to it, like "cp mypic.jpg /mnt/fusemnt
 	// it will appear as the
-	ramdisk.MountAndServe("/mnt/myramdisk", &fsevents)
+	// only the latest frames are kept, so that ffmpeg can run forever
+	ramdisk.MountAndServeWithOptions("/mnt/myramdisk", &fsevents, ramdisk.Options{KeepFiles: 10})
 }
 
 type circle struct {
@@ -0,0 +1,268 @@
+package ramdisk
+
+import (
+	"bazil.org/fuse"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// The methods below give in-process access to the files of the RAM disk, for frontends other than
+// the FUSE mount. They act like a process working on the mount: hooks run and listeners are notified.
+// Permissions are not checked, callers act as the process owning the RAM disk.
+
+// File returns the file called name
+func (f *ramdiskFS) File(name string) (*FileEntry, bool) {
+	return f.root.findEntryByName(name)
+}
+
+// Files returns all files, in order of creation
+func (f *ramdiskFS) Files() []*FileEntry {
+	d := f.root
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return append([]*FileEntry{}, d.entries...)
+}
+
+// CreateFile creates an empty regular file called name, with permissions mode less Options.Umask
+func (f *ramdiskFS) CreateFile(name string, mode os.FileMode) (*FileEntry, error) {
+	entry, created, err := f.openFile(name, mode, true)
+	if err != nil {
+		return nil, err
+	}
+	f.closeFile(entry)
+	if !created {
+		return nil, fuse.EEXIST
+	}
+	return entry, nil
+}
+
+// RemoveFile removes the file called name, like unlink(2)
+func (f *ramdiskFS) RemoveFile(name string) error {
+	d := f.root
+	entry, found := d.findEntryByName(name)
+	if !found {
+		return fuse.ENOENT
+	}
+	if !d.removeEntry(entry, RemovedUnlinked) {
+		return fuse.ENOENT
+	}
+	f.invalidateEntry(d, name)
+	return nil
+}
+
+// WriteFile replaces the content of the file called name, like a process opening it with O_TRUNC,
+// writing data and closing it. The file is created with permissions mode less Options.Umask if missing.
+// created tells if the file was created
+func (f *ramdiskFS) WriteFile(name string, data []byte, mode os.FileMode) (entry *FileEntry, created bool, err error) {
+	entry, created, err = f.openFile(name, mode, true)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.closeFile(entry)
+
+	if entry.virtual != nil {
+		if entry.virtual.Write == nil {
+			return entry, created, fuse.Errno(syscall.EACCES)
+		}
+		if err := entry.virtual.Write(data); err != nil {
+			return entry, created, hookError(name, err)
+		}
+		return entry, created, nil
+	}
+	if entry.Meta.Type() != 0 {
+		return entry, created, fuse.Errno(syscall.EINVAL)
+	}
+
+	// the old content is kept if the hook or the capacity rejects the new one
+	if err := entry.copyUpChecked(); err != nil {
+		return entry, created, err
+	}
+	data, err = entry.interceptWrite(data, 0)
+	if err != nil {
+		return entry, created, err
+	}
+	size := int64(len(data))
+	if ringSize := entry.RingSize(); ringSize > 0 && size > ringSize {
+		size = ringSize
+	}
+	growth := size - int64(entry.Meta.Size())
+	if err := f.reserve(growth); err != nil {
+		return entry, created, err
+	}
+	entry.truncate(0)
+	f.store(entry, data, 0, false)
+	f.unreserve(growth)
+	if err := entry.commit(); err != nil {
+		return entry, created, err
+	}
+	f.backendEvents.FileFlushed <- EventFileFlushed{FSEvent{File: entry}}
+	return entry, created, nil
+}
+
+// writeThrough stores data at offset of an open file, like a write through the mount:
+// the write hook runs, capacity is reserved and listeners are notified
+func (f *ramdiskFS) writeThrough(entry *FileEntry, data []byte, offset int64, appendMode bool) error {
+	if err := entry.copyUpChecked(); err != nil {
+		return err
+	}
+	data, err := entry.interceptWrite(data, offset)
+	if err != nil {
+		return err
+	}
+	growth := entry.growth(len(data), offset, appendMode)
+	if err := f.reserve(growth); err != nil {
+		return err
+	}
+	f.store(entry, data, offset, appendMode)
+	f.unreserve(growth)
+	return nil
+}
+
+// store writes data checked by the hook, with capacity reserved, and notifies listeners
+func (f *ramdiskFS) store(entry *FileEntry, data []byte, offset int64, appendMode bool) {
+	entry.write(data, offset, appendMode)
+	entry.written()
+	f.evictIfNeeded()
+	entry.Meta.touchModified()
+	f.invalidate(entry)
+	f.backendEvents.FileWritten <- EventFileWritten{FSEvent{File: entry}}
+}
+
+// RenameFile renames the file called oldName to newName, replacing a file called newName.
+// The file is renamed in place: open handles, locks and versions stay with it
+func (f *ramdiskFS) RenameFile(oldName, newName string) error {
+	if newName == "" {
+		return fuse.EPERM
+	}
+	if err := checkName(newName); err != nil {
+		return err
+	}
+	if oldName == newName {
+		if _, found := f.File(oldName); !found {
+			return fuse.ENOENT
+		}
+		return nil
+	}
+
+	d := f.root
+	d.mutex.Lock()
+	entry, found := d.findEntryLocked(oldName)
+	if !found {
+		d.mutex.Unlock()
+		return fuse.ENOENT
+	}
+	if entry.virtual != nil {
+		d.mutex.Unlock()
+		return fuse.Errno(syscall.EINVAL)
+	}
+	replaced, replacing := d.findEntryLocked(newName)
+	if replacing && !d.unlinkLocked(replaced) {
+		replacing = false
+	}
+
+	// the old name no longer shows a file of the lower layer
+	d.whiteout(entry)
+	d.renameLocked(entry, newName)
+	d.mutex.Unlock()
+
+	entry.Meta.touchChanged()
+	if replacing {
+		d.removed(replaced, RemovedUnlinked)
+	}
+	f.invalidateEntry(d, oldName)
+	f.invalidateEntry(d, newName)
+	f.backendEvents.FileRenamed <- EventFileRenamed{FSEvent{File: entry}, oldName}
+	return nil
+}
+
+// ReadFile returns the content of the file called name, like a process opening, reading and closing it
+func (f *ramdiskFS) ReadFile(name string) ([]byte, *FileEntry, error) {
+	data, _, entry, err := f.readFile(name)
+	return data, entry, err
+}
+
+// readFile is ReadFile, also describing the file as it was when read
+func (f *ramdiskFS) readFile(name string) ([]byte, FileInfo, *FileEntry, error) {
+	entry, _, err := f.openFile(name, 0, false)
+	if err != nil {
+		return nil, FileInfo{}, nil, err
+	}
+	defer f.closeFile(entry)
+
+	if entry.virtual != nil {
+		data, err := entry.virtual.Read()
+		if err != nil {
+			return nil, FileInfo{}, entry, hookError(name, err)
+		}
+		return data, entry.Info(), entry, nil
+	}
+	if entry.Meta.Type() != 0 {
+		return nil, FileInfo{}, entry, fuse.Errno(syscall.EINVAL)
+	}
+
+	data, info := entry.content()
+	entry.Meta.touchAccessed(f.options.Atime)
+	f.backendEvents.FileRead <- EventFileRead{FSEvent{File: entry}}
+	return data, info, entry, nil
+}
+
+// openFile opens the file called name, creating it if create is set. the file has to be closed with closeFile
+func (f *ramdiskFS) openFile(name string, mode os.FileMode, create bool) (entry *FileEntry, created bool, err error) {
+	if name == "" {
+		return nil, false, fuse.EPERM
+	}
+	if err := checkName(name); err != nil {
+		return nil, false, err
+	}
+
+	d := f.root
+	if _, found := d.findEntryByName(name); !found {
+		if !create {
+			return nil, false, fuse.ENOENT
+		}
+		if err := f.checkCreate(name); err != nil {
+			return nil, false, err
+		}
+	}
+
+	d.mutex.Lock()
+	entry, found := d.findEntryLocked(name)
+	if !found {
+		if !create {
+			d.mutex.Unlock()
+			return nil, false, fuse.ENOENT
+		}
+		perm := permissions{mode: mode.Perm() &^ f.options.Umask, uid: uint32(os.Getuid()), gid: uint32(os.Getgid())}
+		entry = createFileEntry(name, f, perm)
+		entry.ringSize = f.options.ringSize(name)
+		d.linkLocked(entry)
+		created = true
+	}
+	// counted under the directory lock, so that it is not expired or rotated before
+	entry.opened()
+	d.mutex.Unlock()
+
+	if created {
+		f.metrics.addFiles(1)
+		f.backendEvents.FileCreated <- EventFileCreated{FSEvent{File: entry}}
+	} else {
+		f.backendEvents.FileOpened <- EventFileOpened{FSEvent{File: entry}}
+	}
+	return entry, created, nil
+}
+
+// checkName rejects names no file in the root directory can have, and names taken by .snapshots and versions
+func checkName(name string) error {
+	if name == "." || name == ".." || strings.Contains(name, "/") || name == SnapshotsDirName || versionName.MatchString(name) {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	return nil
+}
+
+// closeFile closes a file opened with openFile
+func (f *ramdiskFS) closeFile(entry *FileEntry) {
+	entry.closed()
+	f.backendEvents.FileClosed <- EventFileClosed{FSEvent{File: entry}}
+	f.rotate()
+}
@@ -0,0 +1,171 @@
+package ramdisk
+
+import (
+	"testing"
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs/fstestutil"
+	"errors"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"syscall"
+)
+
+func TestHandleFlags(t *testing.T) {
+	filesys := CreateRamFS()
+	entry := createFileEntry("f0.txt", filesys, permissions{mode: 0644})
+
+	readOnly := Handle{entry: entry, flags: fuse.OpenReadOnly}
+	err := readOnly.Write(context.Background(), &fuse.WriteRequest{Data: []byte("test")}, &fuse.WriteResponse{})
+	if err != fuse.Errno(syscall.EBADF) {
+		t.Fatalf("expected EBADF writing to read-only handle, got %v", err)
+	}
+
+	writeOnly := Handle{entry: entry, flags: fuse.OpenWriteOnly}
+	err = writeOnly.Read(context.Background(), &fuse.ReadRequest{Size: 4}, &fuse.ReadResponse{})
+	if err != fuse.Errno(syscall.EBADF) {
+		t.Fatalf("expected EBADF reading from write-only handle, got %v", err)
+	}
+
+	appending := Handle{entry: entry, flags: fuse.OpenWriteOnly | fuse.OpenAppend}
+	appending.Write(context.Background(), &fuse.WriteRequest{Data: []byte("abc")}, &fuse.WriteResponse{})
+	appending.Write(context.Background(), &fuse.WriteRequest{Data: []byte("def"), Offset: 0}, &fuse.WriteResponse{})
+	if string(entry.Data) != "abcdef" {
+		t.Fatalf("O_APPEND write did not go to the end: %q", entry.Data)
+	}
+}
+
+func TestOpenAppend(t *testing.T) {
+	mnt, mntErr := fstestutil.MountedT(t, CreateRamFS(), nil)
+	if mntErr != nil {
+		t.Fatal("mount failed")
+	}
+	defer mnt.Close()
+
+	path := mnt.Dir + "/" + "f1.txt"
+	ioutil.WriteFile(path, []byte("first"), 0644)
+
+	appender, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("open for append failed: %v", err)
+	}
+	appender.WriteString("second")
+	appender.Close()
+
+	byts, _ := ioutil.ReadFile(path)
+	if string(byts) != "firstsecond" {
+		t.Fatalf("wrong content after append: %q", byts)
+	}
+}
+
+func TestOpenExclusive(t *testing.T) {
+	mnt, mntErr := fstestutil.MountedT(t, CreateRamFS(), nil)
+	if mntErr != nil {
+		t.Fatal("mount failed")
+	}
+	defer mnt.Close()
+
+	path := mnt.Dir + "/" + "f2.txt"
+	first, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("exclusive create failed: %v", err)
+	}
+	first.Close()
+
+	_, err = os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if !os.IsExist(err) {
+		t.Fatalf("expected EEXIST, got %v", err)
+	}
+
+	// without O_EXCL, the existing file is opened
+	second, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("create of existing file failed: %v", err)
+	}
+	second.Close()
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	mnt, mntErr := fstestutil.MountedT(t, CreateRamFS(), nil)
+	if mntErr != nil {
+		t.Fatal("mount failed")
+	}
+	defer mnt.Close()
+
+	path := mnt.Dir + "/" + "f3.txt"
+	ioutil.WriteFile(path, []byte("content"), 0644)
+
+	reader, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer reader.Close()
+
+	if _, err := reader.Write([]byte("x")); err == nil {
+		t.Fatal("write to read-only file succeeded")
+	}
+	byts, _ := ioutil.ReadFile(path)
+	if string(byts) != "content" {
+		t.Fatalf("content changed by read-only handle: %q", byts)
+	}
+}
+
+func TestOpenTruncate(t *testing.T) {
+	mnt, mntErr := fstestutil.MountedT(t, CreateRamFS(), nil)
+	if mntErr != nil {
+		t.Fatal("mount failed")
+	}
+	defer mnt.Close()
+
+	path := mnt.Dir + "/" + "f4.txt"
+	ioutil.WriteFile(path, []byte("long content"), 0644)
+	ioutil.WriteFile(path, []byte("short"), 0644)
+
+	byts, _ := ioutil.ReadFile(path)
+	if string(byts) != "short" {
+		t.Fatalf("O_TRUNC not applied: %q", byts)
+	}
+
+	if err := os.Truncate(path, 2); err != nil {
+		t.Fatalf("truncate failed: %v", err)
+	}
+	byts, _ = ioutil.ReadFile(path)
+	if string(byts) != "sh" {
+		t.Fatalf("truncate not applied: %q", byts)
+	}
+}
+
+func TestFsync(t *testing.T) {
+	synced := make(chan string, 1)
+	filesys := CreateRamFSWithOptions(Options{
+		FsyncHandler: func(entry *FileEntry) error {
+			synced <- string(entry.Data)
+			if entry.Meta.Name() == "fail.txt" {
+				return errors.New("write-behind failed")
+			}
+			return nil
+		},
+	})
+	mnt, mntErr := fstestutil.MountedT(t, filesys, nil)
+	if mntErr != nil {
+		t.Fatal("mount failed")
+	}
+	defer mnt.Close()
+
+	writer, _ := os.Create(mnt.Dir + "/" + "f5.txt")
+	defer writer.Close()
+	writer.WriteString("durable")
+	if err := writer.Sync(); err != nil {
+		t.Fatalf("fsync failed: %v", err)
+	}
+	if data := <-synced; data != "durable" {
+		t.Fatalf("fsync handler saw %q", data)
+	}
+
+	failing, _ := os.Create(mnt.Dir + "/" + "fail.txt")
+	defer failing.Close()
+	if err := failing.Sync(); err == nil {
+		t.Fatal("fsync handler error not reported")
+	}
+	<-synced
+}
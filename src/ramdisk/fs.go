@@ -12,15 +12,48 @@ import (
 	"sync"
 	"runtime"
 	"log"
+	"io/ioutil"
 )
 
 var atomicInode uint64 = 1
 
 func CreateRamFS() *ramdiskFS {
+	return CreateRamFSWithOptions(Options{})
+}
+
+func CreateRamFSWithOptions(options Options) *ramdiskFS {
+	encryption, err := newEncryption(options.EncryptionKey)
+	if err != nil {
+		log.Panicf("invalid encryption key: %v", err)
+	}
 	filesys := &ramdiskFS{
-		backendEvents: NewFSEvents(),
+		backendEvents: newBackendEvents(),
 		addListenerChan: make(chan *FSEvents),
+		options: options,
+		encryption: encryption,
+	}
+
+	rootMode := options.RootMode.Perm()
+	if rootMode == 0 {
+		rootMode = 0755
 	}
+	now := time.Now()
+	filesys.root = &Dir{
+		fs: filesys,
+		perm: permissions{mode: rootMode, uid: uint32(os.Getuid()), gid: uint32(os.Getgid())},
+		created: now,
+		accessed: now,
+		modified: now,
+		changed: now,
+	}
+
+	if options.Lower != "" {
+		if err := filesys.root.loadLower(options.Lower); err != nil {
+			log.Printf("failed to read lower directory %q: %v", options.Lower, err)
+		}
+	}
+
+	go filesys.reaper()
 
 	eventQueueMutex := sync.Mutex{}
 	eventQueue := make([]interface{}, 0)
@@ -36,10 +69,24 @@ func CreateRamFS() *ramdiskFS {
 			case event = <-fsevents.FileRead:
 			case event = <-fsevents.FileWritten:
 			case event = <-fsevents.FileClosed:
+			case event = <-fsevents.FileFlushed:
+			case event = <-fsevents.FileSynced:
+			case event = <-fsevents.FileXattrChanged:
+			case event = <-fsevents.DirXattrChanged:
+			case event = <-fsevents.FileRenamed:
+			case event = <-fsevents.FileRemoved:
 			case event = <-fsevents.Unmount:
 			}
 			_ = event
 			eventQueueMutex.Lock()
+			maxQueued := filesys.options.MaxQueuedEvents
+			if maxQueued > 0 && len(eventQueue) >= maxQueued {
+				// drop the oldest event, listeners are too slow
+				eventQueue = eventQueue[1:]
+				atomic.AddUint64(&filesys.metrics.eventsDropped, 1)
+			} else {
+				atomic.AddInt64(&filesys.metrics.eventQueueDepth, 1)
+			}
 			eventQueue = append(eventQueue, event)
 			eventQueueMutex.Unlock()
 		}
@@ -65,11 +112,13 @@ func CreateRamFS() *ramdiskFS {
 			if len(eventQueue) > 0 {
 				event = eventQueue[0]
 				eventQueue = eventQueue[1:]
+				atomic.AddInt64(&filesys.metrics.eventQueueDepth, -1)
 			}
 			eventQueueMutex.Unlock()
 
 			if event != nil {
-				// this part relies on cooperation of listeners
+				// this part relies on cooperation of listeners.
+				// listeners get events added later than the basic ones only if they created the channel
 				for _, listener := range listenerEvents {
 					switch event.(type) {
 					case EventFileCreated:
@@ -82,6 +131,30 @@ func CreateRamFS() *ramdiskFS {
 						listener.FileRead <- event.(EventFileRead)
 					case EventFileClosed:
 						listener.FileClosed <- event.(EventFileClosed)
+					case EventFileFlushed:
+						if listener.FileFlushed != nil {
+							listener.FileFlushed <- event.(EventFileFlushed)
+						}
+					case EventFileSynced:
+						if listener.FileSynced != nil {
+							listener.FileSynced <- event.(EventFileSynced)
+						}
+					case EventFileXattrChanged:
+						if listener.FileXattrChanged != nil {
+							listener.FileXattrChanged <- event.(EventFileXattrChanged)
+						}
+					case EventDirXattrChanged:
+						if listener.DirXattrChanged != nil {
+							listener.DirXattrChanged <- event.(EventDirXattrChanged)
+						}
+					case EventFileRenamed:
+						if listener.FileRenamed != nil {
+							listener.FileRenamed <- event.(EventFileRenamed)
+						}
+					case EventFileRemoved:
+						if listener.FileRemoved != nil {
+							listener.FileRemoved <- event.(EventFileRemoved)
+						}
 					case bool:
 						listener.Unmount <- event.(bool)
 					default:
@@ -99,7 +172,20 @@ func CreateRamFS() *ramdiskFS {
 }
 
 func MountAndServe(mountpoint string, optionalListener *FSEvents) error {
-	c, err := fuse.Mount(mountpoint)
+	return MountAndServeWithOptions(mountpoint, optionalListener, Options{})
+}
+
+func MountAndServeWithOptions(mountpoint string, optionalListener *FSEvents, options Options) error {
+	if _, err := newEncryption(options.EncryptionKey); err != nil {
+		return err
+	}
+	if options.Lower != "" {
+		if _, err := ioutil.ReadDir(options.Lower); err != nil {
+			return err
+		}
+	}
+
+	c, err := fuse.Mount(mountpoint, options.mountOptions()...)
 	if err != nil {
 		log.Printf("failed to MountAndServe %q", mountpoint)
 		return err
@@ -108,21 +194,20 @@ func MountAndServe(mountpoint string, optionalListener *FSEvents) error {
 
 	defer c.Close()
 
-	filesys := CreateRamFS()
+	filesys := CreateRamFSWithOptions(options)
 
 	if optionalListener != nil {
 		filesys.AddListener(optionalListener)
 	}
 
-	if err := fs.Serve(c, filesys); err != nil {
-		log.Printf("failed to serve  a filesystem at MountAndServe %q", mountpoint)
-		return err
-	}
+	server := fs.New(c, nil)
+	filesys.SetServer(server)
 
-	// check if the MountAndServe process has an error to report
-	<-c.Ready
-	if err := c.MountError; err != nil {
-		log.Printf("failure mounting a filesystem at MountAndServe %q", mountpoint)
+	// the kernel doesn't always send DESTROY on unmount
+	err = server.Serve(filesys)
+	filesys.Destroy()
+	if err != nil {
+		log.Printf("failed to serve  a filesystem at MountAndServe %q", mountpoint)
 		return err
 	}
 
@@ -138,10 +223,21 @@ func nextInode() uint64 {
 type ramdiskFS struct {
 	backendEvents FSEvents
 	addListenerChan chan *FSEvents
+	root *Dir
+	options Options
+	server *fs.Server // set while mounted, for cache invalidation
+	metrics metrics
+	reserved int64 // bytes reserved for writes in progress, see reserve
+	dedup dedupTable
+	encryption *encryption
+	snapshots snapshotTable
+	destroyOnce sync.Once
+	webdavOnce sync.Once
+	webdavLocks *webdavLocks // created on first use
 }
 
 func (f *ramdiskFS) Root() (fs.Node, error) {
-	return &Dir{fs: f}, nil
+	return f.root, nil
 }
 
 func (f *ramdiskFS) GenerateInode(parentInode uint64, name string) uint64 {
@@ -155,92 +251,298 @@ func (f *ramdiskFS) AddListener(newListener *FSEvents) {
 type Dir struct {
 	mutex sync.RWMutex
 	fs *ramdiskFS
+	perm permissions
+	created time.Time
+	accessed time.Time
+	modified time.Time
+	changed time.Time
+	xattrs xattrStore
+	entries []*FileEntry // guarded by mutex
+	whiteouts map[string]bool // files removed from the lower layer of an overlay, guarded by mutex
+}
+
+// findEntryByName returns the file called name
+func (d *Dir) findEntryByName(name string) (*FileEntry, bool) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.findEntryLocked(name)
+}
+
+// linkLocked adds a new entry to the directory, caller must hold the mutex
+func (d *Dir) linkLocked(entry *FileEntry) {
+	d.entries = append(d.entries, entry)
+	delete(d.whiteouts, entry.Meta.name)
+	d.modified = entry.Meta.created
+	d.changed = entry.Meta.created
+}
+
+// renameLocked gives an entry of the directory a new name, caller must hold the mutex
+func (d *Dir) renameLocked(entry *FileEntry, name string) {
+	entry.Meta.mutex.Lock()
+	entry.Meta.name = name
+	entry.Meta.mutex.Unlock()
+	entry.dirEntry.Name = name
+	delete(d.whiteouts, name)
+	now := time.Now()
+	d.modified = now
+	d.changed = now
 }
 
-func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
-	entry, found := findEntryByName(name)
+// findEntryLocked is findEntryByName for callers holding the mutex
+func (d *Dir) findEntryLocked(name string) (*FileEntry, bool) {
+	for _, fileEntry := range d.entries {
+		if fileEntry.dirEntry.Name == name {
+			return fileEntry, true
+		}
+	}
+	return nil, false
+}
+
+// implements fs.NodeRequestLookuper, to check search permission on the directory
+func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (node fs.Node, err error) {
+	defer func(start time.Time) { d.fs.metrics.observe(opLookup, start, err) }(time.Now())
+
+	d.mutex.RLock()
+	permitted := d.perm.permits(req.Header, accessExec)
+	d.mutex.RUnlock()
+	if d.fs.enforcePermissions() && !permitted {
+		return nil, fuse.Errno(syscall.EACCES)
+	}
+
+	name := req.Name
+	if name == SnapshotsDirName && d.fs.options.SnapshotsDir {
+		return d.fs.snapshotsDir(), nil
+	}
+	entry, found := d.findEntryByName(name)
 	if !found {
+		if version, found := d.lookupVersion(name); found {
+			return version, nil
+		}
 		return nil, fuse.ENOENT
 	}
 	return &entry.Meta, nil
 }
 
 func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
 	a.Inode = 1
-	a.Mode = os.ModeDir | 0555
+	a.Mode = os.ModeDir | d.perm.mode
+	a.Uid = d.perm.uid
+	a.Gid = d.perm.gid
+	a.Atime = d.accessed
+	a.Mtime = d.modified
+	a.Ctime = d.changed
 	return nil
 }
 
+func (d *Dir) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	d.mutex.RLock()
+	permitted := d.perm.permits(req.Header, accessRead)
+	d.mutex.RUnlock()
+	if d.fs.enforcePermissions() && !permitted {
+		return nil, fuse.Errno(syscall.EACCES)
+	}
+	return d, nil
+}
+
 func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-	entries := make([]fuse.Dirent, 0)
-	for _, entry := range rootEntries {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	entries := make([]fuse.Dirent, 0, len(d.entries))
+	for _, entry := range d.entries {
 		entries = append(entries, entry.dirEntry)
 	}
+	if d.fs.options.SnapshotsDir {
+		entries = append(entries, fuse.Dirent{Name: SnapshotsDirName, Type: fuse.DT_Dir})
+	}
 	return entries, nil
 }
 
-func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (node fs.Node, handle fs.Handle, err error) {
+	defer func(start time.Time) { d.fs.metrics.observe(opCreate, start, err) }(time.Now())
+
 	requestedName := req.Name
 	if requestedName == "" {
 		// no file has no name
 		return nil, nil, fuse.EPERM
 	}
 
-	_, alreadyExits := findEntryByName(requestedName)
-	if alreadyExits {
-		// already exists
-		return nil, nil, fuse.EPERM
+	// opening an existing file needs search permission only, creating one write permission too
+	d.mutex.RLock()
+	searchable := d.perm.permits(req.Header, accessExec)
+	writable := d.perm.permits(req.Header, accessWrite|accessExec)
+	d.mutex.RUnlock()
+	if d.fs.enforcePermissions() && !searchable {
+		return nil, nil, fuse.Errno(syscall.EACCES)
 	}
 
-	newEntry := createFileEntry(requestedName, d.fs)
+	perm := permissions{
+		mode: req.Mode.Perm() &^ req.Umask &^ d.fs.options.Umask,
+		uid: req.Header.Uid,
+		gid: req.Header.Gid,
+	}
+
+	if _, alreadyExits := d.findEntryByName(requestedName); !alreadyExits {
+		if d.fs.enforcePermissions() && !writable {
+			return nil, nil, fuse.Errno(syscall.EACCES)
+		}
+		if err := d.fs.checkCreate(requestedName); err != nil {
+			return nil, nil, err
+		}
+	}
 
 	d.mutex.Lock()
-	rootEntries = append(rootEntries, newEntry)
+	existing, alreadyExits := d.findEntryLocked(requestedName)
+	var newEntry *FileEntry
+	if !alreadyExits {
+		if d.fs.enforcePermissions() && !writable {
+			// removed since checked
+			d.mutex.Unlock()
+			return nil, nil, fuse.Errno(syscall.EACCES)
+		}
+		newEntry = createFileEntry(requestedName, d.fs, perm)
+		newEntry.ringSize = d.fs.options.ringSize(requestedName)
+		newEntry.opened() // counted before others can see it
+		d.linkLocked(newEntry)
+	}
 	d.mutex.Unlock()
 
-	handle := Handle{inode: newEntry.Meta.inode}
+	if alreadyExits {
+		if req.Flags&fuse.OpenExclusive != 0 {
+			return nil, nil, fuse.EEXIST
+		}
+		// somebody else was faster, open the existing file instead
+		openReq := &fuse.OpenRequest{Header: req.Header, Flags: req.Flags}
+		handle, err = existing.Meta.Open(ctx, openReq, &resp.OpenResponse)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &existing.Meta, handle, nil
+	}
+
+	d.fs.metrics.addFiles(1)
+
+	handle = Handle{entry: newEntry, flags: req.Flags}
+	resp.Flags |= newEntry.openResponseFlags()
 
 	d.fs.backendEvents.FileCreated<-EventFileCreated{FSEvent{File: newEntry}}
 
+	d.fs.rotate()
+
 	return &newEntry.Meta, handle, nil
 }
 
 // implements fs.Node
 type RamFile struct {
-	fuse    *fs.Server
+	entry   *FileEntry
 	inode   uint64
 	name string
 	size   uint64
 	created time.Time
+	accessed time.Time
 	modified time.Time
-	writable bool
+	changed time.Time
+	mutex sync.RWMutex // guards name, perm and timestamps. name changes under the directory mutex too
+	perm permissions
+	fileType os.FileMode // type bits, zero for regular files
+	rdev     uint32      // device number of device nodes
+	xattrs xattrStore
 }
 
 func (f *RamFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	f.mutex.RLock()
+	a.Mode = f.fileType | f.perm.mode
+	a.Uid = f.perm.uid
+	a.Gid = f.perm.gid
+	a.Atime = f.accessed
+	a.Mtime = f.modified
+	a.Ctime = f.changed
+	f.mutex.RUnlock()
+
 	a.Inode = f.inode
-	if f.writable {
-		a.Mode = 0666
-	} else {
-		a.Mode = 0555
-	}
 	a.Size = f.size
-	a.Ctime = f.created
-	a.Mtime = f.modified
+	a.Rdev = f.rdev
 	return nil
 }
 
+// implements fs.NodeSetattrer
+func (f *RamFile) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	entry := f.entry
+
+	enforce := entry.fs.enforcePermissions()
+	now := time.Now()
+
+	// like any change, changing attributes copies up a file of the lower layer
+	if err := entry.copyUpChecked(); err != nil {
+		return err
+	}
+
+	if req.Valid.Size() {
+		growth := entry.growth(0, int64(req.Size), false)
+		if err := entry.fs.reserve(growth); err != nil {
+			return err
+		}
+		defer entry.fs.unreserve(growth)
+	}
+
+	f.mutex.Lock()
+	var err error
+	if enforce && req.Valid.Size() && !req.Valid.Handle() && !f.perm.permits(req.Header, accessWrite) {
+		// truncate(2) by path needs write permission, ftruncate(2) was checked on open
+		err = fuse.Errno(syscall.EACCES)
+	}
+	if err == nil && enforce {
+		err = checkSetTimes(f.perm, req)
+	}
+	if err == nil {
+		err = f.perm.setattr(req, enforce)
+	}
+	if err == nil {
+		setTimes(req, now, &f.accessed, &f.modified)
+		f.changed = now
+	}
+	f.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if req.Valid.Size() {
+		// truncate(2) or open(2) with O_TRUNC
+		entry.truncate(req.Size)
+		entry.mutex.Lock()
+		entry.sealIfClosed()
+		entry.mutex.Unlock()
+		entry.fs.evictIfNeeded()
+	}
+
+	return f.Attr(ctx, &resp.Attr)
+}
+
 func (f *RamFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
-	if !f.writable && !req.Flags.IsReadOnly() {
+	entry := f.entry
+
+	resp.Flags |= entry.openResponseFlags()
+
+	f.mutex.RLock()
+	permitted := f.perm.permits(req.Header, openAccess(req.Flags))
+	f.mutex.RUnlock()
+	if entry.fs.enforcePermissions() && !permitted {
 		return nil, fuse.Errno(syscall.EACCES)
 	}
-	resp.Flags |= fuse.OpenDirectIO
 
-	entry, found := findEntryByInode(f.inode)
-	if !found {
-		return nil, fuse.Errno(syscall.ENOENT)
+	if entry.virtual != nil {
+		return entry.openVirtual(req.Flags)
 	}
 
-	handle := Handle{inode: f.inode}
+	if req.Flags&fuse.OpenTruncate != 0 && !req.Flags.IsReadOnly() {
+		entry.truncate(0)
+	}
+
+	handle := Handle{entry: entry, flags: req.Flags}
+	entry.opened()
 
 	entry.fs.backendEvents.FileOpened<-EventFileOpened{FSEvent{File: entry}}
 
@@ -252,6 +554,8 @@ func (f *RamFile) Inode() uint64 {
 }
 
 func (f *RamFile) Name() string {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
 	return f.name
 }
 
@@ -259,38 +563,115 @@ func (f *RamFile) Size() uint64 {
 	return f.size
 }
 
-// implements fs.Handle, fs.HandleWriter, fs.HandleReader
+// implements fs.NodeFsyncer
+func (f *RamFile) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	entry := f.entry
+
+	if entry.fs.options.FsyncHandler != nil {
+		if err := entry.fs.options.FsyncHandler(entry); err != nil {
+			log.Printf("fsync handler failed for %q: %v", f.Name(), err)
+			return fuse.Errno(syscall.EIO)
+		}
+	}
+
+	entry.fs.backendEvents.FileSynced<-EventFileSynced{FSEvent{File: entry}}
+
+	return nil
+}
+
+// implements fs.Handle, fs.HandleWriter, fs.HandleReader, fs.HandleFlusher, fs.HandleFlockLocker, fs.HandlePOSIXLocker
 type Handle struct {
-	inode   uint64
+	entry   *FileEntry
+	flags   fuse.OpenFlags // flags the file was opened with
 }
 
-func (h Handle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
-	entry, found := findEntryByInode(h.inode)
-	if !found {
-		return fuse.Errno(syscall.ENOENT)
+func (h Handle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
+	start := time.Now()
+
+	entry := h.entry
+	defer func() { entry.fs.metrics.observe(opRead, start, err) }()
+
+	if h.flags.IsWriteOnly() {
+		return fuse.Errno(syscall.EBADF)
 	}
 
-	fuseutil.HandleRead(req, resp, entry.Data)
+	entry.rlockInflated()
+	if entry.sealed != nil {
+		err = entry.handleSealedRead(req, resp)
+	} else if entry.isInLower() {
+		err = entry.handleLowerRead(req, resp)
+	} else {
+		fuseutil.HandleRead(req, resp, entry.Data)
+	}
+	entry.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	entry.Meta.touchAccessed(entry.fs.options.Atime)
 
 	entry.fs.backendEvents.FileRead <-EventFileRead{FSEvent{File: entry}}
 
 	return nil
 }
 
-func (h Handle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+func (h Handle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	start := time.Now()
+
 	//log.Printf("try to write %s", req.ID)
 	//n, err := w.buf.Write(req.Data)
 	newBytes := req.Data
 
-	inode := h.inode
+	entry := h.entry
+	defer func() { entry.fs.metrics.observe(opWrite, start, err) }()
 
-	entry, found := findEntryByInode(inode)
-	if !found {
-		return fuse.Errno(syscall.ENOENT)
+	if h.flags.IsReadOnly() {
+		return fuse.Errno(syscall.EBADF)
+	}
+
+	// O_APPEND writes always go to the end, whatever offset the kernel assumed.
+	// but not when writing back pages of a mmap'ed file, these have to go where they belong
+	appendMode := h.flags&fuse.OpenAppend != 0 && req.Flags&fuse.WriteCache == 0
+	if err := entry.copyUpChecked(); err != nil {
+		return err
+	}
+	newBytes, err = entry.interceptWrite(newBytes, req.Offset)
+	if err != nil {
+		return err
+	}
+	growth := entry.growth(len(newBytes), req.Offset, appendMode)
+	if err := entry.fs.reserve(growth); err != nil {
+		return err
+	}
+	entry.write(newBytes, req.Offset, appendMode)
+	entry.fs.unreserve(growth)
+	entry.written()
+	entry.fs.evictIfNeeded()
+
+	entry.Meta.touchModified()
+	// a hook may have changed the data, but the writer is done with what it passed
+	resp.Size = len(req.Data)
+	//log.Printf("write: added: %d, new total: %d", resp.Size, entry.Meta.size)
+
+	entry.fs.backendEvents.FileWritten<-EventFileWritten{FSEvent{File: entry}}
+
+	return nil
+}
+
+// write stores newBytes at offset, or at the end of the data if appendMode is set
+func (entry *FileEntry) write(newBytes []byte, offset int64, appendMode bool) {
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+
+	entry.own()
+	if entry.ringSize > 0 && !appendMode {
+		newBytes, offset = entry.ringWindow(newBytes, offset)
 	}
 
 	currentDataLength := len(entry.Data)
-	offsetPos := int(req.Offset)
+	offsetPos := int(offset)
+	if appendMode {
+		offsetPos = currentDataLength
+	}
 	if (offsetPos == currentDataLength) {
 		// new data is added at the end
 		entry.Data = append(entry.Data, newBytes...)
@@ -310,67 +691,183 @@ func (h Handle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.Wr
 		entry.Data = append(entry.Data, make([]byte, missingBytes)...)
 		copy(entry.Data[offsetPos:newEndPos], newBytes[:])
 	}
-	entry.Meta.size = uint64(len(entry.Data))
+	entry.trimRing()
+	entry.setSize(uint64(len(entry.Data)))
+}
 
-	entry.Meta.modified = time.Now()
-	resp.Size = len(newBytes)
-	//log.Printf("write: added: %d, new total: %d", resp.Size, entry.Meta.size)
+// growth returns by how many bytes a write of length bytes at offset extends the data
+func (entry *FileEntry) growth(length int, offset int64, appendMode bool) int64 {
+	entry.mutex.RLock()
+	defer entry.mutex.RUnlock()
+
+	size := int64(entry.Meta.size)
+	end := offset + int64(length)
+	if appendMode {
+		end = size + int64(length)
+	} else if entry.ringSize > 0 {
+		// offsets of ring buffers count all bytes ever written, see ringWindow
+		end -= entry.discarded
+	}
+	if entry.ringSize > 0 && end > entry.ringSize {
+		// the oldest bytes are dropped, a ring buffer never grows beyond its size
+		end = entry.ringSize
+	}
+	if end < size {
+		return 0
+	}
+	return end - size
+}
 
-	entry.fs.backendEvents.FileWritten<-EventFileWritten{FSEvent{File: entry}}
+// truncate cuts or zero-extends the data to size
+func (entry *FileEntry) truncate(size uint64) {
+	entry.mutex.Lock()
+	entry.own()
+	currentDataLength := uint64(len(entry.Data))
+	if size < currentDataLength {
+		entry.Data = entry.Data[:size]
+	} else if size > currentDataLength {
+		entry.Data = append(entry.Data, make([]byte, size-currentDataLength)...)
+	}
+	if size == 0 {
+		entry.discarded = 0
+	}
+	entry.trimRing()
+	entry.setSize(uint64(len(entry.Data)))
+	entry.mutex.Unlock()
 
-	return nil
+	entry.Meta.touchModified()
 }
 
-func (h Handle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
-	inode := h.inode
+func (h Handle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	entry := h.entry
+	entry.releaseLocks(req.LockOwner, false)
 
-	entry, found := findEntryByInode(inode)
-	if !found {
-		return fuse.Errno(syscall.ENOENT)
+	if err := entry.commit(); err != nil {
+		return err
 	}
-	entry.fs.backendEvents.FileClosed<-EventFileClosed{FSEvent{File: entry}}
+
+	entry.fs.backendEvents.FileFlushed<-EventFileFlushed{FSEvent{File: entry}}
 
 	return nil
 }
 
+func (h Handle) Release(ctx context.Context, req *fuse.ReleaseRequest) (err error) {
+	start := time.Now()
 
-var rootEntries = []*FileEntry{
-}
+	entry := h.entry
+	defer func() { entry.fs.metrics.observe(opRelease, start, err) }()
+	entry.releaseLocks(req.LockOwner, req.ReleaseFlags&fuse.ReleaseFlockUnlock != 0)
+	entry.closed()
+	entry.fs.backendEvents.FileClosed<-EventFileClosed{FSEvent{File: entry}}
+	entry.fs.rotate()
 
-func findEntryByName(name string) (*FileEntry, bool) {
-	for _, fileEntry := range rootEntries {
-		if fileEntry.dirEntry.Name == name {
-			return fileEntry, true
-		}
-	}
-	return nil, false
+	return nil
 }
 
-func findEntryByInode(inode uint64) (*FileEntry, bool) {
-	for _, fileEntry := range rootEntries {
-		if fileEntry.dirEntry.Inode == inode {
-			return fileEntry, true
-		}
-	}
-	return nil, false
-}
 
 type FileEntry struct {
 	fs       *ramdiskFS
 	dirEntry fuse.Dirent
 	Meta     RamFile
 	Data     []byte
+	mutex    sync.RWMutex // guards Data and Meta.size
+	posixLocks lockTable
+	flockLocks lockTable
+	handles  int  // open handles, guarded by mutex
+	unlinked bool // removed from its directory, guarded by mutex
+	released bool // data not counted as stored: unlinked and closed, or virtual. guarded by mutex
+	pinned   bool      // protected from eviction, guarded by mutex
+	lastUsed time.Time // last open or close, guarded by mutex
+	uses     uint64    // number of opens, guarded by mutex
+	ringSize  int64 // maximum size of a ring-buffer file, zero for regular files, guarded by mutex
+	virtual   *VirtualFile // content produced by Go code, nil for regular files
+	uncommitted bool // written since the last commit, guarded by mutex
+	compressed     []byte // data of a cold file, compressed. Data is nil then, guarded by mutex
+	incompressible bool   // compression does not pay off for the current data, guarded by mutex
+	shared *sharedData // data shared with files of identical content, guarded by mutex
+	sealed [][]byte    // encrypted chunks of the data of a closed file. Data is nil then, guarded by mutex
+	versions []*Version // committed contents kept, oldest first, guarded by mutex
+	commits  int        // number of commits, guarded by mutex
+	lower   string // path of the file in the lower layer of an overlay, empty for files created in RAM
+	inLower int32  // 1 while the data is read from the lower layer, accessed atomically
+	discarded int64 // bytes dropped from the front of a ring-buffer file, guarded by mutex
+}
+
+// setSize records the new length of Data, caller must hold the mutex
+func (entry *FileEntry) setSize(size uint64) {
+	if !entry.released {
+		entry.fs.metrics.addBytes(int64(size) - int64(entry.Meta.size))
+		entry.fs.metrics.addPhysicalBytes(int64(size) - int64(entry.Meta.size))
+	}
+	entry.incompressible = false
+	entry.Meta.size = size
+}
+
+// opened counts a new open handle, open files are never compressed
+func (entry *FileEntry) opened() {
+	entry.mutex.Lock()
+	entry.inflate()
+	entry.handles++
+	entry.uses++
+	entry.lastUsed = time.Now()
+	entry.mutex.Unlock()
+}
+
+// closed counts a released handle. the data of an unlinked file is gone with its last handle
+func (entry *FileEntry) closed() {
+	entry.mutex.Lock()
+	entry.handles--
+	entry.lastUsed = time.Now()
+	entry.release()
+	if !entry.unlinked {
+		entry.sealIfClosed()
+	}
+	entry.mutex.Unlock()
+}
+
+// release stops counting the data of an unlinked file without open handles, caller must hold the mutex
+func (entry *FileEntry) release() {
+	if entry.unlinked && entry.handles == 0 && !entry.released {
+		entry.fs.metrics.addBytes(-int64(entry.Meta.size))
+		entry.fs.metrics.addPhysicalBytes(-entry.physicalSize())
+		entry.fs.dedup.unshare(entry, false)
+		entry.dropVersions()
+		entry.released = true
+	}
+}
+
+// regular tells if the file holds data written to it, other than special and virtual files and files of the lower layer
+func (entry *FileEntry) regular() bool {
+	return entry.Meta.Type() == 0 && entry.virtual == nil && !entry.isInLower()
+}
+
+// isOpen tells if the file has open handles
+func (entry *FileEntry) isOpen() bool {
+	entry.mutex.RLock()
+	defer entry.mutex.RUnlock()
+	return entry.handles > 0
 }
 
-func createFileEntry(name string, fs *ramdiskFS) (entry *FileEntry) {
+func createFileEntry(name string, fs *ramdiskFS, perm permissions) (entry *FileEntry) {
 	inode := nextInode()
 	emptyContent := make([]byte, 0)
+	now := time.Now()
 	entry = &FileEntry{
 		fs: fs,
 		dirEntry: fuse.Dirent{Inode:inode, Name: name, Type: fuse.DT_File},
-		Meta: RamFile{inode: inode, name: name, writable: true},
+		Meta: RamFile{
+			inode: inode,
+			name: name,
+			created: now,
+			accessed: now,
+			modified: now,
+			changed: now,
+			perm: perm,
+		},
 		Data: emptyContent,
+		lastUsed: now,
 	}
+	entry.Meta.entry = entry
 	return
 }
 
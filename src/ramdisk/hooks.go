@@ -0,0 +1,138 @@
+package ramdisk
+
+import (
+	"bazil.org/fuse"
+	"log"
+	"path"
+	"syscall"
+)
+
+// WriteHook intercepts writes to files with names matching Pattern (see path.Match), to validate or transform data.
+// Errors returned by hooks reach the writer: use a fuse.Errno like fuse.Errno(syscall.EINVAL), other errors are logged and reported as EIO.
+type WriteHook struct {
+	Pattern string
+
+	// Create is called before a file called name is created, an error refuses creation.
+	Create func(name string) error
+
+	// Write is called before data is written at offset, it returns the data to store instead, or an error refusing the write.
+	Write func(entry *FileEntry, data []byte, offset int64) ([]byte, error)
+
+	// Commit is called when a file written to is closed, with its content.
+	// It returns content replacing it, nil to keep it, or an error reported to the caller of close(2).
+	Commit func(entry *FileEntry, data []byte) ([]byte, error)
+}
+
+// writeHook returns the first hook matching name, nil if none matches
+func (o Options) writeHook(name string) *WriteHook {
+	for i := range o.WriteHooks {
+		if matched, _ := path.Match(o.WriteHooks[i].Pattern, name); matched {
+			return &o.WriteHooks[i]
+		}
+	}
+	return nil
+}
+
+// hookError turns the error of a hook into the error returned to the kernel
+func hookError(name string, err error) error {
+	if _, isErrno := err.(fuse.ErrorNumber); isErrno {
+		return err
+	}
+	log.Printf("write hook for %q failed: %v", name, err)
+	return fuse.Errno(syscall.EIO)
+}
+
+// checkCreate runs the create hook for a new file called name
+func (f *ramdiskFS) checkCreate(name string) error {
+	hook := f.options.writeHook(name)
+	if hook == nil || hook.Create == nil {
+		return nil
+	}
+	if err := hook.Create(name); err != nil {
+		return hookError(name, err)
+	}
+	return nil
+}
+
+// interceptWrite runs the write hook, returning the data to store
+func (e *FileEntry) interceptWrite(data []byte, offset int64) ([]byte, error) {
+	hook := e.fs.options.writeHook(e.Meta.Name())
+	if hook == nil {
+		return data, nil
+	}
+	if hook.Write != nil {
+		replacement, err := hook.Write(e, data, offset)
+		if err != nil {
+			return nil, hookError(e.Meta.Name(), err)
+		}
+		data = replacement
+	}
+	return data, nil
+}
+
+// written records a write stored, the file is committed on its next flush
+func (e *FileEntry) written() {
+	e.mutex.Lock()
+	e.uncommitted = true
+	e.mutex.Unlock()
+}
+
+// commit runs the commit hook and records a version, for a file written to since the last commit
+func (e *FileEntry) commit() error {
+	e.mutex.Lock()
+	if !e.uncommitted {
+		e.mutex.Unlock()
+		return nil
+	}
+	e.uncommitted = false
+	e.mutex.Unlock()
+
+	if err := e.runCommitHook(); err != nil {
+		return err
+	}
+	e.addVersion()
+	return nil
+}
+
+// runCommitHook lets the commit hook replace the content of the file
+func (e *FileEntry) runCommitHook() error {
+	hook := e.fs.options.writeHook(e.Meta.Name())
+	if hook == nil || hook.Commit == nil {
+		return nil
+	}
+
+	e.mutex.Lock()
+	e.inflate()
+	data := append([]byte{}, e.Data...)
+	e.mutex.Unlock()
+
+	replacement, err := hook.Commit(e, data)
+	if err != nil {
+		return hookError(e.Meta.Name(), err)
+	}
+	if replacement == nil {
+		return nil
+	}
+	size := int64(len(replacement))
+	if ringSize := e.RingSize(); ringSize > 0 && size > ringSize {
+		size = ringSize
+	}
+	growth := size - int64(e.Meta.Size())
+	if err := e.fs.reserve(growth); err != nil {
+		return err
+	}
+	defer e.fs.unreserve(growth)
+
+	e.mutex.Lock()
+	e.inflate()
+	e.fs.dedup.unshare(e, false)
+	e.Data = replacement
+	e.trimRing()
+	e.setSize(uint64(len(e.Data)))
+	e.mutex.Unlock()
+	e.Meta.touchModified()
+
+	// committing happens while serving a request for the file, invalidate asynchronously
+	go e.fs.invalidate(e)
+	return nil
+}
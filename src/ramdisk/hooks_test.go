@@ -0,0 +1,140 @@
+package ramdisk
+
+import (
+	"testing"
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs/fstestutil"
+	"bytes"
+	"errors"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+)
+
+func TestWriteHooks(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{WriteHooks: []WriteHook{
+		{
+			Pattern: "*.jpg",
+			Write: func(entry *FileEntry, data []byte, offset int64) ([]byte, error) {
+				if offset == 0 && !bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+					return nil, fuse.Errno(syscall.EINVAL)
+				}
+				return data, nil
+			},
+		},
+		{
+			Pattern: "*.txt",
+			Create: func(name string) error {
+				if strings.HasPrefix(name, "tmp") {
+					return fuse.EPERM
+				}
+				return nil
+			},
+			Write: func(entry *FileEntry, data []byte, offset int64) ([]byte, error) {
+				return bytes.ToUpper(data), nil
+			},
+			Commit: func(entry *FileEntry, data []byte) ([]byte, error) {
+				if bytes.Contains(data, []byte("SECRET")) {
+					return nil, errors.New("secret content")
+				}
+				return append(data, '!'), nil
+			},
+		},
+	}})
+	ctx := context.Background()
+
+	jpg := createFileEntry("h1.jpg", filesys, permissions{mode: 0644})
+	writer := Handle{entry: jpg, flags: fuse.OpenWriteOnly}
+	err := writer.Write(ctx, &fuse.WriteRequest{Data: []byte("not a jpeg")}, &fuse.WriteResponse{})
+	if err != fuse.Errno(syscall.EINVAL) || len(jpg.Data) != 0 {
+		t.Fatalf("expected EINVAL for non-JPEG data, got %v", err)
+	}
+
+	_, _, err = filesys.root.Create(ctx, &fuse.CreateRequest{Name: "tmp.txt"}, &fuse.CreateResponse{})
+	if err != fuse.EPERM {
+		t.Fatalf("expected EPERM from create hook, got %v", err)
+	}
+
+	txt := createFileEntry("h2.txt", filesys, permissions{mode: 0644})
+	writer = Handle{entry: txt, flags: fuse.OpenWriteOnly}
+	resp := &fuse.WriteResponse{}
+	writer.Write(ctx, &fuse.WriteRequest{Data: []byte("hello")}, resp)
+	if resp.Size != 5 || string(txt.Data) != "HELLO" {
+		t.Fatalf("write not transformed: %q", txt.Data)
+	}
+	if err := txt.commit(); err != nil || string(txt.Data) != "HELLO!" {
+		t.Fatalf("commit not applied: %q, %v", txt.Data, err)
+	}
+	if txt.commit(); string(txt.Data) != "HELLO!" {
+		t.Fatal("committed twice without writes")
+	}
+
+	writer.Write(ctx, &fuse.WriteRequest{Data: []byte("secret")}, resp)
+	if err := txt.commit(); err != fuse.Errno(syscall.EIO) {
+		t.Fatalf("expected EIO from failing commit, got %v", err)
+	}
+}
+
+func TestCommitHookLimits(t *testing.T) {
+	commits := 0
+	filesys := CreateRamFSWithOptions(Options{Capacity: 10, WriteHooks: []WriteHook{{
+		Pattern: "*.log",
+		Write: func(entry *FileEntry, data []byte, offset int64) ([]byte, error) {
+			if bytes.Contains(data, []byte("refused")) {
+				return nil, fuse.Errno(syscall.EINVAL)
+			}
+			return data, nil
+		},
+		Commit: func(entry *FileEntry, data []byte) ([]byte, error) {
+			commits++
+			return bytes.Repeat(data, 4), nil
+		},
+	}}})
+	ctx := context.Background()
+
+	// a refused write leaves nothing to commit
+	entry := createFileEntry("h3.log", filesys, permissions{mode: 0644})
+	writer := Handle{entry: entry, flags: fuse.OpenWriteOnly}
+	writer.Write(ctx, &fuse.WriteRequest{Data: []byte("refused")}, &fuse.WriteResponse{})
+	if err := entry.commit(); err != nil || commits != 0 {
+		t.Fatalf("refused write committed: %v", err)
+	}
+
+	// the replacement of the commit hook has to fit the capacity
+	writer.Write(ctx, &fuse.WriteRequest{Data: []byte("abc")}, &fuse.WriteResponse{})
+	if err := entry.commit(); err != fuse.Errno(syscall.ENOSPC) || string(entry.Data) != "abc" {
+		t.Fatalf("expected ENOSPC, got %q, %v", entry.Data, err)
+	}
+	if stored := filesys.Metrics().BytesStored; stored > 10 {
+		t.Fatalf("capacity exceeded by commit hook: %d bytes", stored)
+	}
+}
+
+func TestWriteHooksMounted(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{WriteHooks: []WriteHook{{
+		Pattern: "*.csv",
+		Commit: func(entry *FileEntry, data []byte) ([]byte, error) {
+			return bytes.Replace(data, []byte(";"), []byte(","), -1), nil
+		},
+	}}})
+	mnt, mntErr := fstestutil.MountedT(t, filesys, nil)
+	if mntErr != nil {
+		t.Fatal("mount failed")
+	}
+	defer mnt.Close()
+
+	path := mnt.Dir + "/" + "h3.csv"
+	if err := ioutil.WriteFile(path, []byte("a;b;c"), 0644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	byts, _ := ioutil.ReadFile(path)
+	if string(byts) != "a,b,c" {
+		t.Fatalf("commit hook not applied: %q", byts)
+	}
+	fileInfo, _ := os.Stat(path)
+	if fileInfo.Size() != 5 {
+		t.Fatalf("wrong size after commit %d", fileInfo.Size())
+	}
+}
@@ -0,0 +1,191 @@
+package ramdisk
+
+import (
+	"bazil.org/fuse"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// FileInfo describes a file in directory listings
+type FileInfo struct {
+	Name     string      `json:"name"`
+	Size     int64       `json:"size"`
+	Mode     os.FileMode `json:"mode"` // type and permission bits
+	Modified time.Time   `json:"modified"`
+}
+
+// Info returns a description of the file for listings
+func (e *FileEntry) Info() FileInfo {
+	return e.Meta.info(e.dataSize())
+}
+
+// content returns a copy of the file data and its description, read together so that they match
+func (e *FileEntry) content() ([]byte, FileInfo) {
+	e.rlockInflated()
+	defer e.mutex.RUnlock()
+	return e.bytesLocked(), e.Meta.info(int64(e.Meta.size))
+}
+
+func (m *RamFile) info(size int64) FileInfo {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return FileInfo{
+		Name:     m.name,
+		Size:     size,
+		Mode:     m.fileType | m.perm.mode,
+		Modified: m.modified,
+	}
+}
+
+// links of listings are relative to the listing, and path-escaped, so that no name is taken for a URL scheme
+var listingTemplate = template.Must(template.New("listing").Funcs(template.FuncMap{
+	"href": func(name string) string { return "./" + url.PathEscape(name) },
+}).Parse(`<html>
+<head><title>ramdisk</title></head>
+<body>
+<table>
+<tr><th>name</th><th>size</th><th>mode</th><th>modified</th></tr>
+{{range .}}<tr><td><a href="{{href .Name}}">{{.Name}}</a></td><td>{{.Size}}</td><td>{{.Mode}}</td><td>{{.Modified.Format "2006-01-02 15:04:05"}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// HTTPHandler returns a http.Handler serving the files of the RAM disk:
+//
+//	GET /        lists the files, as HTML, or as JSON with "Accept: application/json" or "?format=json"
+//	GET /name    returns the content, with support for ranges and ETags
+//	PUT /name    replaces the content, the file is created if missing
+//	DELETE /name removes the file
+//
+// The handler has full access to all files, see WriteFile.
+func (f *ramdiskFS) HTTPHandler() http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		name := strings.TrimPrefix(request.URL.Path, "/")
+		if name == "" {
+			f.serveListing(response, request)
+			return
+		}
+		if strings.Contains(name, "/") {
+			http.NotFound(response, request)
+			return
+		}
+
+		switch request.Method {
+		case "GET", "HEAD":
+			f.serveFile(response, request, name)
+		case "PUT":
+			f.putFile(response, request, name)
+		case "DELETE":
+			if err := f.RemoveFile(name); err != nil {
+				httpError(response, err)
+				return
+			}
+			response.WriteHeader(http.StatusNoContent)
+		case "MKCOL":
+			http.Error(response, "directories are not supported", http.StatusMethodNotAllowed)
+		default:
+			response.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+			http.Error(response, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func (f *ramdiskFS) serveListing(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" && request.Method != "HEAD" {
+		response.Header().Set("Allow", "GET, HEAD")
+		http.Error(response, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	infos := make([]FileInfo, 0)
+	for _, entry := range f.Files() {
+		infos = append(infos, entry.Info())
+	}
+
+	if request.URL.Query().Get("format") == "json" || strings.Contains(request.Header.Get("Accept"), "application/json") {
+		response.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(response).Encode(infos)
+		return
+	}
+	response.Header().Set("Content-Type", "text/html; charset=utf-8")
+	listingTemplate.Execute(response, infos)
+}
+
+func (f *ramdiskFS) serveFile(response http.ResponseWriter, request *http.Request, name string) {
+	data, info, entry, err := f.readFile(name)
+	if err != nil {
+		httpError(response, err)
+		return
+	}
+
+	if entry.virtual == nil {
+		response.Header().Set("ETag", etag(entry.Meta.Inode(), info))
+	}
+	http.ServeContent(response, request, name, info.Modified, bytes.NewReader(data))
+}
+
+func (f *ramdiskFS) putFile(response http.ResponseWriter, request *http.Request, name string) {
+	body := request.Body
+	if f.options.Capacity > 0 {
+		// a body larger than the RAM disk can never be stored
+		body = http.MaxBytesReader(response, body, f.options.Capacity)
+	}
+	data, err := ioutil.ReadAll(body)
+	if _, tooLarge := err.(*http.MaxBytesError); tooLarge {
+		http.Error(response, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, created, err := f.WriteFile(name, data, 0666)
+	if err != nil {
+		httpError(response, err)
+		return
+	}
+	if created {
+		response.WriteHeader(http.StatusCreated)
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// etag returns the ETag of the file content. ETags change with every write, as the modification time does
+func (e *FileEntry) etag() string {
+	return etag(e.Meta.Inode(), e.Info())
+}
+
+func etag(inode uint64, info FileInfo) string {
+	return fmt.Sprintf(`"%x-%x-%x"`, inode, info.Modified.UnixNano(), info.Size)
+}
+
+// httpError reports the error of a file operation with a matching status code
+func httpError(response http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if errno, isErrno := err.(fuse.Errno); isErrno {
+		switch syscall.Errno(errno) {
+		case syscall.ENOENT:
+			status = http.StatusNotFound
+		case syscall.EEXIST:
+			status = http.StatusConflict
+		case syscall.EACCES, syscall.EPERM:
+			status = http.StatusForbidden
+		case syscall.EINVAL:
+			status = http.StatusBadRequest
+		case syscall.ENOSPC:
+			status = http.StatusInsufficientStorage
+		}
+	}
+	http.Error(response, err.Error(), status)
+}
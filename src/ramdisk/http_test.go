@@ -0,0 +1,128 @@
+package ramdisk
+
+import (
+	"testing"
+	"bazil.org/fuse"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+)
+
+func serveTest(handler http.Handler, method, target, body string, header map[string]string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	for name, value := range header {
+		request.Header.Set(name, value)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestHTTPHandler(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{Versions: 2})
+	handler := filesys.HTTPHandler()
+
+	if response := serveTest(handler, "PUT", "/w1.txt", "hello world", nil); response.Code != http.StatusCreated {
+		t.Fatalf("wrong status of create %d", response.Code)
+	}
+	if response := serveTest(handler, "PUT", "/w1.txt", "hello ramdisk", nil); response.Code != http.StatusNoContent {
+		t.Fatalf("wrong status of update %d", response.Code)
+	}
+	entry, found := filesys.File("w1.txt")
+	if !found || string(entry.Bytes()) != "hello ramdisk" || len(entry.Versions()) != 2 {
+		t.Fatal("file not written like through the mount")
+	}
+
+	response := serveTest(handler, "GET", "/w1.txt", "", map[string]string{"Range": "bytes=6-"})
+	if response.Code != http.StatusPartialContent || response.Body.String() != "ramdisk" {
+		t.Fatalf("wrong range response %d %q", response.Code, response.Body.String())
+	}
+	etag := response.Header().Get("ETag")
+	if response := serveTest(handler, "GET", "/w1.txt", "", map[string]string{"If-None-Match": etag}); response.Code != http.StatusNotModified {
+		t.Fatalf("ETag not honored: %d", response.Code)
+	}
+
+	response = serveTest(handler, "GET", "/?format=json", "", nil)
+	infos := []FileInfo{}
+	if err := json.Unmarshal(response.Body.Bytes(), &infos); err != nil || len(infos) != 1 || infos[0].Name != "w1.txt" || infos[0].Size != 13 {
+		t.Fatalf("wrong listing %s: %v", response.Body.String(), err)
+	}
+	filesys.WriteFile("a:b c", nil, 0644)
+	response = serveTest(handler, "GET", "/", "", nil)
+	if !strings.Contains(response.Body.String(), `<a href="./w1.txt">`) || !strings.Contains(response.Body.String(), `<a href="./a:b%20c">`) {
+		t.Fatalf("wrong HTML listing %s", response.Body.String())
+	}
+	filesys.RemoveFile("a:b c")
+
+	if response := serveTest(handler, "DELETE", "/w1.txt", "", nil); response.Code != http.StatusNoContent {
+		t.Fatalf("wrong status of delete %d", response.Code)
+	}
+	if response := serveTest(handler, "GET", "/w1.txt", "", nil); response.Code != http.StatusNotFound {
+		t.Fatalf("removed file served: %d", response.Code)
+	}
+	if response := serveTest(handler, "MKCOL", "/dir", "", nil); response.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("wrong status of mkcol %d", response.Code)
+	}
+	if filesys.Metrics().Files != 0 || filesys.Metrics().BytesStored != 0 {
+		t.Fatal("wrong metrics after delete")
+	}
+}
+
+func TestHTTPLimits(t *testing.T) {
+	refuse := func(entry *FileEntry, data []byte, offset int64) ([]byte, error) {
+		return nil, errors.New("read-only")
+	}
+	filesys := CreateRamFSWithOptions(Options{Capacity: 10, WriteHooks: []WriteHook{{Pattern: "*.ro", Write: refuse}}})
+	handler := filesys.HTTPHandler()
+
+	if response := serveTest(handler, "PUT", "/w3.txt", strings.Repeat("x", 11), nil); response.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("wrong status of oversized put %d", response.Code)
+	}
+	for _, name := range []string{"/.snapshots", "/w3.txt@v1", "/.."} {
+		if response := serveTest(handler, "PUT", name, "x", nil); response.Code != http.StatusBadRequest {
+			t.Fatalf("wrong status of put to %q: %d", name, response.Code)
+		}
+	}
+
+	// rejected writes keep the old content
+	filesys.WriteFile("w3.txt", []byte("12345678"), 0644)
+	if _, _, err := filesys.WriteFile("w3.txt", []byte("0123456789ab"), 0644); err != fuse.Errno(syscall.ENOSPC) {
+		t.Fatalf("expected ENOSPC, got %v", err)
+	}
+	entry, _ := filesys.CreateFile("w4.ro", 0644)
+	entry.SetData([]byte("kept"))
+	filesys.WriteFile("w4.ro", []byte("lost"), 0644)
+	if data, _, _ := filesys.ReadFile("w3.txt"); string(data) != "12345678" || string(entry.Bytes()) != "kept" {
+		t.Fatalf("content truncated by rejected write: %q %q", data, entry.Bytes())
+	}
+}
+
+func TestHTTPEvents(t *testing.T) {
+	filesys := CreateRamFS()
+	fsevents := NewFSEvents()
+	fsevents.FileFlushed = make(chan EventFileFlushed)
+	filesys.AddListener(&fsevents)
+
+	go serveTest(filesys.HTTPHandler(), "PUT", "/w2.txt", "data", nil)
+
+	expected := []string{"created", "written", "flushed", "closed"}
+	for _, kind := range expected {
+		var received string
+		select {
+		case <-fsevents.FileCreated:
+			received = "created"
+		case <-fsevents.FileWritten:
+			received = "written"
+		case <-fsevents.FileFlushed:
+			received = "flushed"
+		case <-fsevents.FileClosed:
+			received = "closed"
+		}
+		if received != kind {
+			t.Fatalf("expected %s event, received %s", kind, received)
+		}
+	}
+}
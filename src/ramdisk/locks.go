@@ -0,0 +1,263 @@
+package ramdisk
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// LockRangeEnd is the largest possible end of a lock range, locking up to it locks the whole file
+const LockRangeEnd = 1<<63 - 1
+
+// LockOwner identifies the holder of locks taken in-process, see NewLockOwner
+type LockOwner uint64
+
+var atomicLockOwner uint64
+
+// NewLockOwner returns an owner identity for in-process locking, distinct from all others.
+// Locks of the same owner never conflict with each other.
+func NewLockOwner() LockOwner {
+	return LockOwner(atomic.AddUint64(&atomicLockOwner, 1))
+}
+
+// identifies a lock holder, either a kernel lock owner or an in-process one
+type lockOwner struct {
+	kernel  fuse.LockOwner
+	process LockOwner
+}
+
+// LockInfo describes a lock currently held on a file
+type LockInfo struct {
+	Flock     bool   // flock(2) lock if true, fcntl(2) byte-range lock otherwise
+	Start     uint64 // first byte locked
+	End       uint64 // last byte locked, inclusive
+	Exclusive bool   // write lock if true, read lock otherwise
+	PID       int32  // process holding the lock, 0 for in-process locks
+}
+
+type heldLock struct {
+	owner     lockOwner
+	start     uint64 // inclusive
+	end       uint64 // inclusive
+	exclusive bool
+	pid       int32
+}
+
+func (l heldLock) overlaps(start, end uint64) bool {
+	return l.start <= end && start <= l.end
+}
+
+// lockTable holds all locks of one kind (flock or POSIX) on a single file
+type lockTable struct {
+	mutex    sync.Mutex
+	locks    []heldLock
+	released chan struct{} // closed and replaced every time locks are released or downgraded
+}
+
+// conflicting returns the first lock of another owner preventing the lock, caller must hold the mutex
+func (t *lockTable) conflicting(owner lockOwner, start, end uint64, exclusive bool) (heldLock, bool) {
+	for _, l := range t.locks {
+		if l.owner != owner && l.overlaps(start, end) && (exclusive || l.exclusive) {
+			return l, true
+		}
+	}
+	return heldLock{}, false
+}
+
+// remove clears the range from all locks of owner, splitting locks if needed. caller must hold the mutex
+func (t *lockTable) remove(owner lockOwner, start, end uint64) {
+	locks := make([]heldLock, 0, len(t.locks)+1)
+	for _, l := range t.locks {
+		if l.owner != owner || !l.overlaps(start, end) {
+			locks = append(locks, l)
+			continue
+		}
+		if l.start < start {
+			head := l
+			head.end = start - 1
+			locks = append(locks, head)
+		}
+		if l.end > end {
+			tail := l
+			tail.start = end + 1
+			locks = append(locks, tail)
+		}
+	}
+	t.locks = locks
+	t.notify()
+}
+
+// notify wakes up all waiters, caller must hold the mutex
+func (t *lockTable) notify() {
+	if t.released != nil {
+		close(t.released)
+		t.released = nil
+	}
+}
+
+func (t *lockTable) tryLock(owner lockOwner, start, end uint64, exclusive bool, pid int32) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.lockLocked(owner, start, end, exclusive, pid)
+}
+
+// lockLocked places a lock, caller must hold the mutex
+func (t *lockTable) lockLocked(owner lockOwner, start, end uint64, exclusive bool, pid int32) error {
+	if end < start {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	if _, found := t.conflicting(owner, start, end, exclusive); found {
+		return fuse.Errno(syscall.EAGAIN)
+	}
+	// a new lock replaces whatever the owner held on the range before
+	t.remove(owner, start, end)
+	t.locks = append(t.locks, heldLock{owner: owner, start: start, end: end, exclusive: exclusive, pid: pid})
+	return nil
+}
+
+// lockWait places a lock, waiting for conflicting locks to be released or ctx to be done
+func (t *lockTable) lockWait(ctx context.Context, owner lockOwner, start, end uint64, exclusive bool, pid int32) error {
+	t.mutex.Lock()
+	for {
+		err := t.lockLocked(owner, start, end, exclusive, pid)
+		if err != fuse.Errno(syscall.EAGAIN) {
+			t.mutex.Unlock()
+			return err
+		}
+
+		if t.released == nil {
+			t.released = make(chan struct{})
+		}
+		released := t.released
+		t.mutex.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return fuse.Errno(syscall.EINTR)
+		}
+		t.mutex.Lock()
+	}
+}
+
+func (t *lockTable) unlock(owner lockOwner, start, end uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.remove(owner, start, end)
+}
+
+func (t *lockTable) unlockAll(owner lockOwner) {
+	t.unlock(owner, 0, LockRangeEnd)
+}
+
+func (t *lockTable) query(owner lockOwner, start, end uint64, exclusive bool) (heldLock, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.conflicting(owner, start, end, exclusive)
+}
+
+func (t *lockTable) info(flock bool) []LockInfo {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	infos := make([]LockInfo, 0, len(t.locks))
+	for _, l := range t.locks {
+		infos = append(infos, LockInfo{Flock: flock, Start: l.start, End: l.end, Exclusive: l.exclusive, PID: l.pid})
+	}
+	return infos
+}
+
+// lockTable returns the table responsible for requests with flags
+func (e *FileEntry) lockTable(flags fuse.LockFlags) *lockTable {
+	if flags&fuse.LockFlock != 0 {
+		return &e.flockLocks
+	}
+	return &e.posixLocks
+}
+
+// implements fs.HandleLocker
+func (h Handle) Lock(ctx context.Context, req *fuse.LockRequest) error {
+	entry := h.entry
+	owner := lockOwner{kernel: req.LockOwner}
+	return entry.lockTable(req.LockFlags).tryLock(owner, req.Lock.Start, req.Lock.End, req.Lock.Type == fuse.LockWrite, req.Lock.PID)
+}
+
+// implements fs.HandleLocker
+func (h Handle) LockWait(ctx context.Context, req *fuse.LockWaitRequest) error {
+	entry := h.entry
+	owner := lockOwner{kernel: req.LockOwner}
+	return entry.lockTable(req.LockFlags).lockWait(ctx, owner, req.Lock.Start, req.Lock.End, req.Lock.Type == fuse.LockWrite, req.Lock.PID)
+}
+
+// implements fs.HandleLocker
+func (h Handle) Unlock(ctx context.Context, req *fuse.UnlockRequest) error {
+	entry := h.entry
+	owner := lockOwner{kernel: req.LockOwner}
+	entry.lockTable(req.LockFlags).unlock(owner, req.Lock.Start, req.Lock.End)
+	return nil
+}
+
+// implements fs.HandleLocker
+func (h Handle) QueryLock(ctx context.Context, req *fuse.QueryLockRequest, resp *fuse.QueryLockResponse) error {
+	entry := h.entry
+	owner := lockOwner{kernel: req.LockOwner}
+	l, conflict := entry.lockTable(req.LockFlags).query(owner, req.Lock.Start, req.Lock.End, req.Lock.Type == fuse.LockWrite)
+	if conflict {
+		resp.Lock = fuse.FileLock{Start: l.start, End: l.end, Type: fuse.LockRead, PID: l.pid}
+		if l.exclusive {
+			resp.Lock.Type = fuse.LockWrite
+		}
+	}
+	return nil
+}
+
+// releaseLocks drops the locks of a kernel lock owner when its file is closed.
+// POSIX locks go away with any close, flock locks only with the last close of the open file.
+func (e *FileEntry) releaseLocks(owner fuse.LockOwner, flock bool) {
+	e.posixLocks.unlockAll(lockOwner{kernel: owner})
+	if flock {
+		e.flockLocks.unlockAll(lockOwner{kernel: owner})
+	}
+}
+
+// LockRange places a POSIX byte-range lock from start to end (inclusive), waiting until it can be placed.
+// The lock conflicts with fcntl(2) locks taken through the mount.
+func (e *FileEntry) LockRange(ctx context.Context, owner LockOwner, start, end uint64, exclusive bool) error {
+	return e.posixLocks.lockWait(ctx, lockOwner{process: owner}, start, end, exclusive, 0)
+}
+
+// TryLockRange places a POSIX byte-range lock, failing with EAGAIN if a conflicting lock is held
+func (e *FileEntry) TryLockRange(owner LockOwner, start, end uint64, exclusive bool) error {
+	return e.posixLocks.tryLock(lockOwner{process: owner}, start, end, exclusive, 0)
+}
+
+// UnlockRange releases POSIX byte-range locks of owner from start to end (inclusive)
+func (e *FileEntry) UnlockRange(owner LockOwner, start, end uint64) {
+	e.posixLocks.unlock(lockOwner{process: owner}, start, end)
+}
+
+// Flock places a whole-file lock, waiting until it can be placed.
+// The lock conflicts with flock(2) locks taken through the mount.
+func (e *FileEntry) Flock(ctx context.Context, owner LockOwner, exclusive bool) error {
+	return e.flockLocks.lockWait(ctx, lockOwner{process: owner}, 0, LockRangeEnd, exclusive, 0)
+}
+
+// TryFlock places a whole-file lock, failing with EAGAIN if a conflicting lock is held
+func (e *FileEntry) TryFlock(owner LockOwner, exclusive bool) error {
+	return e.flockLocks.tryLock(lockOwner{process: owner}, 0, LockRangeEnd, exclusive, 0)
+}
+
+// Funlock releases the whole-file lock of owner
+func (e *FileEntry) Funlock(owner LockOwner) {
+	e.flockLocks.unlockAll(lockOwner{process: owner})
+}
+
+// Locks lists all locks currently held on the file
+func (e *FileEntry) Locks() []LockInfo {
+	return append(e.flockLocks.info(true), e.posixLocks.info(false)...)
+}
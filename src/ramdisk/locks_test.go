@@ -0,0 +1,177 @@
+package ramdisk
+
+import (
+	"testing"
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs/fstestutil"
+	"golang.org/x/net/context"
+	"os"
+	"syscall"
+	"time"
+)
+
+func TestLockTableConflicts(t *testing.T) {
+	table := lockTable{}
+	a := lockOwner{kernel: 1}
+	b := lockOwner{kernel: 2}
+
+	if err := table.tryLock(a, 0, 99, false, 1); err != nil {
+		t.Fatalf("shared lock failed: %v", err)
+	}
+	if err := table.tryLock(b, 50, 149, false, 2); err != nil {
+		t.Fatalf("second shared lock failed: %v", err)
+	}
+	if err := table.tryLock(b, 0, 9, true, 2); err != fuse.Errno(syscall.EAGAIN) {
+		t.Fatalf("expected EAGAIN for conflicting exclusive lock, got %v", err)
+	}
+	// locks of the same owner never conflict, and are upgraded in place
+	if err := table.tryLock(a, 0, 9, true, 1); err != nil {
+		t.Fatalf("upgrade of own lock failed: %v", err)
+	}
+
+	// unlocking the middle of a range splits it
+	table.unlock(a, 20, 29)
+	if _, conflict := table.query(b, 20, 29, true); conflict {
+		t.Fatal("range still locked after unlock")
+	}
+	if _, conflict := table.query(b, 30, 30, true); !conflict {
+		t.Fatal("rest of range not locked anymore")
+	}
+
+	table.unlockAll(a)
+	table.unlockAll(b)
+	if len(table.locks) != 0 {
+		t.Fatalf("locks left after unlocking all: %v", table.locks)
+	}
+}
+
+func TestLockTableWait(t *testing.T) {
+	table := lockTable{}
+	a := lockOwner{process: NewLockOwner()}
+	b := lockOwner{process: NewLockOwner()}
+
+	table.tryLock(a, 0, LockRangeEnd, true, 0)
+
+	acquired := make(chan error)
+	go func() {
+		acquired <- table.lockWait(context.Background(), b, 0, LockRangeEnd, true, 0)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("lock acquired while conflicting lock held")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	table.unlockAll(a)
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatalf("waiting lock failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiter not woken up")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := table.lockWait(ctx, a, 0, 0, false, 0); err != fuse.Errno(syscall.EINTR) {
+		t.Fatalf("expected EINTR on canceled wait, got %v", err)
+	}
+}
+
+func TestFlock(t *testing.T) {
+	filesys := CreateRamFS()
+	mnt, mntErr := fstestutil.MountedT(t, filesys, nil, filesys.options.mountOptions()...)
+	if mntErr != nil {
+		t.Fatal("mount failed")
+	}
+	defer mnt.Close()
+
+	path := mnt.Dir + "/" + "l1.txt"
+	first, createErr := os.Create(path)
+	if createErr != nil {
+		t.Fatal("create failed")
+	}
+	defer first.Close()
+	second, openErr := os.Open(path)
+	if openErr != nil {
+		t.Fatal("open failed")
+	}
+	defer second.Close()
+
+	if err := syscall.Flock(int(first.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		t.Fatalf("flock failed: %v", err)
+	}
+	if err := syscall.Flock(int(second.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err != syscall.EWOULDBLOCK {
+		t.Fatalf("expected EWOULDBLOCK, got %v", err)
+	}
+
+	entry, _ := filesys.root.findEntryByName("l1.txt")
+	owner := NewLockOwner()
+	if err := entry.TryFlock(owner, false); err != fuse.Errno(syscall.EAGAIN) {
+		t.Fatalf("in-process flock not blocked, got %v", err)
+	}
+
+	// closing the file releases the lock
+	first.Close()
+	if err := entry.Flock(context.Background(), owner, false); err != nil {
+		t.Fatalf("in-process flock failed: %v", err)
+	}
+	if err := syscall.Flock(int(second.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != syscall.EWOULDBLOCK {
+		t.Fatalf("in-process lock ignored, got %v", err)
+	}
+	entry.Funlock(owner)
+	if err := syscall.Flock(int(second.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		t.Fatalf("flock after in-process unlock failed: %v", err)
+	}
+}
+
+func TestPOSIXLock(t *testing.T) {
+	filesys := CreateRamFS()
+	mnt, mntErr := fstestutil.MountedT(t, filesys, nil, filesys.options.mountOptions()...)
+	if mntErr != nil {
+		t.Fatal("mount failed")
+	}
+	defer mnt.Close()
+
+	path := mnt.Dir + "/" + "l2.txt"
+	file, createErr := os.Create(path)
+	if createErr != nil {
+		t.Fatal("create failed")
+	}
+	defer file.Close()
+
+	entry, _ := filesys.root.findEntryByName("l2.txt")
+	owner := NewLockOwner()
+	if err := entry.TryLockRange(owner, 10, 19, true); err != nil {
+		t.Fatalf("in-process range lock failed: %v", err)
+	}
+
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: 0, Start: 15, Len: 10}
+	if err := syscall.FcntlFlock(file.Fd(), syscall.F_SETLK, &lock); err != syscall.EAGAIN && err != syscall.EACCES {
+		t.Fatalf("expected conflict, got %v", err)
+	}
+
+	query := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: 0, Start: 0, Len: 0}
+	if err := syscall.FcntlFlock(file.Fd(), syscall.F_GETLK, &query); err != nil {
+		t.Fatalf("F_GETLK failed: %v", err)
+	}
+	if query.Type != syscall.F_WRLCK || query.Start != 10 || query.Len != 10 {
+		t.Fatalf("wrong conflicting lock reported: %+v", query)
+	}
+
+	free := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: 0, Start: 20, Len: 10}
+	if err := syscall.FcntlFlock(file.Fd(), syscall.F_SETLK, &free); err != nil {
+		t.Fatalf("lock of free range failed: %v", err)
+	}
+	if len(entry.Locks()) != 2 {
+		t.Fatalf("expected 2 locks, got %v", entry.Locks())
+	}
+
+	// any close releases POSIX locks of the process
+	file.Close()
+	if len(entry.Locks()) != 1 {
+		t.Fatalf("POSIX lock not released on close: %v", entry.Locks())
+	}
+}
@@ -0,0 +1,173 @@
+package ramdisk
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// operations with counts and latencies tracked
+const (
+	opLookup = iota
+	opCreate
+	opRead
+	opWrite
+	opRelease
+	opCount
+)
+
+var opNames = [opCount]string{"lookup", "create", "read", "write", "release"}
+
+// LatencyBuckets are the upper bounds of the latency histogram buckets of each operation
+var LatencyBuckets = [...]time.Duration{
+	10 * time.Microsecond,
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+// Metrics is a snapshot of the state and activity of a RAM disk
+type Metrics struct {
+	BytesStored     int64                // logical size of file data, as reported by stat
+	BytesPhysical   int64                // file data held in RAM, less than BytesStored with compression and dedup
+	DedupRatio      float64              // logical bytes per byte held after deduplication, 1 without sharing
+	Files           int64                // number of files
+	Dirs            int64                // number of directories, including the root
+	Ops             map[string]OpMetrics // per operation: lookup, create, read, write, release
+	EventQueueDepth int64                // events waiting to be delivered to listeners
+	EventsDropped   uint64               // events dropped because the queue was full
+}
+
+// OpMetrics counts calls of a single operation
+type OpMetrics struct {
+	Count   uint64
+	Errors  uint64
+	Sum     time.Duration               // total latency
+	Buckets [len(LatencyBuckets)]uint64 // cumulative: calls taking at most LatencyBuckets[i]
+}
+
+type opMetrics struct {
+	count   uint64
+	errors  uint64
+	sum     int64 // nanoseconds
+	buckets [len(LatencyBuckets)]uint64
+}
+
+// metrics of a ramdiskFS, all fields are accessed atomically
+type metrics struct {
+	bytesStored       int64
+	bytesPhysical     int64 // as if no data was shared
+	bytesDeduplicated int64 // not held, thanks to sharing identical data
+	files             int64
+	eventQueueDepth   int64
+	eventsDropped     uint64
+	ops               [opCount]opMetrics
+}
+
+// observe records a finished call of op, started at start
+func (m *metrics) observe(op int, start time.Time, err error) {
+	elapsed := time.Since(start)
+
+	o := &m.ops[op]
+	atomic.AddUint64(&o.count, 1)
+	if err != nil {
+		atomic.AddUint64(&o.errors, 1)
+	}
+	atomic.AddInt64(&o.sum, int64(elapsed))
+	for i, bound := range LatencyBuckets {
+		if elapsed <= bound {
+			atomic.AddUint64(&o.buckets[i], 1)
+		}
+	}
+}
+
+func (m *metrics) addBytes(delta int64) {
+	atomic.AddInt64(&m.bytesStored, delta)
+}
+
+func (m *metrics) addPhysicalBytes(delta int64) {
+	atomic.AddInt64(&m.bytesPhysical, delta)
+}
+
+func (m *metrics) addFiles(delta int64) {
+	atomic.AddInt64(&m.files, delta)
+}
+
+// Metrics returns a snapshot of the RAM disk's metrics
+func (f *ramdiskFS) Metrics() Metrics {
+	m := &f.metrics
+	snapshot := Metrics{
+		BytesStored:     atomic.LoadInt64(&m.bytesStored),
+		BytesPhysical:   atomic.LoadInt64(&m.bytesPhysical) - atomic.LoadInt64(&m.bytesDeduplicated),
+		DedupRatio:      1,
+		Files:           atomic.LoadInt64(&m.files),
+		Dirs:            1,
+		Ops:             make(map[string]OpMetrics, opCount),
+		EventQueueDepth: atomic.LoadInt64(&m.eventQueueDepth),
+		EventsDropped:   atomic.LoadUint64(&m.eventsDropped),
+	}
+	if deduplicated := atomic.LoadInt64(&m.bytesDeduplicated); deduplicated > 0 {
+		snapshot.DedupRatio = float64(snapshot.BytesStored) / float64(snapshot.BytesStored-deduplicated)
+	}
+	for op := range m.ops {
+		o := &m.ops[op]
+		opSnapshot := OpMetrics{
+			Count:  atomic.LoadUint64(&o.count),
+			Errors: atomic.LoadUint64(&o.errors),
+			Sum:    time.Duration(atomic.LoadInt64(&o.sum)),
+		}
+		for i := range o.buckets {
+			opSnapshot.Buckets[i] = atomic.LoadUint64(&o.buckets[i])
+		}
+		snapshot.Ops[opNames[op]] = opSnapshot
+	}
+	return snapshot
+}
+
+// MetricsHandler returns a http.Handler serving the RAM disk's metrics in the Prometheus text format
+func (f *ramdiskFS) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		f.Metrics().writePrometheus(response)
+	})
+}
+
+func (m Metrics) writePrometheus(w io.Writer) {
+	gauge := func(name, help string, value interface{}) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %v\n", name, help, name, name, value)
+	}
+	gauge("ramdisk_bytes_stored", "Logical size of file data.", m.BytesStored)
+	gauge("ramdisk_bytes_physical", "Bytes of file data held in RAM, after compression and deduplication.", m.BytesPhysical)
+	gauge("ramdisk_dedup_ratio", "Logical bytes per byte held after deduplication.", m.DedupRatio)
+	gauge("ramdisk_files", "Number of files.", m.Files)
+	gauge("ramdisk_dirs", "Number of directories.", m.Dirs)
+	gauge("ramdisk_event_queue_depth", "Events waiting to be delivered to listeners.", m.EventQueueDepth)
+
+	fmt.Fprintf(w, "# HELP ramdisk_events_dropped_total Events dropped because the queue was full.\n")
+	fmt.Fprintf(w, "# TYPE ramdisk_events_dropped_total counter\n")
+	fmt.Fprintf(w, "ramdisk_events_dropped_total %d\n", m.EventsDropped)
+
+	fmt.Fprintf(w, "# HELP ramdisk_ops_total Operations served.\n# TYPE ramdisk_ops_total counter\n")
+	for _, op := range opNames {
+		fmt.Fprintf(w, "ramdisk_ops_total{op=%q} %d\n", op, m.Ops[op].Count)
+	}
+	fmt.Fprintf(w, "# HELP ramdisk_op_errors_total Operations failed.\n# TYPE ramdisk_op_errors_total counter\n")
+	for _, op := range opNames {
+		fmt.Fprintf(w, "ramdisk_op_errors_total{op=%q} %d\n", op, m.Ops[op].Errors)
+	}
+
+	fmt.Fprintf(w, "# HELP ramdisk_op_duration_seconds Latency of operations.\n# TYPE ramdisk_op_duration_seconds histogram\n")
+	for _, op := range opNames {
+		opMetrics := m.Ops[op]
+		for i, bound := range LatencyBuckets {
+			fmt.Fprintf(w, "ramdisk_op_duration_seconds_bucket{op=%q,le=\"%g\"} %d\n", op, bound.Seconds(), opMetrics.Buckets[i])
+		}
+		fmt.Fprintf(w, "ramdisk_op_duration_seconds_bucket{op=%q,le=\"+Inf\"} %d\n", op, opMetrics.Count)
+		fmt.Fprintf(w, "ramdisk_op_duration_seconds_sum{op=%q} %g\n", op, opMetrics.Sum.Seconds())
+		fmt.Fprintf(w, "ramdisk_op_duration_seconds_count{op=%q} %d\n", op, opMetrics.Count)
+	}
+}
@@ -0,0 +1,69 @@
+package ramdisk
+
+import (
+	"testing"
+	"bazil.org/fuse/fs/fstestutil"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+func TestMetricsObserve(t *testing.T) {
+	m := metrics{}
+	m.observe(opRead, time.Now(), nil)
+	m.observe(opRead, time.Now().Add(-50*time.Millisecond), errors.New("failed"))
+
+	read := m.ops[opRead]
+	if read.count != 2 || read.errors != 1 {
+		t.Fatalf("wrong counts %d/%d", read.count, read.errors)
+	}
+	// 10ms bucket holds the fast call only, 100ms bucket both
+	if read.buckets[3] != 1 || read.buckets[4] != 2 {
+		t.Fatalf("wrong buckets %v", read.buckets)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	filesys := CreateRamFS()
+	entry := createFileEntry("n0.txt", filesys, permissions{mode: 0644})
+	entry.SetData([]byte("1234567890"))
+	entry.Truncate(4)
+
+	recorder := httptest.NewRecorder()
+	filesys.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := recorder.Body.String()
+	for _, expected := range []string{
+		"ramdisk_bytes_stored 4\n",
+		"ramdisk_dirs 1\n",
+		"ramdisk_ops_total{op=\"write\"} 0\n",
+		"ramdisk_op_duration_seconds_bucket{op=\"read\",le=\"+Inf\"} 0\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("missing %q in:\n%s", expected, body)
+		}
+	}
+}
+
+func TestMetricsMounted(t *testing.T) {
+	filesys := CreateRamFS()
+	mnt, mntErr := fstestutil.MountedT(t, filesys, nil)
+	if mntErr != nil {
+		t.Fatal("mount failed")
+	}
+	defer mnt.Close()
+
+	ioutil.WriteFile(mnt.Dir + "/" + "n1.txt", []byte("12345"), 0644)
+	ioutil.WriteFile(mnt.Dir + "/" + "n2.txt", []byte("123"), 0644)
+	ioutil.ReadFile(mnt.Dir + "/" + "n1.txt")
+
+	metrics := filesys.Metrics()
+	if metrics.Files != 2 || metrics.BytesStored != 8 {
+		t.Fatalf("wrong files/bytes: %d/%d", metrics.Files, metrics.BytesStored)
+	}
+	if metrics.Ops["create"].Count != 2 || metrics.Ops["write"].Count < 2 || metrics.Ops["read"].Count < 1 {
+		t.Fatalf("wrong op counts: %+v", metrics.Ops)
+	}
+}
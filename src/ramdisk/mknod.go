@@ -0,0 +1,102 @@
+package ramdisk
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+	"os"
+	"syscall"
+)
+
+// implements fs.NodeMknoder, for regular files, mkfifo(1), unix sockets and device nodes.
+// FIFOs and sockets are served by the kernel, device nodes are metadata only, as mounts are nodev.
+func (d *Dir) Mknod(ctx context.Context, req *fuse.MknodRequest) (fs.Node, error) {
+	fileType := req.Mode & os.ModeType
+	switch fileType {
+	case 0, os.ModeNamedPipe, os.ModeSocket, os.ModeDevice, os.ModeDevice | os.ModeCharDevice:
+	default:
+		return nil, fuse.Errno(syscall.EINVAL)
+	}
+
+	if fileType == 0 {
+		// a regular file is created like by open(2) with O_CREAT|O_EXCL, hooks and ring rules apply
+		createReq := &fuse.CreateRequest{
+			Header: req.Header,
+			Name: req.Name,
+			Flags: fuse.OpenReadOnly | fuse.OpenCreate | fuse.OpenExclusive,
+			Mode: req.Mode,
+			Umask: req.Umask,
+		}
+		node, handle, err := d.Create(ctx, createReq, &fuse.CreateResponse{})
+		if err != nil {
+			return nil, err
+		}
+		entry := handle.(Handle).entry
+		entry.closed()
+		d.fs.rotate()
+		return node, nil
+	}
+
+	d.mutex.RLock()
+	permitted := d.perm.permits(req.Header, accessWrite|accessExec)
+	d.mutex.RUnlock()
+	if d.fs.enforcePermissions() && !permitted {
+		return nil, fuse.Errno(syscall.EACCES)
+	}
+
+	perm := permissions{
+		mode: req.Mode.Perm() &^ req.Umask &^ d.fs.options.Umask,
+		uid: req.Header.Uid,
+		gid: req.Header.Gid,
+	}
+	entry := createFileEntry(req.Name, d.fs, perm)
+	entry.setType(fileType, req.Rdev)
+
+	d.mutex.Lock()
+	if _, alreadyExists := d.findEntryLocked(req.Name); alreadyExists {
+		d.mutex.Unlock()
+		return nil, fuse.EEXIST
+	}
+	d.linkLocked(entry)
+	d.mutex.Unlock()
+
+	d.fs.metrics.addFiles(1)
+	d.fs.backendEvents.FileCreated <- EventFileCreated{FSEvent{File: entry}}
+	d.fs.rotate()
+
+	return &entry.Meta, nil
+}
+
+// setType makes a new entry a special file, before it is linked to a directory
+func (e *FileEntry) setType(fileType os.FileMode, rdev uint32) {
+	e.Meta.fileType = fileType
+	e.Meta.rdev = rdev
+	e.dirEntry.Type = direntType(fileType)
+}
+
+// direntType maps the type bits of a mode to the type reported by readdir(3)
+func direntType(fileType os.FileMode) fuse.DirentType {
+	switch {
+	case fileType&os.ModeNamedPipe != 0:
+		return fuse.DT_FIFO
+	case fileType&os.ModeSocket != 0:
+		return fuse.DT_Socket
+	case fileType&os.ModeCharDevice != 0:
+		return fuse.DT_Char
+	case fileType&os.ModeDevice != 0:
+		return fuse.DT_Block
+	default:
+		return fuse.DT_File
+	}
+}
+
+// Type returns the type bits of the file: zero for regular files, os.ModeNamedPipe, os.ModeSocket,
+// os.ModeDevice for block devices, or os.ModeDevice|os.ModeCharDevice for character devices
+func (f *RamFile) Type() os.FileMode {
+	return f.fileType
+}
+
+// Rdev returns the device number of a device node
+func (f *RamFile) Rdev() uint32 {
+	return f.rdev
+}
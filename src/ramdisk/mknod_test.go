@@ -0,0 +1,113 @@
+package ramdisk
+
+import (
+	"testing"
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs/fstestutil"
+	"errors"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+)
+
+func TestMknodTypes(t *testing.T) {
+	filesys := CreateRamFS()
+	ctx := context.Background()
+
+	for _, test := range []struct {
+		name       string
+		mode       os.FileMode
+		direntType fuse.DirentType
+		rdev       uint32
+	}{
+		{"k1", os.ModeNamedPipe | 0644, fuse.DT_FIFO, 42},
+		{"k2", os.ModeSocket | 0644, fuse.DT_Socket, 42},
+		{"k3", os.ModeDevice | os.ModeCharDevice | 0600, fuse.DT_Char, 42},
+		{"k4", os.ModeDevice | 0600, fuse.DT_Block, 42},
+		{"k5", 0644, fuse.DT_File, 0}, // created like with open(2), rdev is ignored
+	} {
+		node, err := filesys.root.Mknod(ctx, &fuse.MknodRequest{Name: test.name, Mode: test.mode, Rdev: 42})
+		if err != nil {
+			t.Fatalf("mknod %s failed: %v", test.name, err)
+		}
+		attr := fuse.Attr{}
+		node.Attr(ctx, &attr)
+		if attr.Mode != test.mode || attr.Rdev != test.rdev {
+			t.Fatalf("%s: wrong attributes %v/%d", test.name, attr.Mode, attr.Rdev)
+		}
+	}
+
+	dirents, _ := filesys.root.ReadDirAll(ctx)
+	if len(dirents) != 5 || dirents[0].Type != fuse.DT_FIFO || dirents[2].Type != fuse.DT_Char {
+		t.Fatalf("wrong dirents %v", dirents)
+	}
+
+	if _, err := filesys.root.Mknod(ctx, &fuse.MknodRequest{Name: "k1", Mode: os.ModeNamedPipe}); err != fuse.EEXIST {
+		t.Fatalf("expected EEXIST, got %v", err)
+	}
+	if _, err := filesys.root.Mknod(ctx, &fuse.MknodRequest{Name: "k6", Mode: os.ModeDir}); err != fuse.Errno(syscall.EINVAL) {
+		t.Fatalf("expected EINVAL, got %v", err)
+	}
+}
+
+func TestMknodRegular(t *testing.T) {
+	refused := errors.New("refused")
+	filesys := CreateRamFSWithOptions(Options{
+		RingRules: []RingRule{{Pattern: "*.log", Size: 4}},
+		WriteHooks: []WriteHook{{Pattern: "*.bin", Create: func(name string) error { return refused }}},
+	})
+	ctx := context.Background()
+
+	if _, err := filesys.root.Mknod(ctx, &fuse.MknodRequest{Name: "k9.bin", Mode: 0644}); err == nil {
+		t.Fatal("mknod of a file refused by the hook succeeded")
+	}
+	if _, found := filesys.File("k9.bin"); found {
+		t.Fatal("refused file was created")
+	}
+
+	if _, err := filesys.root.Mknod(ctx, &fuse.MknodRequest{Name: "k10.log", Mode: 0644}); err != nil {
+		t.Fatalf("mknod failed: %v", err)
+	}
+	entry, _ := filesys.File("k10.log")
+	if entry.RingSize() != 4 {
+		t.Fatalf("ring rule not applied, ring size %d", entry.RingSize())
+	}
+	if entry.handles != 0 {
+		t.Fatalf("file left open, %d handles", entry.handles)
+	}
+	if _, err := filesys.root.Mknod(ctx, &fuse.MknodRequest{Name: "k10.log", Mode: 0644}); err != fuse.EEXIST {
+		t.Fatalf("expected EEXIST, got %v", err)
+	}
+}
+
+func TestFifoAndSocket(t *testing.T) {
+	mnt, mntErr := fstestutil.MountedT(t, CreateRamFS(), nil)
+	if mntErr != nil {
+		t.Fatal("mount failed")
+	}
+	defer mnt.Close()
+
+	fifo := mnt.Dir + "/" + "k7.fifo"
+	if err := syscall.Mkfifo(fifo, 0644); err != nil {
+		t.Fatalf("mkfifo failed: %v", err)
+	}
+	go ioutil.WriteFile(fifo, []byte("through the pipe"), 0)
+	byts, _ := ioutil.ReadFile(fifo)
+	if string(byts) != "through the pipe" {
+		t.Fatalf("wrong data from fifo %q", byts)
+	}
+
+	socket := mnt.Dir + "/" + "k8.sock"
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("listen on unix socket failed: %v", err)
+	}
+	defer listener.Close()
+
+	fileInfo, _ := os.Stat(socket)
+	if fileInfo.Mode()&os.ModeSocket == 0 {
+		t.Fatalf("wrong type of socket %v", fileInfo.Mode())
+	}
+}
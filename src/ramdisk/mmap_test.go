@@ -0,0 +1,108 @@
+package ramdisk
+
+import (
+	"testing"
+	"bazil.org/fuse/fs/fstestutil"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+func TestExecuteBinary(t *testing.T) {
+	binary, err := ioutil.ReadFile("/bin/echo")
+	if err != nil {
+		t.Skip("no /bin/echo to copy")
+	}
+
+	mnt, mntErr := fstestutil.MountedT(t, CreateRamFS(), nil)
+	if mntErr != nil {
+		t.Fatal("mount failed")
+	}
+	defer mnt.Close()
+
+	path := mnt.Dir + "/" + "echo"
+	if err := ioutil.WriteFile(path, binary, 0755); err != nil {
+		t.Fatalf("copy of binary failed: %v", err)
+	}
+
+	output, err := exec.Command(path, "hello", "ramdisk").Output()
+	if err != nil {
+		t.Fatalf("executing binary from the mount failed: %v", err)
+	}
+	if string(output) != "hello ramdisk\n" {
+		t.Fatalf("wrong output %q", output)
+	}
+}
+
+func TestMmapRead(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{Cache: CacheKernel})
+	mnt, mntErr := fstestutil.MountedT(t, filesys, nil)
+	if mntErr != nil {
+		t.Fatal("mount failed")
+	}
+	defer mnt.Close()
+	filesys.SetServer(mnt.Server)
+
+	path := mnt.Dir + "/" + "m1.txt"
+	ioutil.WriteFile(path, []byte("mapped content"), 0644)
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal("open failed")
+	}
+	defer file.Close()
+
+	mapped, err := syscall.Mmap(int(file.Fd()), 0, 14, syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		t.Fatalf("mmap failed: %v", err)
+	}
+	defer syscall.Munmap(mapped)
+
+	if string(mapped) != "mapped content" {
+		t.Fatalf("wrong mapped content %q", mapped)
+	}
+
+	// in-process changes invalidate mapped pages
+	entry, _ := filesys.root.findEntryByName("m1.txt")
+	entry.WriteAt([]byte("MAPPED"), 0)
+	if string(mapped) != "MAPPED content" {
+		t.Fatalf("stale mapped content after in-process change: %q", mapped)
+	}
+}
+
+func TestMmapSharedWrite(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{Cache: CacheKernel})
+	mnt, mntErr := fstestutil.MountedT(t, filesys, nil)
+	if mntErr != nil {
+		t.Fatal("mount failed")
+	}
+	defer mnt.Close()
+
+	path := mnt.Dir + "/" + "m2.txt"
+	ioutil.WriteFile(path, []byte("0123456789"), 0644)
+
+	// O_APPEND must not move write-back of mapped pages to the end
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal("open failed")
+	}
+	defer file.Close()
+
+	mapped, err := syscall.Mmap(int(file.Fd()), 0, 10, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		t.Fatalf("shared writable mmap failed: %v", err)
+	}
+	copy(mapped[2:], "ab")
+	// msync(2) writes back dirty pages
+	if err := unix.Msync(mapped, unix.MS_SYNC); err != nil {
+		t.Fatalf("msync failed: %v", err)
+	}
+	syscall.Munmap(mapped)
+
+	entry, _ := filesys.root.findEntryByName("m2.txt")
+	if string(entry.Bytes()) != "01ab456789" {
+		t.Fatalf("mapped write not stored: %q", entry.Bytes())
+	}
+}
@@ -19,6 +19,30 @@ type EventFileWritten struct {
 type EventFileClosed struct {
 	FSEvent
 }
+type EventFileFlushed struct {
+	FSEvent
+}
+type EventFileSynced struct {
+	FSEvent
+}
+type EventFileXattrChanged struct {
+	FSEvent
+	Name    string // name of the extended attribute
+	Removed bool   // true if the attribute was removed, false if it was set
+}
+type EventDirXattrChanged struct {
+	Dir     *Dir   // the root directory
+	Name    string // name of the extended attribute
+	Removed bool   // true if the attribute was removed, false if it was set
+}
+type EventFileRenamed struct {
+	FSEvent
+	OldName string // the name the file had before
+}
+type EventFileRemoved struct {
+	FSEvent
+	Reason string // why the file was removed: RemovedUnlinked, RemovedExpired, RemovedEvicted, RemovedRotated or RemovedRolledBack
+}
 
 type FSEvents struct {
 	FileCreated chan EventFileCreated
@@ -26,9 +50,18 @@ type FSEvents struct {
 	FileRead    chan EventFileRead
 	FileWritten chan EventFileWritten
 	FileClosed  chan EventFileClosed
+	FileFlushed chan EventFileFlushed
+	FileSynced  chan EventFileSynced
+	FileXattrChanged chan EventFileXattrChanged
+	DirXattrChanged chan EventDirXattrChanged
+	FileRenamed chan EventFileRenamed
+	FileRemoved chan EventFileRemoved
 	Unmount     chan bool
 }
 
+// NewFSEvents creates the channels of the events every listener receives.
+// FileFlushed, FileSynced, FileXattrChanged, DirXattrChanged, FileRenamed and FileRemoved are left nil, listeners asking for these events
+// create the channels before being added.
 func NewFSEvents() (fsevents FSEvents) {
 	fsevents = FSEvents{
 		FileCreated: make(chan EventFileCreated),
@@ -40,3 +73,15 @@ func NewFSEvents() (fsevents FSEvents) {
 	}
 	return
 }
+
+// newBackendEvents creates the channels of all events, for the RAM disk sending them
+func newBackendEvents() (fsevents FSEvents) {
+	fsevents = NewFSEvents()
+	fsevents.FileFlushed = make(chan EventFileFlushed)
+	fsevents.FileSynced = make(chan EventFileSynced)
+	fsevents.FileXattrChanged = make(chan EventFileXattrChanged)
+	fsevents.DirXattrChanged = make(chan EventDirXattrChanged)
+	fsevents.FileRenamed = make(chan EventFileRenamed)
+	fsevents.FileRemoved = make(chan EventFileRemoved)
+	return
+}
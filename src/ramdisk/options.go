@@ -0,0 +1,130 @@
+package ramdisk
+
+import (
+	"bazil.org/fuse"
+	"os"
+	"time"
+)
+
+// Options configures a RAM disk. The zero value gives the defaults used by CreateRamFS and MountAndServe.
+type Options struct {
+	// AllowOther lets users other than the one mounting access the file system (fuse allow_other).
+	// This needs "user_allow_other" in /etc/fuse.conf when not mounting as root.
+	AllowOther bool
+
+	// DefaultPermissions leaves permission checks to the kernel (fuse default_permissions).
+	// Otherwise the RAM disk checks permissions itself, without knowledge of supplementary groups.
+	DefaultPermissions bool
+
+	// Umask is cleared from the mode of every created file, in addition to the creator's umask.
+	Umask os.FileMode
+
+	// RootMode holds the permission bits of the root directory, 0755 if zero.
+	// The root directory is owned by the user running the process.
+	RootMode os.FileMode
+
+	// Atime selects when reading a file updates its access time, AtimeRelative if zero.
+	Atime AtimeMode
+
+	// Cache selects how the kernel caches file data, CacheDirectIO if zero.
+	// Use CacheKernel or CacheKeep for mmap(2) support and fast repeated reads.
+	Cache CacheMode
+
+	// CacheRules override Cache for files with matching names, the first matching rule applies.
+	CacheRules []CacheRule
+
+	// FsyncHandler is called when a file is fsync'ed, before fsync(2) returns, e.g. for write-behind to durable storage.
+	// An error is logged and reported as EIO to the caller of fsync(2).
+	FsyncHandler func(entry *FileEntry) error
+
+	// MaxQueuedEvents limits the events queued for slow listeners, the oldest events are dropped if exceeded.
+	// Zero means no limit.
+	MaxQueuedEvents int
+
+	// TTL removes files not modified (or not accessed, see TTLBase) for longer, unless they are open.
+	// Zero means files never expire. Directories override TTL and TTLBase with the XattrTTL and XattrTTLBase attributes.
+	TTL time.Duration
+
+	// TTLBase selects the timestamp the TTL counts from, TTLModified if zero.
+	TTLBase TTLBase
+
+	// ReapInterval is how often expired files are looked for, a second if zero.
+	ReapInterval time.Duration
+
+	// Capacity limits the bytes stored, writes beyond fail with ENOSPC unless eviction makes room.
+	// Zero means no limit.
+	Capacity int64
+
+	// Eviction selects which closed files are dropped when stored bytes exceed the high-water mark, EvictNone if zero.
+	// Open and pinned files are never evicted.
+	Eviction EvictionPolicy
+
+	// HighWaterMark is the number of stored bytes triggering eviction, Capacity if zero.
+	HighWaterMark int64
+
+	// LowWaterMark is the number of stored bytes eviction reduces to, HighWaterMark if zero.
+	LowWaterMark int64
+
+	// RingRules make new files with matching names ring buffers, keeping only the last bytes written.
+	// The first matching rule applies.
+	RingRules []RingRule
+
+	// KeepFiles limits the number of files in a directory, creating more removes the oldest closed files.
+	// Zero means no limit. Directories override it with the XattrKeepFiles attribute.
+	KeepFiles int
+
+	// KeepBytes limits the bytes stored in a directory, the oldest closed files are removed when exceeded.
+	// Zero means no limit. Directories override it with the XattrKeepBytes attribute.
+	KeepBytes int64
+
+	// WriteHooks validate or transform data written to files with matching names, the first matching hook applies.
+	WriteHooks []WriteHook
+
+	// CompressAfter compresses the data of files not opened for longer, they are decompressed on the next open.
+	// Zero means no compression. Compression runs every ReapInterval.
+	CompressAfter time.Duration
+
+	// Dedup shares the data of closed files with identical content, it is copied again when written to.
+	// Deduplication runs every ReapInterval.
+	Dedup bool
+
+	// EncryptionKey keeps the data of closed files encrypted in RAM with AES-GCM, an AES-128, -192 or -256 key.
+	// The slice is overwritten with zeros on unmount, data is unreadable from then on.
+	EncryptionKey []byte
+
+	// SnapshotsDir exposes snapshots taken with Snapshot as read-only directories .snapshots/<id>/ in the root.
+	SnapshotsDir bool
+
+	// Versions keeps the last contents of each file, recorded when a file written to is closed.
+	// Zero keeps none. Directories override it with the XattrVersions attribute.
+	Versions int
+
+	// VersionBytes limits the bytes of versions kept per file, the oldest are dropped when exceeded.
+	// Zero means no limit. Directories override it with the XattrVersionBytes attribute.
+	VersionBytes int64
+
+	// Lower is a host directory the RAM disk is laid over: its files can be read, while writes, new files
+	// and removals stay in RAM. Files are copied up into RAM when first written to.
+	// The lower directory is read once, only regular files directly in it are visible.
+	Lower string
+
+	// P9Users selects whom the users attaching over 9P are taken for, P9PeerUser if zero:
+	// clients on unix sockets are taken for the user of the connecting process, root is squashed on other listeners.
+	P9Users P9UserMapping
+
+	// P9AnonUid and P9AnonGid identify the user squashed 9P users are taken for, nobody (65534) if both are zero.
+	P9AnonUid uint32
+	P9AnonGid uint32
+}
+
+func (o Options) mountOptions() []fuse.MountOption {
+	// let the RAM disk handle locks, so that locks are shared with in-process users
+	mountOptions := []fuse.MountOption{fuse.LockingFlock(), fuse.LockingPOSIX()}
+	if o.AllowOther {
+		mountOptions = append(mountOptions, fuse.AllowOther())
+	}
+	if o.DefaultPermissions {
+		mountOptions = append(mountOptions, fuse.DefaultPermissions())
+	}
+	return mountOptions
+}
@@ -0,0 +1,222 @@
+package ramdisk
+
+import (
+	"bazil.org/fuse"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// WhiteoutPrefix marks files removed from the lower layer in an exported upper layer, like in OCI image layers
+const WhiteoutPrefix = ".wh."
+
+// ChangeKind tells how a file differs from what it is compared to
+type ChangeKind string
+
+const (
+	ChangeAdded    ChangeKind = "added"
+	ChangeModified ChangeKind = "modified"
+	ChangeRemoved  ChangeKind = "removed"
+	ChangeRenamed  ChangeKind = "renamed"
+)
+
+// Change is a file differing between two states of the RAM disk
+type Change struct {
+	Name    string     `json:"name"`
+	Kind    ChangeKind `json:"kind"`
+	Size    int64      `json:"size"`               // bytes of the file after the change, zero for removals
+	OldName string     `json:"old_name,omitempty"` // name before a rename
+	OldSize int64      `json:"old_size"`           // bytes of the file before the change, zero for additions
+}
+
+// loadLower adds the regular files found in the lower directory, their data stays on the host until written to.
+// the lower layer is read once, it must not change while mounted
+func (d *Dir) loadLower(lower string) error {
+	infos, err := ioutil.ReadDir(lower)
+	if err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, info := range infos {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		perm := permissions{mode: info.Mode().Perm(), uid: uint32(os.Getuid()), gid: uint32(os.Getgid())}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			perm.uid = stat.Uid
+			perm.gid = stat.Gid
+		}
+		entry := createFileEntry(info.Name(), d.fs, perm)
+		entry.lower = filepath.Join(lower, info.Name())
+		entry.inLower = 1
+		entry.released = true // data is held by the host
+		entry.Data = nil
+		entry.Meta.size = uint64(info.Size())
+		entry.Meta.modified = info.ModTime()
+		entry.Meta.changed = info.ModTime()
+		d.entries = append(d.entries, entry)
+		d.fs.metrics.addFiles(1)
+	}
+	return nil
+}
+
+// whiteout records the removal of a file hiding a file of the lower layer, caller must hold the mutex
+func (d *Dir) whiteout(entry *FileEntry) {
+	lower := d.fs.options.Lower
+	if lower == "" {
+		return
+	}
+	if _, err := os.Lstat(filepath.Join(lower, entry.Meta.name)); err != nil {
+		return
+	}
+	if d.whiteouts == nil {
+		d.whiteouts = make(map[string]bool)
+	}
+	d.whiteouts[entry.Meta.name] = true
+}
+
+// isInLower tells if the data of the file is still in the lower layer, not copied up
+func (e *FileEntry) isInLower() bool {
+	return atomic.LoadInt32(&e.inLower) == 1
+}
+
+// copyUp reads the data of a file from the lower layer into RAM, before it is modified. caller must hold the mutex
+func (e *FileEntry) copyUp() error {
+	if !e.isInLower() {
+		return nil
+	}
+	data, err := ioutil.ReadFile(e.lower)
+	if err != nil {
+		return err
+	}
+	e.Data = data
+	e.Meta.size = uint64(len(data))
+	e.released = false
+	e.fs.metrics.addBytes(int64(len(data)))
+	e.fs.metrics.addPhysicalBytes(int64(len(data)))
+	atomic.StoreInt32(&e.inLower, 0)
+	return nil
+}
+
+// copyUpChecked copies up the file, reporting failures as EIO
+func (e *FileEntry) copyUpChecked() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if err := e.copyUp(); err != nil {
+		log.Printf("failed to copy up %q: %v", e.Meta.Name(), err)
+		return fuse.Errno(syscall.EIO)
+	}
+	return nil
+}
+
+// readLower reads data of a file not copied up from the lower layer, caller must hold the mutex
+func (e *FileEntry) readLower(p []byte, off int64) (int, error) {
+	file, err := os.Open(e.lower)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	n, err := file.ReadAt(p, off)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// handleLowerRead serves a read of a file not copied up, caller must hold the mutex
+func (e *FileEntry) handleLowerRead(req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	buffer := resp.Data[:req.Size]
+	n, err := e.readLower(buffer, req.Offset)
+	if err != nil {
+		log.Printf("failed to read %q from the lower layer: %v", e.Meta.Name(), err)
+		return fuse.Errno(syscall.EIO)
+	}
+	resp.Data = buffer[:n]
+	return nil
+}
+
+// IsInLower tells if the file's data is read from the lower directory of an overlay, see Options.Lower.
+// Data is nil then, use ReadAt or Bytes
+func (e *FileEntry) IsInLower() bool {
+	return e.isInLower()
+}
+
+// OverlayChanges lists what the upper layer changes in the lower directory of an overlay, ordered by name
+func (f *ramdiskFS) OverlayChanges() []Change {
+	lower := f.options.Lower
+	changes := make([]Change, 0)
+	if lower == "" {
+		return changes
+	}
+
+	d := f.root
+	d.mutex.RLock()
+	for _, entry := range d.entries {
+		name := entry.Meta.Name()
+		// a file of the lower layer renamed is added under its new name, with the data still in the lower layer
+		if entry.isInLower() && entry.lower == filepath.Join(lower, name) || entry.virtual != nil {
+			continue
+		}
+		change := Change{Name: name, Kind: ChangeAdded, Size: entry.dataSize()}
+		if info, err := os.Lstat(filepath.Join(lower, name)); err == nil {
+			change.Kind = ChangeModified
+			change.OldSize = info.Size()
+		}
+		changes = append(changes, change)
+	}
+	for name := range d.whiteouts {
+		change := Change{Name: name, Kind: ChangeRemoved}
+		if info, err := os.Lstat(filepath.Join(lower, name)); err == nil {
+			change.OldSize = info.Size()
+		}
+		changes = append(changes, change)
+	}
+	d.mutex.RUnlock()
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	return changes
+}
+
+// ExportUpper writes the upper layer of an overlay to the directory dir: added and modified files,
+// and an empty file named WhiteoutPrefix+name for every file removed from the lower layer
+func (f *ramdiskFS) ExportUpper(dir string) error {
+	for _, change := range f.OverlayChanges() {
+		if change.Kind == ChangeRemoved {
+			if err := ioutil.WriteFile(filepath.Join(dir, WhiteoutPrefix+change.Name), nil, 0644); err != nil {
+				return err
+			}
+			continue
+		}
+
+		entry, found := f.root.findEntryByName(change.Name)
+		if !found {
+			continue
+		}
+		if entry.Meta.Type() != 0 {
+			// special files are not exported
+			continue
+		}
+		entry.Meta.mutex.RLock()
+		mode := entry.Meta.perm.mode
+		modified := entry.Meta.modified
+		entry.Meta.mutex.RUnlock()
+
+		path := filepath.Join(dir, change.Name)
+		if err := ioutil.WriteFile(path, entry.Bytes(), mode); err != nil {
+			return err
+		}
+		if err := os.Chtimes(path, time.Now(), modified); err != nil {
+			return err
+		}
+	}
+	return nil
+}
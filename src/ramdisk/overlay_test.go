@@ -0,0 +1,108 @@
+package ramdisk
+
+import (
+	"testing"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+)
+
+func TestOverlay(t *testing.T) {
+	lower, _ := ioutil.TempDir("", "lower")
+	defer os.RemoveAll(lower)
+	ioutil.WriteFile(filepath.Join(lower, "o1.txt"), []byte("lower one"), 0644)
+	ioutil.WriteFile(filepath.Join(lower, "o2.txt"), []byte("lower two"), 0644)
+	ioutil.WriteFile(filepath.Join(lower, "o3.txt"), []byte("lower three"), 0644)
+	os.Mkdir(filepath.Join(lower, "subdir"), 0755)
+
+	filesys := CreateRamFSWithOptions(Options{Lower: lower})
+	if metrics := filesys.Metrics(); metrics.Files != 3 || metrics.BytesStored != 0 {
+		t.Fatalf("wrong files/bytes of lower layer %d/%d", metrics.Files, metrics.BytesStored)
+	}
+
+	// reads fall through
+	one, found := filesys.root.findEntryByName("o1.txt")
+	if !found || !one.IsInLower() || one.Meta.Size() != 9 || string(one.Bytes()) != "lower one" {
+		t.Fatal("lower file not read through")
+	}
+
+	id := filesys.Snapshot()
+
+	// writes copy up
+	one.WriteAt([]byte("UPPER"), 0)
+	if one.IsInLower() || string(one.Bytes()) != "UPPER one" || filesys.Metrics().BytesStored != 9 {
+		t.Fatal("lower file not copied up")
+	}
+	two, _ := filesys.root.findEntryByName("o2.txt")
+	filesys.root.removeEntry(two, RemovedUnlinked)
+	added := addTestFile(filesys, "o4.txt", 0, one.lastUsed)
+	added.write([]byte("new"), 0, false)
+
+	expected := []Change{
+		{Name: "o1.txt", Kind: ChangeModified, Size: 9, OldSize: 9},
+		{Name: "o2.txt", Kind: ChangeRemoved, OldSize: 9},
+		{Name: "o4.txt", Kind: ChangeAdded, Size: 3},
+	}
+	if changes := filesys.OverlayChanges(); !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("wrong changes %v", changes)
+	}
+
+	upper, _ := ioutil.TempDir("", "upper")
+	defer os.RemoveAll(upper)
+	if err := filesys.ExportUpper(upper); err != nil {
+		t.Fatalf("export failed: %v", err)
+	}
+	names := []string{}
+	infos, _ := ioutil.ReadDir(upper)
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	if !reflect.DeepEqual(names, []string{".wh.o2.txt", "o1.txt", "o4.txt"}) {
+		t.Fatalf("wrong exported files %v", names)
+	}
+
+	// the lower layer is never written
+	if byts, _ := ioutil.ReadFile(filepath.Join(lower, "o1.txt")); string(byts) != "lower one" {
+		t.Fatal("lower file changed")
+	}
+	if _, err := os.Stat(filepath.Join(lower, "o2.txt")); err != nil {
+		t.Fatal("lower file removed")
+	}
+
+	// rolling back returns to the lower layer
+	filesys.Rollback(id)
+	if !one.IsInLower() || len(filesys.OverlayChanges()) != 0 || filesys.Metrics().BytesStored != 0 {
+		t.Fatalf("not rolled back to lower layer: %v", filesys.OverlayChanges())
+	}
+}
+
+func TestOverlayRename(t *testing.T) {
+	lower, _ := ioutil.TempDir("", "lower")
+	defer os.RemoveAll(lower)
+	ioutil.WriteFile(filepath.Join(lower, "o5.txt"), []byte("lower five"), 0644)
+
+	filesys := CreateRamFSWithOptions(Options{Lower: lower})
+	if err := filesys.RenameFile("o5.txt", "o6.txt"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []Change{
+		{Name: "o5.txt", Kind: ChangeRemoved, OldSize: 10},
+		{Name: "o6.txt", Kind: ChangeAdded, Size: 10},
+	}
+	if changes := filesys.OverlayChanges(); !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("wrong changes %v", changes)
+	}
+
+	upper, _ := ioutil.TempDir("", "upper")
+	defer os.RemoveAll(upper)
+	if err := filesys.ExportUpper(upper); err != nil {
+		t.Fatalf("export failed: %v", err)
+	}
+	if byts, err := ioutil.ReadFile(filepath.Join(upper, "o6.txt")); err != nil || string(byts) != "lower five" {
+		t.Fatalf("renamed file not exported: %q %v", byts, err)
+	}
+	if _, err := os.Stat(filepath.Join(upper, WhiteoutPrefix+"o5.txt")); err != nil {
+		t.Fatal("old name not whited out")
+	}
+}
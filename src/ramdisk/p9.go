@@ -0,0 +1,1180 @@
+package ramdisk
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+	"io"
+	"log"
+	"net"
+	"os/user"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// ListenAndServe9P serves the RAM disk over 9P2000.L on a "tcp" or "unix" address, see Serve9P
+func (f *ramdiskFS) ListenAndServe9P(network, address string) error {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	return f.Serve9P(listener)
+}
+
+// Serve9P serves the RAM disk over 9P2000.L to clients connecting to listener, until the listener is closed.
+// Guests mount it with e.g. mount -t 9p -o trans=tcp,port=564,version=9p2000.L host /mnt.
+// Requests go to the same nodes as on the FUSE mount: permissions are checked for the user
+// attaching, hooks run and listeners are notified. Clients on network listeners are not authenticated,
+// Options.P9Users selects whom the users they claim to be are taken for.
+func (f *ramdiskFS) Serve9P(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go f.serve9PConn(conn, f.options.P9Users)
+	}
+}
+
+// P9UserMapping selects whom the users attaching over 9P are taken for
+type P9UserMapping int
+
+const (
+	// P9PeerUser takes clients on unix sockets for the user running the connecting process, read with
+	// SO_PEERCRED, whoever they claim to be. It is P9SquashRoot for other listeners. This is the default.
+	P9PeerUser P9UserMapping = iota
+	// P9Trusted takes users for who they claim to be, including root.
+	P9Trusted
+	// P9SquashRoot takes root for the anonymous user, see Options.P9AnonUid, like root_squash of NFS.
+	P9SquashRoot
+	// P9SquashAll takes every user for the anonymous user, like all_squash of NFS.
+	P9SquashAll
+)
+
+// the anonymous user squashed users are taken for, if Options.P9AnonUid and P9AnonGid are zero
+const p9Nobody = 65534
+
+// p9Conn is the state of one client connection
+type p9Conn struct {
+	fs     *ramdiskFS
+	conn   net.Conn
+	users  P9UserMapping
+	peer   *fuse.Header // the user of the connecting process, with P9PeerUser on unix sockets
+	msize  uint32
+	fids   map[uint32]*p9Fid
+	owners map[string]LockOwner // lock owners by client and process id
+	locked map[*FileEntry]bool  // files with locks of the client
+}
+
+// p9Fid is a file or directory the client refers to by a number
+type p9Fid struct {
+	header fuse.Header // the user the fid was attached by
+	groups []uint32    // supplementary groups of the user
+	path   []p9Node    // from the root to the node of the fid
+	handle fs.Handle   // set once opened
+	flags  fuse.OpenFlags
+	data   []byte // content of a handle read with ReadAll, or of an extended attribute
+	loaded bool   // data holds the content
+	list   []fuse.Dirent
+
+	xattr      string // extended attribute written through the fid with Txattrcreate
+	xattrFlags uint32
+	xattrWalk  bool // the fid reads an extended attribute, see Txattrwalk
+}
+
+type p9Node struct {
+	node  fs.Node
+	name  string
+	inode uint64
+}
+
+func (fid *p9Fid) node() p9Node {
+	return fid.path[len(fid.path)-1]
+}
+
+// parent returns the directory of the fid's node, the root for the root itself
+func (fid *p9Fid) parent() p9Node {
+	if len(fid.path) < 2 {
+		return fid.path[0]
+	}
+	return fid.path[len(fid.path)-2]
+}
+
+func (f *ramdiskFS) serve9PConn(conn net.Conn, users P9UserMapping) {
+	c := &p9Conn{
+		fs:     f,
+		conn:   conn,
+		users:  users,
+		msize:  p9MaxSize,
+		fids:   make(map[uint32]*p9Fid),
+		owners: make(map[string]LockOwner),
+		locked: make(map[*FileEntry]bool),
+	}
+	defer c.close()
+	defer func() {
+		// a malformed request must not take down the process, only its connection
+		if r := recover(); r != nil {
+			log.Printf("9p: connection from %s failed: %v", conn.RemoteAddr(), r)
+		}
+	}()
+
+	if users == P9PeerUser {
+		c.users = P9SquashRoot
+		if unixConn, ok := conn.(*net.UnixConn); ok {
+			// if the peer can't be identified, root is squashed like on other listeners
+			if peer, err := peerUser(unixConn); err == nil {
+				// the user is known, even root needs no squashing
+				c.users, c.peer = P9Trusted, &peer
+			} else {
+				log.Printf("9p: failed to identify the peer on %s: %v", conn.LocalAddr(), err)
+			}
+		}
+	}
+
+	for {
+		kind, tag, body, err := readP9Message(conn, c.msize)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("9p: connection from %s failed: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		reply, err := c.handle(kind, tag, body)
+		if err == nil && body.err != nil {
+			err = fuse.Errno(syscall.EINVAL)
+		}
+		if err != nil {
+			reply = newP9Message(p9Rlerror, tag)
+			reply.put32(uint32(p9Errno(err)))
+		}
+		if _, err := conn.Write(reply.bytes()); err != nil {
+			log.Printf("9p: connection from %s failed: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// close releases all fids and locks of the connection
+func (c *p9Conn) close() {
+	c.conn.Close()
+	for number, fid := range c.fids {
+		c.clunk(fid)
+		delete(c.fids, number)
+	}
+	for entry := range c.locked {
+		for _, owner := range c.owners {
+			entry.posixLocks.unlockAll(lockOwner{process: owner})
+		}
+	}
+}
+
+// p9Errno maps errors of nodes to the error numbers of Rlerror
+func p9Errno(err error) syscall.Errno {
+	if errno, isErrno := err.(fuse.ErrorNumber); isErrno {
+		return syscall.Errno(errno.Errno())
+	}
+	if errno, isErrno := err.(syscall.Errno); isErrno {
+		return errno
+	}
+	log.Printf("9p: %v", err)
+	return syscall.EIO
+}
+
+// handle serves a request, returning the reply or the error to report
+func (c *p9Conn) handle(kind uint8, tag uint16, body *p9Buffer) (*p9Buffer, error) {
+	switch kind {
+	case p9Tversion:
+		return c.version(tag, body)
+	case p9Tauth:
+		return nil, fuse.Errno(syscall.EOPNOTSUPP)
+	case p9Tattach:
+		return c.attach(tag, body)
+	case p9Tflush:
+		// requests are served in order, the flushed one is answered already
+		return newP9Message(p9Rflush, tag), nil
+	case p9Tmkdir:
+		return nil, fuse.EPERM
+	}
+
+	fid, found := c.fids[body.get32()]
+	if !found {
+		return nil, fuse.Errno(syscall.EBADF)
+	}
+	switch kind {
+	case p9Twalk:
+		return c.walk(tag, fid, body)
+	case p9Tclunk:
+		err := c.clunk(fid)
+		c.forget(fid)
+		if err != nil {
+			return nil, err
+		}
+		return newP9Message(p9Rclunk, tag), nil
+	case p9Tremove:
+		parent, node := fid.parent(), fid.node()
+		c.forget(fid)
+		c.clunk(fid)
+		if err := c.unlink(fid.header, parent, node.name, false); err != nil {
+			return nil, err
+		}
+		return newP9Message(p9Rremove, tag), nil
+	case p9Tlopen:
+		return c.lopen(tag, fid, body)
+	case p9Tlcreate:
+		return c.lcreate(tag, fid, body)
+	case p9Tmknod:
+		return c.mknod(tag, fid, body)
+	case p9Tread:
+		return c.read(tag, fid, body)
+	case p9Twrite:
+		return c.write(tag, fid, body)
+	case p9Treaddir:
+		return c.readdir(tag, fid, body)
+	case p9Tgetattr:
+		return c.getattr(tag, fid, body)
+	case p9Tsetattr:
+		return c.setattr(tag, fid, body)
+	case p9Tstatfs:
+		return c.statfs(tag)
+	case p9Tfsync:
+		if fsyncer, ok := fid.node().node.(fs.NodeFsyncer); ok {
+			if err := fsyncer.Fsync(context.Background(), &fuse.FsyncRequest{Header: fid.header}); err != nil {
+				return nil, err
+			}
+		}
+		return newP9Message(p9Rfsync, tag), nil
+	case p9Tunlinkat:
+		name := body.getString()
+		flags := body.get32()
+		if err := c.unlink(fid.header, fid.node(), name, flags&p9RemoveDir != 0); err != nil {
+			return nil, err
+		}
+		return newP9Message(p9Runlinkat, tag), nil
+	case p9Trename:
+		dir, found := c.fids[body.get32()]
+		if !found {
+			return nil, fuse.Errno(syscall.EBADF)
+		}
+		name := body.getString()
+		if err := c.rename(fid.header, fid.parent(), fid.node().name, dir.node(), name); err != nil {
+			return nil, err
+		}
+		// the file is renamed in place, the fid refers to it by its new name
+		fid.path[len(fid.path)-1].name = name
+		return newP9Message(p9Rrename, tag), nil
+	case p9Trenameat:
+		oldName := body.getString()
+		dir, found := c.fids[body.get32()]
+		if !found {
+			return nil, fuse.Errno(syscall.EBADF)
+		}
+		newName := body.getString()
+		if err := c.rename(fid.header, fid.node(), oldName, dir.node(), newName); err != nil {
+			return nil, err
+		}
+		return newP9Message(p9Rrenameat, tag), nil
+	case p9Txattrwalk:
+		return c.xattrwalk(tag, fid, body)
+	case p9Txattrcreate:
+		fid.xattr = body.getString()
+		size := body.get64()
+		fid.xattrFlags = body.get32()
+		if size > uint64(c.msize) {
+			return nil, fuse.Errno(syscall.E2BIG)
+		}
+		fid.data = make([]byte, 0, size)
+		return newP9Message(p9Rxattrcreate, tag), nil
+	case p9Tlock:
+		return c.lock(tag, fid, body)
+	case p9Tgetlock:
+		return c.getlock(tag, fid, body)
+	}
+	return nil, fuse.Errno(syscall.ENOSYS)
+}
+
+func (c *p9Conn) forget(fid *p9Fid) {
+	for number, other := range c.fids {
+		if other == fid {
+			delete(c.fids, number)
+		}
+	}
+}
+
+func (c *p9Conn) version(tag uint16, body *p9Buffer) (*p9Buffer, error) {
+	msize := body.get32()
+	version := body.getString()
+	if msize < p9IOHeader+64 {
+		return nil, fuse.Errno(syscall.EINVAL)
+	}
+	if msize < c.msize {
+		c.msize = msize
+	}
+
+	// a new session starts, the fids of the previous one are gone
+	for number, fid := range c.fids {
+		c.clunk(fid)
+		delete(c.fids, number)
+	}
+
+	reply := newP9Message(p9Rversion, tag)
+	reply.put32(c.msize)
+	if version != p9Version {
+		version = "unknown"
+	}
+	reply.putString(version)
+	return reply, nil
+}
+
+func (c *p9Conn) attach(tag uint16, body *p9Buffer) (*p9Buffer, error) {
+	number := body.get32()
+	body.get32() // afid, there is no authentication
+	uname := body.getString()
+	body.getString() // aname, there is only one tree
+	uid := body.get32()
+	if _, exists := c.fids[number]; exists {
+		return nil, fuse.Errno(syscall.EBADF)
+	}
+
+	if c.peer != nil {
+		// the claimed user is ignored, the socket tells who connected
+		uname, uid = "", c.peer.Uid
+	}
+	header, groups, err := p9Header(uname, uid)
+	if err != nil {
+		return nil, err
+	}
+	if c.peer != nil {
+		header.Gid = c.peer.Gid
+	}
+	if c.users == P9SquashAll || c.users == P9SquashRoot && header.Uid == 0 {
+		header = c.fs.options.p9Anon()
+		groups = nil
+	}
+	root := p9Node{node: c.fs.root, inode: 1}
+	c.fids[number] = &p9Fid{header: header, groups: groups, path: []p9Node{root}}
+
+	qid, err := c.qid(root)
+	if err != nil {
+		return nil, err
+	}
+	reply := newP9Message(p9Rattach, tag)
+	reply.putQid(qid)
+	return reply, nil
+}
+
+// p9Header identifies the user attaching by uid, or by name if the client sent no uid.
+// groups are the supplementary groups of the user.
+func p9Header(uname string, uid uint32) (header fuse.Header, groups []uint32, err error) {
+	var account *user.User
+	if uid == p9NoUid {
+		account, err = user.Lookup(uname)
+	} else {
+		account, err = user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	}
+	if err != nil {
+		if uid == p9NoUid {
+			return fuse.Header{}, nil, fuse.EPERM
+		}
+		// unknown to the host, the user gets no group permissions
+		return fuse.Header{Uid: uid, Gid: p9NoUid}, nil, nil
+	}
+	parsedUid, _ := strconv.ParseUint(account.Uid, 10, 32)
+	parsedGid, _ := strconv.ParseUint(account.Gid, 10, 32)
+	groupIds, _ := account.GroupIds()
+	for _, groupId := range groupIds {
+		if gid, err := strconv.ParseUint(groupId, 10, 32); err == nil {
+			groups = append(groups, uint32(gid))
+		}
+	}
+	return fuse.Header{Uid: uint32(parsedUid), Gid: uint32(parsedGid)}, groups, nil
+}
+
+// peerUser returns the user running the process at the other end of a unix socket
+func peerUser(conn *net.UnixConn) (fuse.Header, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return fuse.Header{}, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return fuse.Header{}, err
+	}
+	if credErr != nil {
+		return fuse.Header{}, credErr
+	}
+	return fuse.Header{Uid: cred.Uid, Gid: cred.Gid, Pid: uint32(cred.Pid)}, nil
+}
+
+// p9Anon returns the user squashed 9P users are taken for
+func (o Options) p9Anon() fuse.Header {
+	if o.P9AnonUid == 0 && o.P9AnonGid == 0 {
+		return fuse.Header{Uid: p9Nobody, Gid: p9Nobody}
+	}
+	return fuse.Header{Uid: o.P9AnonUid, Gid: o.P9AnonGid}
+}
+
+// member tells if the user of the fid may give files the group gid
+func (fid *p9Fid) member(gid uint32) bool {
+	if fid.header.Uid == 0 || gid == fid.header.Gid {
+		return true
+	}
+	for _, group := range fid.groups {
+		if group == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// chgrp gives a file created through fid the group asked for by the client.
+// Access is checked for the group the user attached with, a file gets another group only if the user is a member.
+func (c *p9Conn) chgrp(fid *p9Fid, node fs.Node, gid uint32) {
+	setattrer, ok := node.(fs.NodeSetattrer)
+	if gid == fid.header.Gid || !fid.member(gid) || !ok {
+		return
+	}
+	header := fid.header
+	header.Gid = gid
+	req := &fuse.SetattrRequest{Header: header, Valid: fuse.SetattrGid, Gid: gid}
+	if err := setattrer.Setattr(context.Background(), req, &fuse.SetattrResponse{}); err != nil {
+		log.Printf("9p: failed to set group %d: %v", gid, err)
+	}
+}
+
+// qid describes a node to the client
+func (c *p9Conn) qid(n p9Node) (p9Qid, error) {
+	var a fuse.Attr
+	if err := n.node.Attr(context.Background(), &a); err != nil {
+		return p9Qid{}, err
+	}
+	qid := p9Qid{Type: p9QidFile, Path: n.inode}
+	if a.Mode.IsDir() {
+		qid.Type = p9QidDir
+	}
+	return qid, nil
+}
+
+// lookup finds name in the directory dir, like a lookup through the mount
+func (c *p9Conn) lookup(fid *p9Fid, dir p9Node, name string) (p9Node, error) {
+	var node fs.Node
+	var err error
+	switch lookuper := dir.node.(type) {
+	case fs.NodeRequestLookuper:
+		req := &fuse.LookupRequest{Header: fid.header, Name: name}
+		node, err = lookuper.Lookup(context.Background(), req, &fuse.LookupResponse{})
+	case fs.NodeStringLookuper:
+		node, err = lookuper.Lookup(context.Background(), name)
+	default:
+		return p9Node{}, fuse.Errno(syscall.ENOTDIR)
+	}
+	if err != nil {
+		return p9Node{}, err
+	}
+	var a fuse.Attr
+	if err := node.Attr(context.Background(), &a); err != nil {
+		return p9Node{}, err
+	}
+	inode := a.Inode
+	if inode == 0 {
+		inode = fs.GenerateDynamicInode(dir.inode, name)
+	}
+	return p9Node{node: node, name: name, inode: inode}, nil
+}
+
+func (c *p9Conn) walk(tag uint16, fid *p9Fid, body *p9Buffer) (*p9Buffer, error) {
+	newNumber := body.get32()
+	count := int(body.get16())
+	if count > p9MaxWalk {
+		return nil, fuse.Errno(syscall.EINVAL)
+	}
+	names := make([]string, count)
+	for i := range names {
+		names[i] = body.getString()
+	}
+	if body.err != nil {
+		return nil, body.err
+	}
+	if fid.handle != nil {
+		return nil, fuse.Errno(syscall.EBADF)
+	}
+	if other, exists := c.fids[newNumber]; exists && other != fid {
+		return nil, fuse.Errno(syscall.EBADF)
+	}
+
+	path := append([]p9Node{}, fid.path...)
+	qids := make([]p9Qid, 0, count)
+	for _, name := range names {
+		switch name {
+		case ".":
+		case "..":
+			if len(path) > 1 {
+				path = path[:len(path)-1]
+			}
+		default:
+			next, err := c.lookup(fid, path[len(path)-1], name)
+			if err != nil {
+				if len(qids) == 0 {
+					return nil, err
+				}
+				// a partial walk reports how far it got, newfid is not created
+				return walkReply(tag, qids), nil
+			}
+			path = append(path, next)
+		}
+		qid, err := c.qid(path[len(path)-1])
+		if err != nil {
+			return nil, err
+		}
+		qids = append(qids, qid)
+	}
+
+	c.fids[newNumber] = &p9Fid{header: fid.header, groups: fid.groups, path: path}
+	return walkReply(tag, qids), nil
+}
+
+func walkReply(tag uint16, qids []p9Qid) *p9Buffer {
+	reply := newP9Message(p9Rwalk, tag)
+	reply.put16(uint16(len(qids)))
+	for _, qid := range qids {
+		reply.putQid(qid)
+	}
+	return reply
+}
+
+// p9OpenFlags maps the flags of Tlopen and Tlcreate to those of open(2) on the mount
+func p9OpenFlags(flags uint32) fuse.OpenFlags {
+	var open fuse.OpenFlags
+	switch flags & p9OpenAccess {
+	case 1:
+		open = fuse.OpenWriteOnly
+	case 2:
+		open = fuse.OpenReadWrite
+	default:
+		open = fuse.OpenReadOnly
+	}
+	if flags&p9OpenCreate != 0 {
+		open |= fuse.OpenCreate
+	}
+	if flags&p9OpenExcl != 0 {
+		open |= fuse.OpenExclusive
+	}
+	if flags&p9OpenTrunc != 0 {
+		open |= fuse.OpenTruncate
+	}
+	if flags&p9OpenAppend != 0 {
+		open |= fuse.OpenAppend
+	}
+	return open
+}
+
+func (c *p9Conn) lopen(tag uint16, fid *p9Fid, body *p9Buffer) (*p9Buffer, error) {
+	flags := p9OpenFlags(body.get32())
+	if fid.handle != nil || fid.xattrWalk {
+		return nil, fuse.Errno(syscall.EBADF)
+	}
+	node := fid.node()
+	qid, err := c.qid(node)
+	if err != nil {
+		return nil, err
+	}
+
+	handle := fs.Handle(node.node)
+	if opener, ok := node.node.(fs.NodeOpener); ok {
+		req := &fuse.OpenRequest{Header: fid.header, Dir: qid.Type == p9QidDir, Flags: flags}
+		handle, err = opener.Open(context.Background(), req, &fuse.OpenResponse{})
+		if err != nil {
+			return nil, err
+		}
+	}
+	fid.handle = handle
+	fid.flags = flags
+	if flags&fuse.OpenTruncate != 0 {
+		c.invalidate(node)
+	}
+
+	reply := newP9Message(p9Rlopen, tag)
+	reply.putQid(qid)
+	reply.put32(0)
+	return reply, nil
+}
+
+func (c *p9Conn) lcreate(tag uint16, fid *p9Fid, body *p9Buffer) (*p9Buffer, error) {
+	name := body.getString()
+	flags := p9OpenFlags(body.get32())
+	mode := p9FileMode(body.get32())
+	gid := body.get32()
+	if body.err != nil {
+		return nil, body.err
+	}
+	dir := fid.node()
+	creater, ok := dir.node.(fs.NodeCreater)
+	if !ok || fid.handle != nil {
+		return nil, fuse.EPERM
+	}
+
+	req := &fuse.CreateRequest{Header: fid.header, Name: name, Flags: flags | fuse.OpenCreate, Mode: mode}
+	node, handle, err := creater.Create(context.Background(), req, &fuse.CreateResponse{})
+	if err != nil {
+		return nil, err
+	}
+	c.chgrp(fid, node, gid)
+
+	// the fid now stands for the new file, opened
+	var a fuse.Attr
+	node.Attr(context.Background(), &a)
+	fid.path = append(fid.path, p9Node{node: node, name: name, inode: a.Inode})
+	fid.handle = handle
+	fid.flags = req.Flags
+
+	qid, err := c.qid(fid.node())
+	if err != nil {
+		return nil, err
+	}
+	reply := newP9Message(p9Rlcreate, tag)
+	reply.putQid(qid)
+	reply.put32(0)
+	return reply, nil
+}
+
+func (c *p9Conn) mknod(tag uint16, fid *p9Fid, body *p9Buffer) (*p9Buffer, error) {
+	name := body.getString()
+	mode := p9FileMode(body.get32())
+	major := body.get32()
+	minor := body.get32()
+	gid := body.get32()
+	if body.err != nil {
+		return nil, body.err
+	}
+	dir := fid.node()
+	mknoder, ok := dir.node.(fs.NodeMknoder)
+	if !ok {
+		return nil, fuse.EPERM
+	}
+
+	// device numbers as encoded by new_encode_dev(), like in FUSE
+	rdev := minor&0xff | major<<8 | (minor&^0xff)<<12
+	req := &fuse.MknodRequest{Header: fid.header, Name: name, Mode: mode, Rdev: rdev}
+	node, err := mknoder.Mknod(context.Background(), req)
+	if err != nil {
+		return nil, err
+	}
+	c.chgrp(fid, node, gid)
+
+	var a fuse.Attr
+	node.Attr(context.Background(), &a)
+	qid, err := c.qid(p9Node{node: node, name: name, inode: a.Inode})
+	if err != nil {
+		return nil, err
+	}
+	reply := newP9Message(p9Rmknod, tag)
+	reply.putQid(qid)
+	return reply, nil
+}
+
+func (c *p9Conn) read(tag uint16, fid *p9Fid, body *p9Buffer) (*p9Buffer, error) {
+	offset := int64(body.get64())
+	count := body.get32()
+	if body.err != nil {
+		return nil, body.err
+	}
+	if offset < 0 {
+		return nil, fuse.Errno(syscall.EINVAL)
+	}
+	if max := c.msize - p9IOHeader; count > max {
+		count = max
+	}
+
+	var data []byte
+	switch {
+	case fid.xattrWalk:
+		data = sliceAt(fid.data, offset, count)
+	case fid.handle == nil:
+		return nil, fuse.Errno(syscall.EBADF)
+	default:
+		var err error
+		if data, err = c.readHandle(fid, offset, count); err != nil {
+			return nil, err
+		}
+	}
+
+	reply := newP9Message(p9Rread, tag)
+	reply.put32(uint32(len(data)))
+	reply.data = append(reply.data, data...)
+	return reply, nil
+}
+
+// readHandle reads from an open file, the way the mount would
+func (c *p9Conn) readHandle(fid *p9Fid, offset int64, count uint32) ([]byte, error) {
+	if reader, ok := fid.handle.(fs.HandleReader); ok {
+		req := &fuse.ReadRequest{Header: fid.header, Offset: offset, Size: int(count), FileFlags: fid.flags}
+		resp := &fuse.ReadResponse{Data: make([]byte, 0, count)}
+		if err := reader.Read(context.Background(), req, resp); err != nil {
+			return nil, err
+		}
+		return resp.Data, nil
+	}
+
+	allReader, ok := fid.handle.(fs.HandleReadAller)
+	if !ok {
+		return nil, fuse.Errno(syscall.EINVAL)
+	}
+	if !fid.loaded {
+		data, err := allReader.ReadAll(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		fid.data = data
+		fid.loaded = true
+	}
+	return sliceAt(fid.data, offset, count), nil
+}
+
+// sliceAt returns up to count bytes of data from offset
+func sliceAt(data []byte, offset int64, count uint32) []byte {
+	if offset < 0 || offset >= int64(len(data)) {
+		return nil
+	}
+	data = data[offset:]
+	if uint32(len(data)) > count {
+		data = data[:count]
+	}
+	return data
+}
+
+func (c *p9Conn) write(tag uint16, fid *p9Fid, body *p9Buffer) (*p9Buffer, error) {
+	offset := int64(body.get64())
+	count := body.get32()
+	data := body.take(int(count))
+	if body.err != nil {
+		return nil, body.err
+	}
+	if offset < 0 {
+		return nil, fuse.Errno(syscall.EINVAL)
+	}
+
+	switch {
+	case fid.xattr != "":
+		// the value of an extended attribute is set with the clunk
+		if offset > int64(cap(fid.data)) {
+			return nil, fuse.Errno(syscall.EINVAL)
+		}
+		// no overflow, data is shorter than msize
+		end := offset + int64(len(data))
+		if end > int64(cap(fid.data)) {
+			return nil, fuse.Errno(syscall.ERANGE)
+		}
+		if end > int64(len(fid.data)) {
+			fid.data = fid.data[:end]
+		}
+		copy(fid.data[offset:], data)
+	case fid.handle == nil:
+		return nil, fuse.Errno(syscall.EBADF)
+	default:
+		writer, ok := fid.handle.(fs.HandleWriter)
+		if !ok {
+			return nil, fuse.Errno(syscall.EBADF)
+		}
+		req := &fuse.WriteRequest{Header: fid.header, Offset: offset, Data: data, FileFlags: fid.flags}
+		resp := &fuse.WriteResponse{}
+		if err := writer.Write(context.Background(), req, resp); err != nil {
+			return nil, err
+		}
+		c.invalidate(fid.node())
+	}
+
+	reply := newP9Message(p9Rwrite, tag)
+	reply.put32(uint32(len(data)))
+	return reply, nil
+}
+
+// invalidate drops what the kernel caches of a file changed through 9P, for the FUSE mount
+func (c *p9Conn) invalidate(n p9Node) {
+	if file, ok := n.node.(*RamFile); ok {
+		c.fs.invalidate(file.entry)
+	}
+}
+
+// clunk closes the handle of an opened fid, like the last close(2) through the mount.
+// an extended attribute created through the fid is set now
+func (c *p9Conn) clunk(fid *p9Fid) error {
+	if fid.xattr != "" {
+		name := fid.xattr
+		fid.xattr = ""
+		node := fid.node().node
+		if len(fid.data) == 0 && cap(fid.data) == 0 {
+			// Txattrcreate with size 0 stands for removexattr(2)
+			remover, ok := node.(fs.NodeRemovexattrer)
+			if !ok {
+				return fuse.Errno(syscall.EOPNOTSUPP)
+			}
+			return remover.Removexattr(context.Background(), &fuse.RemovexattrRequest{Header: fid.header, Name: name})
+		}
+		setter, ok := node.(fs.NodeSetxattrer)
+		if !ok {
+			return fuse.Errno(syscall.EOPNOTSUPP)
+		}
+		req := &fuse.SetxattrRequest{Header: fid.header, Name: name, Xattr: fid.data, Flags: fid.xattrFlags}
+		return setter.Setxattr(context.Background(), req)
+	}
+
+	if fid.handle == nil {
+		return nil
+	}
+	handle := fid.handle
+	fid.handle = nil
+
+	var err error
+	if flusher, ok := handle.(fs.HandleFlusher); ok {
+		err = flusher.Flush(context.Background(), &fuse.FlushRequest{Header: fid.header})
+	}
+	if releaser, ok := handle.(fs.HandleReleaser); ok {
+		releaseErr := releaser.Release(context.Background(), &fuse.ReleaseRequest{Header: fid.header, Flags: fid.flags})
+		if err == nil {
+			err = releaseErr
+		}
+	}
+	return err
+}
+
+func (c *p9Conn) readdir(tag uint16, fid *p9Fid, body *p9Buffer) (*p9Buffer, error) {
+	offset := body.get64()
+	count := body.get32()
+	if body.err != nil {
+		return nil, body.err
+	}
+	lister, ok := fid.handle.(fs.HandleReadDirAller)
+	if !ok {
+		return nil, fuse.Errno(syscall.ENOTDIR)
+	}
+	if max := c.msize - p9IOHeader; count > max {
+		count = max
+	}
+
+	dir, parent := fid.node(), fid.parent()
+	if offset == 0 || fid.list == nil {
+		// listed when reading starts, later offsets refer to this listing
+		list, err := lister.ReadDirAll(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		dot := []fuse.Dirent{{Inode: dir.inode, Name: ".", Type: fuse.DT_Dir}, {Inode: parent.inode, Name: "..", Type: fuse.DT_Dir}}
+		fid.list = append(dot, list...)
+	}
+
+	entries := &p9Buffer{}
+	for i := offset; i < uint64(len(fid.list)); i++ {
+		entry := fid.list[i]
+		inode := entry.Inode
+		if inode == 0 {
+			inode = fs.GenerateDynamicInode(dir.inode, entry.Name)
+		}
+		qid := p9Qid{Type: p9QidFile, Path: inode}
+		if entry.Type == fuse.DT_Dir {
+			qid.Type = p9QidDir
+		}
+		// qid[13] offset[8] type[1] name[s]
+		if len(entries.data)+24+len(entry.Name) > int(count) {
+			break
+		}
+		entries.putQid(qid)
+		entries.put64(i + 1)
+		entries.put8(uint8(entry.Type))
+		entries.putString(entry.Name)
+	}
+
+	reply := newP9Message(p9Rreaddir, tag)
+	reply.put32(uint32(len(entries.data)))
+	reply.data = append(reply.data, entries.data...)
+	return reply, nil
+}
+
+func (c *p9Conn) getattr(tag uint16, fid *p9Fid, body *p9Buffer) (*p9Buffer, error) {
+	body.get64() // request mask, all basic attributes are returned anyway
+	node := fid.node()
+	var a fuse.Attr
+	if err := node.node.Attr(context.Background(), &a); err != nil {
+		return nil, err
+	}
+	qid, err := c.qid(node)
+	if err != nil {
+		return nil, err
+	}
+	nlink := uint64(a.Nlink)
+	if nlink == 0 {
+		nlink = 1
+		if a.Mode.IsDir() {
+			nlink = 2
+		}
+	}
+
+	reply := newP9Message(p9Rgetattr, tag)
+	reply.put64(p9GetattrBasic)
+	reply.putQid(qid)
+	reply.put32(p9Mode(a.Mode))
+	reply.put32(a.Uid)
+	reply.put32(a.Gid)
+	reply.put64(nlink)
+	reply.put64(uint64(a.Rdev))
+	reply.put64(a.Size)
+	reply.put64(4096)                 // blksize
+	reply.put64((a.Size + 511) / 512) // blocks
+	for _, t := range []time.Time{a.Atime, a.Mtime, a.Ctime} {
+		putP9Time(reply, t)
+	}
+	putP9Time(reply, time.Time{}) // btime, not basic
+	reply.put64(0)                // gen
+	reply.put64(0)                // data_version
+	return reply, nil
+}
+
+func putP9Time(b *p9Buffer, t time.Time) {
+	if t.IsZero() {
+		b.put64(0)
+		b.put64(0)
+		return
+	}
+	b.put64(uint64(t.Unix()))
+	b.put64(uint64(t.Nanosecond()))
+}
+
+func (c *p9Conn) setattr(tag uint16, fid *p9Fid, body *p9Buffer) (*p9Buffer, error) {
+	valid := body.get32()
+	mode := body.get32()
+	uid := body.get32()
+	gid := body.get32()
+	size := body.get64()
+	atime := time.Unix(int64(body.get64()), int64(body.get64()))
+	mtime := time.Unix(int64(body.get64()), int64(body.get64()))
+	if body.err != nil {
+		return nil, body.err
+	}
+	node := fid.node()
+	setter, ok := node.node.(fs.NodeSetattrer)
+	if !ok {
+		return nil, fuse.EPERM
+	}
+
+	req := &fuse.SetattrRequest{Header: fid.header, Mode: p9FileMode(mode), Uid: uid, Gid: gid, Size: size, Atime: atime, Mtime: mtime}
+	if valid&p9SetattrMode != 0 {
+		req.Valid |= fuse.SetattrMode
+	}
+	if valid&p9SetattrUid != 0 {
+		req.Valid |= fuse.SetattrUid
+	}
+	if valid&p9SetattrGid != 0 {
+		req.Valid |= fuse.SetattrGid
+	}
+	if valid&p9SetattrSize != 0 {
+		req.Valid |= fuse.SetattrSize
+	}
+	// times without the _SET bit are set to the current time
+	if valid&p9SetattrAtime != 0 {
+		req.Valid |= fuse.SetattrAtime
+		if valid&p9SetattrAtimeSet == 0 {
+			req.Valid |= fuse.SetattrAtimeNow
+		}
+	}
+	if valid&p9SetattrMtime != 0 {
+		req.Valid |= fuse.SetattrMtime
+		if valid&p9SetattrMtimeSet == 0 {
+			req.Valid |= fuse.SetattrMtimeNow
+		}
+	}
+	if err := setter.Setattr(context.Background(), req, &fuse.SetattrResponse{}); err != nil {
+		return nil, err
+	}
+	if req.Valid.Size() {
+		c.invalidate(node)
+	}
+	return newP9Message(p9Rsetattr, tag), nil
+}
+
+func (c *p9Conn) statfs(tag uint16) (*p9Buffer, error) {
+	const blockSize = 4096
+	metrics := c.fs.Metrics()
+	var blocks, free uint64
+	if capacity := c.fs.options.Capacity; capacity > 0 {
+		blocks = uint64(capacity) / blockSize
+		if metrics.BytesStored < capacity {
+			free = uint64(capacity-metrics.BytesStored) / blockSize
+		}
+	}
+
+	reply := newP9Message(p9Rstatfs, tag)
+	reply.put32(p9StatfsType)
+	reply.put32(blockSize)
+	reply.put64(blocks)
+	reply.put64(free)
+	reply.put64(free)
+	reply.put64(uint64(metrics.Files))
+	reply.put64(0) // free inodes, there is no limit
+	reply.put64(0) // fsid
+	reply.put32(255)
+	return reply, nil
+}
+
+// unlink removes name from the directory dir
+func (c *p9Conn) unlink(header fuse.Header, dir p9Node, name string, isDir bool) error {
+	remover, ok := dir.node.(fs.NodeRemover)
+	if !ok {
+		return fuse.Errno(syscall.EROFS)
+	}
+	return remover.Remove(context.Background(), &fuse.RemoveRequest{Header: header, Name: name, Dir: isDir})
+}
+
+// rename renames a file of the RAM disk, directories other than the root are read-only
+func (c *p9Conn) rename(header fuse.Header, oldDir p9Node, oldName string, newDir p9Node, newName string) error {
+	d, isRoot := oldDir.node.(*Dir)
+	if _, newIsRoot := newDir.node.(*Dir); !isRoot || !newIsRoot {
+		return fuse.Errno(syscall.EROFS)
+	}
+
+	d.mutex.RLock()
+	permitted := d.perm.permits(header, accessWrite|accessExec)
+	d.mutex.RUnlock()
+	if c.fs.enforcePermissions() && !permitted {
+		return fuse.Errno(syscall.EACCES)
+	}
+	return c.fs.RenameFile(oldName, newName)
+}
+
+func (c *p9Conn) xattrwalk(tag uint16, fid *p9Fid, body *p9Buffer) (*p9Buffer, error) {
+	newNumber := body.get32()
+	name := body.getString()
+	if body.err != nil {
+		return nil, body.err
+	}
+	if other, exists := c.fids[newNumber]; exists && other != fid {
+		return nil, fuse.Errno(syscall.EBADF)
+	}
+
+	node := fid.node().node
+	var data []byte
+	if name == "" {
+		lister, ok := node.(fs.NodeListxattrer)
+		if !ok {
+			return nil, fuse.Errno(syscall.EOPNOTSUPP)
+		}
+		resp := &fuse.ListxattrResponse{}
+		if err := lister.Listxattr(context.Background(), &fuse.ListxattrRequest{Header: fid.header}, resp); err != nil {
+			return nil, err
+		}
+		data = resp.Xattr
+	} else {
+		getter, ok := node.(fs.NodeGetxattrer)
+		if !ok {
+			return nil, fuse.Errno(syscall.EOPNOTSUPP)
+		}
+		resp := &fuse.GetxattrResponse{}
+		if err := getter.Getxattr(context.Background(), &fuse.GetxattrRequest{Header: fid.header, Name: name}, resp); err != nil {
+			return nil, err
+		}
+		data = resp.Xattr
+	}
+
+	c.fids[newNumber] = &p9Fid{header: fid.header, groups: fid.groups, path: append([]p9Node{}, fid.path...), data: data, xattrWalk: true}
+	reply := newP9Message(p9Rxattrwalk, tag)
+	reply.put64(uint64(len(data)))
+	return reply, nil
+}
+
+// lockOwner returns the owner of locks taken by a process of the client
+func (c *p9Conn) lockOwner(client string, pid uint32) LockOwner {
+	key := client + "/" + strconv.FormatUint(uint64(pid), 10)
+	owner, found := c.owners[key]
+	if !found {
+		owner = NewLockOwner()
+		c.owners[key] = owner
+	}
+	return owner
+}
+
+// lockRange converts the start and length of a 9P lock to an inclusive range, length zero meaning to the end
+func lockRange(start, length uint64) (uint64, uint64) {
+	if length == 0 || start+length-1 > LockRangeEnd || start+length < start {
+		return start, LockRangeEnd
+	}
+	return start, start + length - 1
+}
+
+func (c *p9Conn) lock(tag uint16, fid *p9Fid, body *p9Buffer) (*p9Buffer, error) {
+	kind := body.get8()
+	body.get32() // flags, blocking locks are retried by the client
+	start, end := lockRange(body.get64(), body.get64())
+	pid := body.get32()
+	client := body.getString()
+	if body.err != nil {
+		return nil, body.err
+	}
+	file, ok := fid.node().node.(*RamFile)
+	if !ok || fid.handle == nil {
+		return nil, fuse.Errno(syscall.EBADF)
+	}
+
+	entry := file.entry
+	owner := lockOwner{process: c.lockOwner(client, pid)}
+	status := uint8(p9LockSuccess)
+	switch kind {
+	case p9LockUnlock:
+		entry.posixLocks.unlock(owner, start, end)
+	case p9LockRead, p9LockWrite:
+		if err := entry.posixLocks.tryLock(owner, start, end, kind == p9LockWrite, int32(pid)); err != nil {
+			status = p9LockBlocked
+		} else {
+			c.locked[entry] = true
+		}
+	default:
+		return nil, fuse.Errno(syscall.EINVAL)
+	}
+
+	reply := newP9Message(p9Rlock, tag)
+	reply.put8(status)
+	return reply, nil
+}
+
+func (c *p9Conn) getlock(tag uint16, fid *p9Fid, body *p9Buffer) (*p9Buffer, error) {
+	kind := body.get8()
+	start, length := body.get64(), body.get64()
+	pid := body.get32()
+	client := body.getString()
+	if body.err != nil {
+		return nil, body.err
+	}
+	file, ok := fid.node().node.(*RamFile)
+	if !ok || fid.handle == nil {
+		return nil, fuse.Errno(syscall.EBADF)
+	}
+
+	first, last := lockRange(start, length)
+	owner := lockOwner{process: c.lockOwner(client, pid)}
+	held, conflict := file.entry.posixLocks.query(owner, first, last, kind == p9LockWrite)
+	reply := newP9Message(p9Rgetlock, tag)
+	if !conflict {
+		reply.put8(p9LockUnlock)
+		reply.put64(start)
+		reply.put64(length)
+		reply.put32(pid)
+		reply.putString(client)
+		return reply, nil
+	}
+	if held.exclusive {
+		reply.put8(p9LockWrite)
+	} else {
+		reply.put8(p9LockRead)
+	}
+	reply.put64(held.start)
+	if held.end == LockRangeEnd {
+		reply.put64(0)
+	} else {
+		reply.put64(held.end - held.start + 1)
+	}
+	reply.put32(uint32(held.pid))
+	reply.putString("")
+	return reply, nil
+}
@@ -0,0 +1,407 @@
+package ramdisk
+
+import (
+	"testing"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// p9TestClient speaks just enough 9P2000.L to test the server
+type p9TestClient struct {
+	t    *testing.T
+	conn net.Conn
+	tag  uint16
+}
+
+// dialP9Test connects to the RAM disk over a "unix" socket or "tcp" on localhost
+func dialP9Test(t *testing.T, filesys *ramdiskFS, network string) *p9TestClient {
+	address := "127.0.0.1:0"
+	if network == "unix" {
+		address = filepath.Join(t.TempDir(), "9p.sock")
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go filesys.Serve9P(listener)
+
+	conn, err := net.Dial(network, listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	client := &p9TestClient{t: t, conn: conn}
+
+	reply := client.rpc(p9Tversion, func(b *p9Buffer) {
+		b.put32(8192)
+		b.putString(p9Version)
+	})
+	if msize, version := reply.get32(), reply.getString(); msize != 8192 || version != p9Version {
+		t.Fatalf("wrong version reply %d %q", msize, version)
+	}
+	return client
+}
+
+// call sends a request and returns the reply fields, or the error of an Rlerror
+func (c *p9TestClient) call(kind uint8, fields func(b *p9Buffer)) (*p9Buffer, syscall.Errno) {
+	c.tag++
+	request := newP9Message(kind, c.tag)
+	fields(request)
+	if _, err := c.conn.Write(request.bytes()); err != nil {
+		c.t.Fatal(err)
+	}
+	replyKind, tag, reply, err := readP9Message(c.conn, p9MaxSize)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if tag != c.tag {
+		c.t.Fatalf("reply with tag %d to request %d", tag, c.tag)
+	}
+	if replyKind == p9Rlerror {
+		return nil, syscall.Errno(reply.get32())
+	}
+	if replyKind != kind+1 {
+		c.t.Fatalf("reply of type %d to request of type %d", replyKind, kind)
+	}
+	return reply, 0
+}
+
+// rpc is call failing the test on errors
+func (c *p9TestClient) rpc(kind uint8, fields func(b *p9Buffer)) *p9Buffer {
+	reply, errno := c.call(kind, fields)
+	if errno != 0 {
+		c.t.Fatalf("request of type %d failed: %v", kind, errno)
+	}
+	return reply
+}
+
+func (c *p9TestClient) attach(fid, uid uint32) {
+	c.rpc(p9Tattach, func(b *p9Buffer) {
+		b.put32(fid)
+		b.put32(p9NoFid)
+		b.putString("")
+		b.putString("")
+		b.put32(uid)
+	})
+}
+
+func (c *p9TestClient) walk(fid, newFid uint32, names ...string) syscall.Errno {
+	reply, errno := c.call(p9Twalk, func(b *p9Buffer) {
+		b.put32(fid)
+		b.put32(newFid)
+		b.put16(uint16(len(names)))
+		for _, name := range names {
+			b.putString(name)
+		}
+	})
+	if errno == 0 && int(reply.get16()) != len(names) {
+		return syscall.ENOENT
+	}
+	return errno
+}
+
+func (c *p9TestClient) lopen(fid, flags uint32) syscall.Errno {
+	_, errno := c.call(p9Tlopen, func(b *p9Buffer) {
+		b.put32(fid)
+		b.put32(flags)
+	})
+	return errno
+}
+
+func (c *p9TestClient) write(fid uint32, offset uint64, data string) {
+	reply := c.rpc(p9Twrite, func(b *p9Buffer) {
+		b.put32(fid)
+		b.put64(offset)
+		b.put32(uint32(len(data)))
+		b.data = append(b.data, data...)
+	})
+	if count := reply.get32(); int(count) != len(data) {
+		c.t.Fatalf("short write %d", count)
+	}
+}
+
+func (c *p9TestClient) read(fid uint32, offset uint64, count uint32) string {
+	reply := c.rpc(p9Tread, func(b *p9Buffer) {
+		b.put32(fid)
+		b.put64(offset)
+		b.put32(count)
+	})
+	return string(reply.take(int(reply.get32())))
+}
+
+func (c *p9TestClient) clunk(fid uint32) {
+	c.rpc(p9Tclunk, func(b *p9Buffer) { b.put32(fid) })
+}
+
+func TestP9(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{Versions: 2})
+	client := dialP9Test(t, filesys, "unix")
+	client.attach(1, uint32(os.Getuid()))
+
+	// create and write a file
+	client.walk(1, 2)
+	reply := client.rpc(p9Tlcreate, func(b *p9Buffer) {
+		b.put32(2)
+		b.putString("n1.txt")
+		b.put32(2) // O_RDWR
+		b.put32(0640)
+		b.put32(uint32(os.Getgid()))
+	})
+	if qid := reply.getQid(); qid.Type != p9QidFile {
+		t.Fatalf("wrong qid %+v", qid)
+	}
+	client.write(2, 0, "hello 9p")
+	client.clunk(2)
+	entry, found := filesys.File("n1.txt")
+	if !found || string(entry.Bytes()) != "hello 9p" || len(entry.Versions()) != 1 {
+		t.Fatal("file not written like through the mount")
+	}
+
+	// read it back
+	if errno := client.walk(1, 3, "n1.txt"); errno != 0 {
+		t.Fatal(errno)
+	}
+	reply = client.rpc(p9Tgetattr, func(b *p9Buffer) {
+		b.put32(3)
+		b.put64(p9GetattrBasic)
+	})
+	reply.get64()
+	qid := reply.getQid()
+	mode := reply.get32()
+	reply.take(4 + 4 + 8 + 8) // uid, gid, nlink, rdev
+	size := reply.get64()
+	if qid.Path != entry.Meta.Inode() || mode != syscall.S_IFREG|0640 || size != 8 {
+		t.Fatalf("wrong attributes %+v %o %d", qid, mode, size)
+	}
+	if errno := client.lopen(3, 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	if data := client.read(3, 6, 100); data != "9p" {
+		t.Fatalf("wrong data read %q", data)
+	}
+	client.clunk(3)
+
+	// list the directory
+	client.walk(1, 4)
+	client.lopen(4, 0)
+	reply = client.rpc(p9Treaddir, func(b *p9Buffer) {
+		b.put32(4)
+		b.put64(0)
+		b.put32(4096)
+	})
+	entries := &p9Buffer{data: reply.take(int(reply.get32()))}
+	var names []string
+	for len(entries.data) > 0 {
+		entries.getQid()
+		entries.get64()
+		entries.get8()
+		names = append(names, entries.getString())
+	}
+	if len(names) != 3 || names[2] != "n1.txt" {
+		t.Fatalf("wrong listing %v", names)
+	}
+	client.clunk(4)
+
+	// rename and remove
+	client.rpc(p9Trenameat, func(b *p9Buffer) {
+		b.put32(1)
+		b.putString("n1.txt")
+		b.put32(1)
+		b.putString("n2.txt")
+	})
+	if _, found := filesys.File("n2.txt"); !found {
+		t.Fatal("file not renamed")
+	}
+	client.rpc(p9Tunlinkat, func(b *p9Buffer) {
+		b.put32(1)
+		b.putString("n2.txt")
+		b.put32(0)
+	})
+	if len(filesys.Files()) != 0 {
+		t.Fatal("file not removed")
+	}
+	if errno := client.walk(1, 5, "n2.txt"); errno != syscall.ENOENT {
+		t.Fatalf("walked to removed file: %v", errno)
+	}
+	if _, errno := client.call(p9Tmkdir, func(b *p9Buffer) { b.put32(1) }); errno != syscall.EPERM {
+		t.Fatalf("directory created: %v", errno)
+	}
+}
+
+func TestP9Permissions(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{P9Users: P9Trusted})
+	filesys.WriteFile("private", []byte("secret"), 0600)
+	client := dialP9Test(t, filesys, "unix")
+	client.attach(1, 54321)
+
+	client.walk(1, 2, "private")
+	if errno := client.lopen(2, 0); errno != syscall.EACCES {
+		t.Fatalf("other user opened private file: %v", errno)
+	}
+}
+
+func TestP9PeerUser(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{RootMode: 0777})
+	client := dialP9Test(t, filesys, "unix")
+	client.attach(1, 54321)
+
+	// the user claimed is ignored, files belong to the user of the client process
+	client.walk(1, 2)
+	client.rpc(p9Tlcreate, func(b *p9Buffer) {
+		b.put32(2)
+		b.putString("u1")
+		b.put32(2) // O_RDWR
+		b.put32(0640)
+		b.put32(uint32(os.Getgid()))
+	})
+	entry, _ := filesys.File("u1")
+	if uid, gid := entry.Meta.Owner(); uid != uint32(os.Getuid()) || gid != uint32(os.Getgid()) {
+		t.Fatalf("wrong owner of created file %d:%d", uid, gid)
+	}
+}
+
+func TestP9RootSquash(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{})
+	entry, _, _ := filesys.WriteFile("private", []byte("secret"), 0600)
+	entry.Chown(0, 0)
+	client := dialP9Test(t, filesys, "tcp")
+	client.attach(1, 0)
+
+	client.walk(1, 2, "private")
+	if errno := client.lopen(2, 0); errno != syscall.EACCES {
+		t.Fatalf("root over the network opened private file: %v", errno)
+	}
+}
+
+func TestP9SquashAll(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{RootMode: 0777, P9Users: P9SquashAll, P9AnonUid: 54321, P9AnonGid: 54322})
+	client := dialP9Test(t, filesys, "unix")
+	client.attach(1, 0)
+
+	// the group asked for is ignored, the user is no member of it
+	client.walk(1, 2)
+	client.rpc(p9Tlcreate, func(b *p9Buffer) {
+		b.put32(2)
+		b.putString("g1")
+		b.put32(2) // O_RDWR
+		b.put32(0640)
+		b.put32(0)
+	})
+	entry, _ := filesys.File("g1")
+	if uid, gid := entry.Meta.Owner(); uid != 54321 || gid != 54322 {
+		t.Fatalf("wrong owner of created file %d:%d", uid, gid)
+	}
+}
+
+func TestP9Malformed(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{})
+	filesys.WriteFile("m1", []byte("data"), 0644)
+	client := dialP9Test(t, filesys, "unix")
+	client.attach(1, uint32(os.Getuid()))
+
+	client.walk(1, 2, "m1")
+	client.rpc(p9Txattrcreate, func(b *p9Buffer) {
+		b.put32(2)
+		b.putString("user.color")
+		b.put64(4)
+		b.put32(0)
+	})
+	for _, offset := range []uint64{1<<64 - 1, 5} {
+		_, errno := client.call(p9Twrite, func(b *p9Buffer) {
+			b.put32(2)
+			b.put64(offset)
+			b.put32(0)
+		})
+		if errno != syscall.EINVAL {
+			t.Fatalf("write at offset %d: expected EINVAL, got %v", offset, errno)
+		}
+	}
+	_, errno := client.call(p9Twrite, func(b *p9Buffer) {
+		b.put32(2)
+		b.put64(2)
+		b.put32(3)
+		b.data = append(b.data, "red"...)
+	})
+	if errno != syscall.ERANGE {
+		t.Fatalf("write beyond the size: expected ERANGE, got %v", errno)
+	}
+
+	// the connection is still served
+	client.write(2, 0, "blue")
+	client.clunk(2)
+}
+
+func TestP9XattrsAndLocks(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{})
+	entry, _, _ := filesys.WriteFile("x1", []byte("data"), 0644)
+	client := dialP9Test(t, filesys, "unix")
+	client.attach(1, uint32(os.Getuid()))
+
+	// setxattr(2) is Txattrcreate, Twrite and Tclunk
+	client.walk(1, 2, "x1")
+	client.rpc(p9Txattrcreate, func(b *p9Buffer) {
+		b.put32(2)
+		b.putString("user.color")
+		b.put64(4)
+		b.put32(0)
+	})
+	client.write(2, 0, "blue")
+	client.clunk(2)
+	if value, found := entry.Xattr("user.color"); !found || string(value) != "blue" {
+		t.Fatal("extended attribute not set")
+	}
+
+	client.walk(1, 3, "x1")
+	reply := client.rpc(p9Txattrwalk, func(b *p9Buffer) {
+		b.put32(3)
+		b.put32(4)
+		b.putString("user.color")
+	})
+	if size := reply.get64(); size != 4 || client.read(4, 0, 100) != "blue" {
+		t.Fatal("extended attribute not read")
+	}
+	client.clunk(4)
+
+	// byte-range locks conflict with in-process locks
+	client.lopen(3, 2)
+	lock := func(kind uint8) uint8 {
+		reply := client.rpc(p9Tlock, func(b *p9Buffer) {
+			b.put32(3)
+			b.put8(kind)
+			b.put32(0)
+			b.put64(0)
+			b.put64(0)
+			b.put32(42)
+			b.putString("guest")
+		})
+		return reply.get8()
+	}
+	if status := lock(p9LockWrite); status != p9LockSuccess {
+		t.Fatalf("lock not granted: %d", status)
+	}
+	owner := NewLockOwner()
+	if err := entry.TryLockRange(owner, 0, 10, false); err == nil {
+		t.Fatal("9P lock not held")
+	}
+	lock(p9LockUnlock)
+	if err := entry.TryLockRange(owner, 0, 10, true); err != nil {
+		t.Fatal("9P lock not released")
+	}
+	if status := lock(p9LockRead); status != p9LockBlocked {
+		t.Fatalf("conflicting lock granted: %d", status)
+	}
+	entry.UnlockRange(owner, 0, 10)
+
+	lock(p9LockWrite)
+	client.conn.Close()
+	for i := 0; i < 100 && entry.TryLockRange(owner, 0, 10, true) != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if locks := entry.Locks(); len(locks) != 1 || locks[0].PID != 0 {
+		t.Fatalf("locks not released with the connection: %+v", locks)
+	}
+}
@@ -0,0 +1,282 @@
+package ramdisk
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// 9P2000.L message types, see https://github.com/chaos/diod/blob/master/protocol.md
+const (
+	p9Rlerror      = 7
+	p9Tstatfs      = 8
+	p9Rstatfs      = 9
+	p9Tlopen       = 12
+	p9Rlopen       = 13
+	p9Tlcreate     = 14
+	p9Rlcreate     = 15
+	p9Tmknod       = 18
+	p9Rmknod       = 19
+	p9Trename      = 20
+	p9Rrename      = 21
+	p9Tgetattr     = 24
+	p9Rgetattr     = 25
+	p9Tsetattr     = 26
+	p9Rsetattr     = 27
+	p9Txattrwalk   = 30
+	p9Rxattrwalk   = 31
+	p9Txattrcreate = 32
+	p9Rxattrcreate = 33
+	p9Treaddir     = 40
+	p9Rreaddir     = 41
+	p9Tfsync       = 50
+	p9Rfsync       = 51
+	p9Tlock        = 52
+	p9Rlock        = 53
+	p9Tgetlock     = 54
+	p9Rgetlock     = 55
+	p9Tmkdir       = 72
+	p9Trenameat    = 74
+	p9Rrenameat    = 75
+	p9Tunlinkat    = 76
+	p9Runlinkat    = 77
+	p9Tversion     = 100
+	p9Rversion     = 101
+	p9Tauth        = 102
+	p9Tattach      = 104
+	p9Rattach      = 105
+	p9Tflush       = 108
+	p9Rflush       = 109
+	p9Twalk        = 110
+	p9Rwalk        = 111
+	p9Tread        = 116
+	p9Rread        = 117
+	p9Twrite       = 118
+	p9Rwrite       = 119
+	p9Tclunk       = 120
+	p9Rclunk       = 121
+	p9Tremove      = 122
+	p9Rremove      = 123
+)
+
+const (
+	p9Version   = "9P2000.L"
+	p9NoFid     = 0xffffffff
+	p9NoUid     = 0xffffffff
+	p9MaxWalk   = 16
+	p9HeaderLen = 7          // size[4] type[1] tag[2]
+	p9IOHeader  = 11         // header of Rread and Rwrite: size[4] type[1] tag[2] count[4]
+	p9MaxSize   = 1<<20 + 64 // largest message accepted, msize is negotiated down to it
+
+	p9QidDir  = 0x80
+	p9QidFile = 0
+
+	// bits of Tgetattr and Rgetattr
+	p9GetattrBasic = 0x7ff
+
+	// bits of Tsetattr
+	p9SetattrMode     = 0x1
+	p9SetattrUid      = 0x2
+	p9SetattrGid      = 0x4
+	p9SetattrSize     = 0x8
+	p9SetattrAtime    = 0x10
+	p9SetattrMtime    = 0x20
+	p9SetattrAtimeSet = 0x80
+	p9SetattrMtimeSet = 0x100
+
+	// flags of Tlopen and Tlcreate, independent of the host
+	p9OpenAccess = 03
+	p9OpenCreate = 0100
+	p9OpenExcl   = 0200
+	p9OpenTrunc  = 01000
+	p9OpenAppend = 02000
+
+	// Tlock and Tgetlock
+	p9LockRead    = 0
+	p9LockWrite   = 1
+	p9LockUnlock  = 2
+	p9LockSuccess = 0
+	p9LockBlocked = 1
+
+	p9RemoveDir = 0x200 // AT_REMOVEDIR of Tunlinkat
+
+	p9StatfsType = 0x01021997 // V9FS_MAGIC
+)
+
+var errP9Short = errors.New("9p: message too short")
+
+// p9Qid identifies a file to the client, like an inode number
+type p9Qid struct {
+	Type    uint8
+	Version uint32
+	Path    uint64
+}
+
+// p9Buffer encodes a message by appending to data, or decodes one by consuming data from the front.
+// decoding errors are sticky, check err after reading all fields
+type p9Buffer struct {
+	data []byte
+	err  error
+}
+
+// newP9Message starts a message of type kind
+func newP9Message(kind uint8, tag uint16) *p9Buffer {
+	b := &p9Buffer{data: make([]byte, 4, 64)}
+	b.put8(kind)
+	b.put16(tag)
+	return b
+}
+
+// bytes returns the encoded message, with its size
+func (b *p9Buffer) bytes() []byte {
+	binary.LittleEndian.PutUint32(b.data, uint32(len(b.data)))
+	return b.data
+}
+
+func (b *p9Buffer) put8(v uint8) {
+	b.data = append(b.data, v)
+}
+
+func (b *p9Buffer) put16(v uint16) {
+	b.data = append(b.data, byte(v), byte(v>>8))
+}
+
+func (b *p9Buffer) put32(v uint32) {
+	b.data = append(b.data, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func (b *p9Buffer) put64(v uint64) {
+	b.put32(uint32(v))
+	b.put32(uint32(v >> 32))
+}
+
+func (b *p9Buffer) putString(s string) {
+	b.put16(uint16(len(s)))
+	b.data = append(b.data, s...)
+}
+
+func (b *p9Buffer) putQid(qid p9Qid) {
+	b.put8(qid.Type)
+	b.put32(qid.Version)
+	b.put64(qid.Path)
+}
+
+// take consumes n bytes, nil if the message is too short
+func (b *p9Buffer) take(n int) []byte {
+	if b.err != nil || n < 0 || len(b.data) < n {
+		b.err = errP9Short
+		return nil
+	}
+	taken := b.data[:n]
+	b.data = b.data[n:]
+	return taken
+}
+
+func (b *p9Buffer) get8() uint8 {
+	if p := b.take(1); p != nil {
+		return p[0]
+	}
+	return 0
+}
+
+func (b *p9Buffer) get16() uint16 {
+	if p := b.take(2); p != nil {
+		return binary.LittleEndian.Uint16(p)
+	}
+	return 0
+}
+
+func (b *p9Buffer) get32() uint32 {
+	if p := b.take(4); p != nil {
+		return binary.LittleEndian.Uint32(p)
+	}
+	return 0
+}
+
+func (b *p9Buffer) get64() uint64 {
+	if p := b.take(8); p != nil {
+		return binary.LittleEndian.Uint64(p)
+	}
+	return 0
+}
+
+func (b *p9Buffer) getString() string {
+	return string(b.take(int(b.get16())))
+}
+
+func (b *p9Buffer) getQid() p9Qid {
+	return p9Qid{Type: b.get8(), Version: b.get32(), Path: b.get64()}
+}
+
+// readP9Message reads the next message from r, returning its type, tag and the remaining fields
+func readP9Message(r io.Reader, msize uint32) (kind uint8, tag uint16, body *p9Buffer, err error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return 0, 0, nil, err
+	}
+	length := binary.LittleEndian.Uint32(size[:])
+	if length < p9HeaderLen || length > msize {
+		return 0, 0, nil, errors.New("9p: invalid message size")
+	}
+	data := make([]byte, length-4)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, 0, nil, err
+	}
+	body = &p9Buffer{data: data}
+	kind = body.get8()
+	tag = body.get16()
+	return kind, tag, body, nil
+}
+
+// p9Mode encodes the type and permission bits of mode like st_mode
+func p9Mode(mode os.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	switch {
+	case mode.IsDir():
+		bits |= syscall.S_IFDIR
+	case mode&os.ModeNamedPipe != 0:
+		bits |= syscall.S_IFIFO
+	case mode&os.ModeSocket != 0:
+		bits |= syscall.S_IFSOCK
+	case mode&os.ModeCharDevice != 0:
+		bits |= syscall.S_IFCHR
+	case mode&os.ModeDevice != 0:
+		bits |= syscall.S_IFBLK
+	case mode&os.ModeSymlink != 0:
+		bits |= syscall.S_IFLNK
+	default:
+		bits |= syscall.S_IFREG
+	}
+	if mode&os.ModeSetuid != 0 {
+		bits |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= syscall.S_ISVTX
+	}
+	return bits
+}
+
+// p9FileMode decodes st_mode bits sent by the client
+func p9FileMode(bits uint32) os.FileMode {
+	mode := os.FileMode(bits & 0777)
+	switch bits & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		mode |= os.ModeDir
+	case syscall.S_IFIFO:
+		mode |= os.ModeNamedPipe
+	case syscall.S_IFSOCK:
+		mode |= os.ModeSocket
+	case syscall.S_IFCHR:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case syscall.S_IFBLK:
+		mode |= os.ModeDevice
+	case syscall.S_IFLNK:
+		mode |= os.ModeSymlink
+	}
+	return mode
+}
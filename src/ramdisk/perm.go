@@ -0,0 +1,190 @@
+package ramdisk
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// permission bits as used by access(2)
+const (
+	accessExec  = 1
+	accessWrite = 2
+	accessRead  = 4
+)
+
+// modeBits are the bits of a mode set by chmod(2): permissions, setuid, setgid and sticky
+const modeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// owner and permission bits of an inode
+type permissions struct {
+	mode os.FileMode // modeBits only, no type bits
+	uid  uint32
+	gid  uint32
+}
+
+// permits checks if the caller identified by header may access the inode.
+// want is a combination of accessRead, accessWrite and accessExec.
+// Supplementary groups of the caller are unknown to FUSE and are not considered.
+func (p permissions) permits(header fuse.Header, want uint32) bool {
+	if header.Uid == 0 {
+		// root may do anything, but execute only if anybody may execute
+		return want&accessExec == 0 || p.mode&0111 != 0
+	}
+
+	var granted uint32
+	switch {
+	case header.Uid == p.uid:
+		granted = uint32(p.mode>>6) & 7
+	case header.Gid == p.gid:
+		granted = uint32(p.mode>>3) & 7
+	default:
+		granted = uint32(p.mode) & 7
+	}
+	return want&granted == want
+}
+
+// setattr applies chmod and chown parts of req, checking if the caller is allowed to do so
+func (p *permissions) setattr(req *fuse.SetattrRequest, enforce bool) error {
+	if enforce && req.Header.Uid != 0 {
+		if (req.Valid.Mode() || req.Valid.Gid()) && req.Header.Uid != p.uid {
+			return fuse.EPERM
+		}
+		if req.Valid.Uid() && req.Uid != p.uid {
+			// only root may give away files
+			return fuse.EPERM
+		}
+		if req.Valid.Gid() && req.Gid != p.gid && req.Gid != req.Header.Gid {
+			return fuse.EPERM
+		}
+	}
+
+	if req.Valid.Mode() {
+		p.mode = req.Mode & modeBits
+		if enforce && req.Header.Uid != 0 && req.Header.Gid != p.gid {
+			// like chmod(2), setgid is cleared for owners not in the group of the file
+			p.mode &^= os.ModeSetgid
+		}
+	}
+	if req.Valid.Uid() {
+		p.uid = req.Uid
+	}
+	if req.Valid.Gid() {
+		p.gid = req.Gid
+	}
+	return nil
+}
+
+// permitsXattr checks if the caller identified by header may set or remove the extended attribute name.
+// This needs write permission, attributes controlling the RAM disk (user.ramdisk.*) are reserved to the owner
+func (p permissions) permitsXattr(header fuse.Header, name string) error {
+	if strings.HasPrefix(name, xattrControlPrefix) && header.Uid != 0 && header.Uid != p.uid {
+		return fuse.EPERM
+	}
+	if !p.permits(header, accessWrite) {
+		return fuse.Errno(syscall.EACCES)
+	}
+	return nil
+}
+
+// openAccess maps open flags to the access needed
+func openAccess(flags fuse.OpenFlags) (want uint32) {
+	switch {
+	case flags.IsReadOnly():
+		want = accessRead
+	case flags.IsWriteOnly():
+		want = accessWrite
+	case flags.IsReadWrite():
+		want = accessRead | accessWrite
+	}
+	if flags&fuse.OpenTruncate != 0 {
+		want |= accessWrite
+	}
+	return
+}
+
+// enforcePermissions tells if the RAM disk has to check permissions, or if the kernel does it
+func (f *ramdiskFS) enforcePermissions() bool {
+	return !f.options.DefaultPermissions
+}
+
+// implements fs.NodeAccesser
+func (f *RamFile) Access(ctx context.Context, req *fuse.AccessRequest) error {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	if !f.perm.permits(req.Header, req.Mask) {
+		return fuse.Errno(syscall.EACCES)
+	}
+	return nil
+}
+
+// implements fs.NodeAccesser
+func (d *Dir) Access(ctx context.Context, req *fuse.AccessRequest) error {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	if !d.perm.permits(req.Header, req.Mask) {
+		return fuse.Errno(syscall.EACCES)
+	}
+	return nil
+}
+
+// implements fs.NodeSetattrer
+func (d *Dir) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	enforce := d.fs.enforcePermissions()
+	now := time.Now()
+
+	d.mutex.Lock()
+	var err error
+	if enforce {
+		err = checkSetTimes(d.perm, req)
+	}
+	if err == nil {
+		err = d.perm.setattr(req, enforce)
+	}
+	if err == nil {
+		setTimes(req, now, &d.accessed, &d.modified)
+		d.changed = now
+	}
+	d.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return d.Attr(ctx, &resp.Attr)
+}
+
+// Mode returns the permission bits of the file
+func (f *RamFile) Mode() os.FileMode {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.perm.mode
+}
+
+// Owner returns uid and gid of the file's owner
+func (f *RamFile) Owner() (uid, gid uint32) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.perm.uid, f.perm.gid
+}
+
+// Chmod sets the permission bits of the file, including setuid, setgid and sticky
+func (e *FileEntry) Chmod(mode os.FileMode) {
+	e.Meta.mutex.Lock()
+	e.Meta.perm.mode = mode & modeBits
+	e.Meta.changed = time.Now()
+	e.Meta.mutex.Unlock()
+}
+
+// Chown sets the owner of the file
+func (e *FileEntry) Chown(uid, gid uint32) {
+	e.Meta.mutex.Lock()
+	e.Meta.perm.uid = uid
+	e.Meta.perm.gid = gid
+	e.Meta.changed = time.Now()
+	e.Meta.mutex.Unlock()
+}
@@ -0,0 +1,157 @@
+package ramdisk
+
+import (
+	"testing"
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs/fstestutil"
+	"golang.org/x/net/context"
+	"os"
+	"syscall"
+)
+
+func TestPermits(t *testing.T) {
+	perm := permissions{mode: 0640, uid: 1000, gid: 100}
+
+	owner := fuse.Header{Uid: 1000, Gid: 1000}
+	if !perm.permits(owner, accessRead|accessWrite) {
+		t.Fatal("owner may not read and write")
+	}
+	if perm.permits(owner, accessExec) {
+		t.Fatal("owner may execute")
+	}
+
+	group := fuse.Header{Uid: 1001, Gid: 100}
+	if !perm.permits(group, accessRead) || perm.permits(group, accessWrite) {
+		t.Fatal("wrong group permissions")
+	}
+
+	other := fuse.Header{Uid: 1002, Gid: 101}
+	if perm.permits(other, accessRead) {
+		t.Fatal("others may read")
+	}
+
+	root := fuse.Header{Uid: 0, Gid: 0}
+	if !perm.permits(root, accessRead|accessWrite) || perm.permits(root, accessExec) {
+		t.Fatal("wrong root permissions")
+	}
+}
+
+func TestSetattrModeBits(t *testing.T) {
+	perm := permissions{mode: 0644, uid: 1000, gid: 100}
+	req := &fuse.SetattrRequest{Header: fuse.Header{Uid: 1000, Gid: 100}, Valid: fuse.SetattrMode, Mode: os.ModeSetuid | os.ModeSetgid | os.ModeSticky | 0755}
+	if err := perm.setattr(req, true); err != nil || perm.mode != req.Mode {
+		t.Fatalf("special bits not kept: %v %v", perm.mode, err)
+	}
+
+	// setgid is cleared for owners not in the group
+	req.Header.Gid = 1000
+	perm.setattr(req, true)
+	if perm.mode != os.ModeSetuid|os.ModeSticky|0755 {
+		t.Fatalf("setgid kept for owner outside the group: %v", perm.mode)
+	}
+}
+
+func TestSetxattrPermissions(t *testing.T) {
+	filesys := CreateRamFS()
+	entry := createFileEntry("p1.txt", filesys, permissions{mode: 0664, uid: 1000, gid: 100})
+	ctx := context.Background()
+
+	other := fuse.Header{Uid: 1002, Gid: 101}
+	if err := entry.Meta.Setxattr(ctx, &fuse.SetxattrRequest{Header: other, Name: "user.color", Xattr: []byte("red")}); err != fuse.Errno(syscall.EACCES) {
+		t.Fatalf("expected EACCES for other user, got %v", err)
+	}
+	if err := entry.Meta.Removexattr(ctx, &fuse.RemovexattrRequest{Header: other, Name: "user.color"}); err != fuse.Errno(syscall.EACCES) {
+		t.Fatalf("expected EACCES for other user, got %v", err)
+	}
+
+	group := fuse.Header{Uid: 1001, Gid: 100}
+	if err := entry.Meta.Setxattr(ctx, &fuse.SetxattrRequest{Header: group, Name: "user.color", Xattr: []byte("red")}); err != nil {
+		t.Fatalf("group member may not set attribute: %v", err)
+	}
+	if err := entry.Meta.Setxattr(ctx, &fuse.SetxattrRequest{Header: group, Name: XattrRing, Xattr: []byte("8")}); err != fuse.EPERM {
+		t.Fatalf("expected EPERM for control attribute of other owner, got %v", err)
+	}
+}
+
+func TestLookupPermissions(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{RootMode: 0700})
+	filesys.CreateFile("p2.txt", 0666)
+	ctx := context.Background()
+
+	other := fuse.Header{Uid: 1002, Gid: 101}
+	if _, err := filesys.root.Lookup(ctx, &fuse.LookupRequest{Header: other, Name: "p2.txt"}, &fuse.LookupResponse{}); err != fuse.Errno(syscall.EACCES) {
+		t.Fatalf("expected EACCES on lookup, got %v", err)
+	}
+	createReq := &fuse.CreateRequest{Header: other, Name: "p2.txt", Flags: fuse.OpenReadWrite | fuse.OpenCreate, Mode: 0644}
+	if _, _, err := filesys.root.Create(ctx, createReq, &fuse.CreateResponse{}); err != fuse.Errno(syscall.EACCES) {
+		t.Fatalf("expected EACCES on create, got %v", err)
+	}
+
+	owner := fuse.Header{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	if _, err := filesys.root.Lookup(ctx, &fuse.LookupRequest{Header: owner, Name: "p2.txt"}, &fuse.LookupResponse{}); err != nil {
+		t.Fatalf("owner lookup failed: %v", err)
+	}
+}
+
+func TestCreateModeAndUmask(t *testing.T) {
+	mnt, mntErr := fstestutil.MountedT(t, CreateRamFSWithOptions(Options{Umask: 0027}), nil)
+	if mntErr != nil {
+		t.Fatal("mount failed")
+	}
+	defer mnt.Close()
+
+	writer, createErr := os.OpenFile(mnt.Dir + "/" + "p1.txt", os.O_CREATE|os.O_WRONLY, 0666)
+	if createErr != nil {
+		t.Fatal("create failed")
+	}
+	writer.Close()
+
+	fileInfo, errStat := os.Stat(mnt.Dir + "/" + "p1.txt")
+	if errStat != nil {
+		t.Fatal("no stat on created file")
+	}
+	if fileInfo.Mode().Perm()&0027 != 0 {
+		t.Fatalf("umask not applied: %v", fileInfo.Mode())
+	}
+
+	stat := fileInfo.Sys().(*syscall.Stat_t)
+	if stat.Uid != uint32(os.Getuid()) || stat.Gid != uint32(os.Getgid()) {
+		t.Fatalf("wrong owner %d:%d", stat.Uid, stat.Gid)
+	}
+}
+
+func TestChmodChown(t *testing.T) {
+	filesys := CreateRamFS()
+	mnt, mntErr := fstestutil.MountedT(t, filesys, nil)
+	if mntErr != nil {
+		t.Fatal("mount failed")
+	}
+	defer mnt.Close()
+
+	path := mnt.Dir + "/" + "p2.txt"
+	writer, createErr := os.Create(path)
+	if createErr != nil {
+		t.Fatal("create failed")
+	}
+	writer.Close()
+
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatalf("chmod failed: %v", err)
+	}
+	fileInfo, _ := os.Stat(path)
+	if fileInfo.Mode().Perm() != 0600 {
+		t.Fatalf("chmod not applied: %v", fileInfo.Mode())
+	}
+
+	if os.Getuid() != 0 {
+		t.Skip("chown needs root")
+	}
+	if err := os.Chown(path, 4711, 4712); err != nil {
+		t.Fatalf("chown failed: %v", err)
+	}
+	entry, _ := filesys.root.findEntryByName("p2.txt")
+	uid, gid := entry.Meta.Owner()
+	if uid != 4711 || gid != 4712 {
+		t.Fatalf("chown not applied: %d:%d", uid, gid)
+	}
+}
@@ -0,0 +1,80 @@
+package ramdisk
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"syscall"
+	"time"
+)
+
+// reasons for the removal of a file, see EventFileRemoved
+const (
+	RemovedUnlinked = "unlinked" // unlink(2) on the mount
+	RemovedExpired  = "expired"  // the TTL of the file ran out
+)
+
+// implements fs.NodeRemover
+func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	d.mutex.RLock()
+	permitted := d.perm.permits(req.Header, accessWrite|accessExec)
+	d.mutex.RUnlock()
+	if d.fs.enforcePermissions() && !permitted {
+		return fuse.Errno(syscall.EACCES)
+	}
+
+	entry, found := d.findEntryByName(req.Name)
+	if !found {
+		return fuse.ENOENT
+	}
+	if req.Dir {
+		// rmdir(2), but there are no sub directories
+		return fuse.Errno(syscall.ENOTDIR)
+	}
+	if !d.removeEntry(entry, RemovedUnlinked) {
+		// somebody else was faster
+		return fuse.ENOENT
+	}
+	return nil
+}
+
+// removeEntry unlinks entry from the directory and notifies listeners.
+// Open handles keep working, the data is gone with the last of them.
+func (d *Dir) removeEntry(entry *FileEntry, reason string) bool {
+	d.mutex.Lock()
+	unlinked := d.unlinkLocked(entry)
+	d.mutex.Unlock()
+
+	if unlinked {
+		d.removed(entry, reason)
+	}
+	return unlinked
+}
+
+// unlinkLocked takes entry out of the directory, caller must hold the mutex
+func (d *Dir) unlinkLocked(entry *FileEntry) bool {
+	for i, fileEntry := range d.entries {
+		if fileEntry != entry {
+			continue
+		}
+		d.entries = append(d.entries[:i], d.entries[i+1:]...)
+		d.whiteout(entry)
+		now := time.Now()
+		d.modified = now
+		d.changed = now
+
+		entry.mutex.Lock()
+		entry.unlinked = true
+		entry.release()
+		entry.mutex.Unlock()
+		return true
+	}
+	return false
+}
+
+// removed completes the removal of an unlinked entry
+func (d *Dir) removed(entry *FileEntry, reason string) {
+	entry.Meta.touchChanged()
+	d.fs.metrics.addFiles(-1)
+
+	d.fs.backendEvents.FileRemoved <- EventFileRemoved{FSEvent{File: entry}, reason}
+}
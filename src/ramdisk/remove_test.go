@@ -0,0 +1,42 @@
+package ramdisk
+
+import (
+	"testing"
+	"bazil.org/fuse/fs/fstestutil"
+	"io/ioutil"
+	"os"
+)
+
+func TestRemove(t *testing.T) {
+	filesys := CreateRamFS()
+	mnt, mntErr := fstestutil.MountedT(t, filesys, nil)
+	if mntErr != nil {
+		t.Fatal("mount failed")
+	}
+	defer mnt.Close()
+
+	path := mnt.Dir + "/" + "r1.txt"
+	ioutil.WriteFile(path, []byte("still here"), 0644)
+
+	reader, err := os.Open(path)
+	if err != nil {
+		t.Fatal("open failed")
+	}
+	defer reader.Close()
+
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("removed file still exists: %v", err)
+	}
+
+	// open handles keep working
+	byts, _ := ioutil.ReadAll(reader)
+	if string(byts) != "still here" {
+		t.Fatalf("wrong content of removed file: %q", byts)
+	}
+	if filesys.Metrics().Files != 0 {
+		t.Fatal("removed file still counted")
+	}
+}
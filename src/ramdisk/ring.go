@@ -0,0 +1,94 @@
+package ramdisk
+
+import (
+	"bazil.org/fuse"
+	"path"
+	"strconv"
+	"syscall"
+)
+
+// XattrRing turns a file into a ring buffer of the size given in bytes (decimal), removing it ends ring buffering
+const XattrRing = "user.ramdisk.ring"
+
+// RingRule makes files with names matching Pattern (see path.Match) ring buffers of Size bytes
+type RingRule struct {
+	Pattern string
+	Size    int64
+}
+
+// ringSize returns the ring buffer size of the first rule matching name, zero if none matches
+func (o Options) ringSize(name string) int64 {
+	for _, rule := range o.RingRules {
+		if matched, _ := path.Match(rule.Pattern, name); matched {
+			return rule.Size
+		}
+	}
+	return 0
+}
+
+// SetRingSize turns the file into a ring buffer keeping the last size bytes written, or back into a regular file if size is zero.
+// Offsets of writes to a ring buffer count from the start of everything ever written, reads see the retained bytes only.
+func (e *FileEntry) SetRingSize(size int64) {
+	e.setRingSize(size)
+	e.modifiedInProcess()
+}
+
+func (e *FileEntry) setRingSize(size int64) {
+	e.mutex.Lock()
+	e.own()
+	e.ringSize = size
+	e.discarded = 0
+	e.trimRing()
+	e.setSize(uint64(len(e.Data)))
+	e.mutex.Unlock()
+
+	e.Meta.touchModified()
+}
+
+// RingSize returns the maximum size of a ring-buffer file, zero for regular files
+func (e *FileEntry) RingSize() int64 {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.ringSize
+}
+
+// Discarded returns the number of bytes a ring-buffer file dropped since it was created or truncated to zero
+func (e *FileEntry) Discarded() int64 {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.discarded
+}
+
+// ringWindow maps a write at a stream offset to the retained data, dropping bytes discarded already.
+// caller must hold the mutex
+func (e *FileEntry) ringWindow(newBytes []byte, offset int64) ([]byte, int64) {
+	offset -= e.discarded
+	if offset < 0 {
+		skip := -offset
+		if skip > int64(len(newBytes)) {
+			skip = int64(len(newBytes))
+		}
+		newBytes = newBytes[skip:]
+		offset = 0
+	}
+	return newBytes, offset
+}
+
+// trimRing drops the oldest bytes beyond the size of a ring buffer, caller must hold the mutex.
+// Data keeps being a plain slice for in-process users, re-slicing and the growth of append keep memory bounded.
+func (e *FileEntry) trimRing() {
+	excess := int64(len(e.Data)) - e.ringSize
+	if e.ringSize <= 0 || excess <= 0 {
+		return
+	}
+	e.Data = e.Data[excess:]
+	e.discarded += excess
+}
+
+func parseRingSize(value []byte) (int64, error) {
+	size, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil || size < 0 {
+		return 0, fuse.Errno(syscall.EINVAL)
+	}
+	return size, nil
+}
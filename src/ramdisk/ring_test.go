@@ -0,0 +1,109 @@
+package ramdisk
+
+import (
+	"testing"
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs/fstestutil"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"syscall"
+)
+
+func TestRingWrite(t *testing.T) {
+	filesys := CreateRamFS()
+	entry := createFileEntry("g0.log", filesys, permissions{mode: 0644})
+	entry.setRingSize(8)
+
+	// a sequential writer keeps its offset in the stream
+	writer := Handle{entry: entry, flags: fuse.OpenWriteOnly}
+	offset := int64(0)
+	for _, chunk := range []string{"abcd", "efgh", "ijkl"} {
+		writer.Write(context.Background(), &fuse.WriteRequest{Data: []byte(chunk), Offset: offset}, &fuse.WriteResponse{})
+		offset += int64(len(chunk))
+	}
+	if string(entry.Data) != "efghijkl" || entry.Discarded() != 4 || entry.Meta.Size() != 8 {
+		t.Fatalf("wrong retained window %q, discarded %d", entry.Data, entry.Discarded())
+	}
+
+	appending := Handle{entry: entry, flags: fuse.OpenWriteOnly | fuse.OpenAppend}
+	appending.Write(context.Background(), &fuse.WriteRequest{Data: []byte("0123456789")}, &fuse.WriteResponse{})
+	if string(entry.Data) != "23456789" || entry.Discarded() != 14 {
+		t.Fatalf("wrong window after large append %q", entry.Data)
+	}
+
+	// bytes discarded already are not written again
+	entry.write([]byte("xxxxZZ"), 10, false)
+	if string(entry.Data) != "ZZ456789" {
+		t.Fatalf("wrong window after rewrite %q", entry.Data)
+	}
+
+	entry.truncate(0)
+	if entry.Discarded() != 0 || len(entry.Data) != 0 {
+		t.Fatal("truncate did not reset the ring")
+	}
+}
+
+func TestRingCapacity(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{Capacity: 64})
+	entry := createFileEntry("g2.log", filesys, permissions{mode: 0644})
+	entry.setRingSize(16)
+
+	// only the retained bytes count against the capacity
+	writer := Handle{entry: entry, flags: fuse.OpenWriteOnly}
+	chunk := make([]byte, 16)
+	for offset := int64(0); offset <= 128; offset += 16 {
+		err := writer.Write(context.Background(), &fuse.WriteRequest{Data: chunk, Offset: offset}, &fuse.WriteResponse{})
+		if err != nil {
+			t.Fatalf("write at offset %d failed: %v", offset, err)
+		}
+	}
+	if entry.Meta.Size() != 16 || filesys.Metrics().BytesStored != 16 {
+		t.Fatalf("wrong size %d, stored %d", entry.Meta.Size(), filesys.Metrics().BytesStored)
+	}
+}
+
+func TestRingSelection(t *testing.T) {
+	options := Options{RingRules: []RingRule{{Pattern: "*.log", Size: 1024}}}
+	if options.ringSize("app.log") != 1024 || options.ringSize("app.txt") != 0 {
+		t.Fatal("ring rules not applied")
+	}
+
+	filesys := CreateRamFSWithOptions(options)
+
+	entry := createFileEntry("g1.txt", filesys, permissions{mode: 0644})
+	if err := entry.SetXattr(XattrRing, []byte("-1")); err != fuse.Errno(syscall.EINVAL) {
+		t.Fatalf("expected EINVAL for malformed size, got %v", err)
+	}
+	entry.SetXattr(XattrRing, []byte("4"))
+	if entry.RingSize() != 4 || entry.openResponseFlags() != fuse.OpenDirectIO {
+		t.Fatal("ring attribute not applied")
+	}
+	entry.RemoveXattr(XattrRing)
+	if entry.RingSize() != 0 {
+		t.Fatal("removing ring attribute did not end ring buffering")
+	}
+}
+
+func TestRingMounted(t *testing.T) {
+	mnt, mntErr := fstestutil.MountedT(t, CreateRamFSWithOptions(Options{RingRules: []RingRule{{Pattern: "*.log", Size: 10}}}), nil)
+	if mntErr != nil {
+		t.Fatal("mount failed")
+	}
+	defer mnt.Close()
+
+	path := mnt.Dir + "/" + "g2.log"
+	writer, err := os.Create(path)
+	if err != nil {
+		t.Fatal("create failed")
+	}
+	defer writer.Close()
+	for _, line := range []string{"line 1\n", "line 2\n", "line 3\n"} {
+		writer.WriteString(line)
+	}
+
+	byts, _ := ioutil.ReadFile(path)
+	if string(byts) != "2\nline 3\n" {
+		t.Fatalf("wrong retained window %q", byts)
+	}
+}
@@ -0,0 +1,98 @@
+package ramdisk
+
+import (
+	"bazil.org/fuse"
+	"strconv"
+	"syscall"
+)
+
+// Extended attributes of directories, overriding Options.KeepFiles and Options.KeepBytes for the directory
+const (
+	XattrKeepFiles = "user.ramdisk.keep_files" // number of files kept (decimal), "0" keeps all
+	XattrKeepBytes = "user.ramdisk.keep_bytes" // bytes kept (decimal), "0" keeps all
+)
+
+// RemovedRotated is the reason of removals making room for newer files of a directory, see EventFileRemoved
+const RemovedRotated = "rotated"
+
+// rotationPolicy limits what a directory keeps, zero means no limit
+type rotationPolicy struct {
+	files int64
+	bytes int64
+}
+
+func parseKeep(value []byte) (int64, error) {
+	keep, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil || keep < 0 {
+		return 0, fuse.Errno(syscall.EINVAL)
+	}
+	return keep, nil
+}
+
+// rotationPolicy returns the policy of the directory, its attributes override the inherited policy
+func (d *Dir) rotationPolicy(inherited rotationPolicy) rotationPolicy {
+	policy := inherited
+	if value, err := d.xattrs.get(XattrKeepFiles); err == nil {
+		policy.files, _ = parseKeep(value)
+	}
+	if value, err := d.xattrs.get(XattrKeepBytes); err == nil {
+		policy.bytes, _ = parseKeep(value)
+	}
+	return policy
+}
+
+// rotate enforces the rotation policies after a file was created or closed
+func (f *ramdiskFS) rotate() {
+	f.root.rotate(rotationPolicy{files: int64(f.options.KeepFiles), bytes: f.options.KeepBytes})
+}
+
+// rotate removes the oldest committed files of the directory, until it is within its policy.
+// files still open are not committed yet, they are kept like pinned files. special and virtual files don't count
+func (d *Dir) rotate(inherited rotationPolicy) {
+	policy := d.rotationPolicy(inherited)
+	if policy.files <= 0 && policy.bytes <= 0 {
+		return
+	}
+
+	rotated := make([]*FileEntry, 0)
+	d.mutex.Lock()
+	files := int64(0)
+	bytes := int64(0)
+	for _, entry := range d.entries {
+		if entry.regular() {
+			files++
+			bytes += entry.dataSize()
+		}
+	}
+	// entries are in order of creation, oldest first
+	for _, entry := range append([]*FileEntry{}, d.entries...) {
+		tooManyFiles := policy.files > 0 && files > policy.files
+		tooManyBytes := policy.bytes > 0 && bytes > policy.bytes
+		if !tooManyFiles && !tooManyBytes {
+			break
+		}
+		if !entry.regular() || entry.isOpen() || entry.Pinned() {
+			continue
+		}
+		size := entry.dataSize()
+		if d.unlinkLocked(entry) {
+			files--
+			bytes -= size
+			rotated = append(rotated, entry)
+		}
+	}
+	d.mutex.Unlock()
+
+	for _, entry := range rotated {
+		// rotation happens while serving a request for the directory, invalidate asynchronously
+		go d.fs.invalidateEntry(d, entry.Meta.Name())
+		d.removed(entry, RemovedRotated)
+	}
+}
+
+// dataSize returns the length of the file data
+func (e *FileEntry) dataSize() int64 {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return int64(e.Meta.size)
+}
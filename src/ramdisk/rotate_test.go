@@ -0,0 +1,75 @@
+package ramdisk
+
+import (
+	"testing"
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs/fstestutil"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"syscall"
+	"time"
+)
+
+func TestRotateFiles(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{KeepFiles: 2})
+	first := addTestFile(filesys, "s1.jpg", 1, time.Now())
+	addTestFile(filesys, "s2.jpg", 1, time.Now())
+	open := addTestFile(filesys, "s3.jpg", 1, time.Now())
+	open.opened()
+
+	filesys.rotate()
+
+	if _, found := filesys.root.findEntryByName("s1.jpg"); found {
+		t.Fatal("oldest file not rotated")
+	}
+	if _, found := filesys.root.findEntryByName("s2.jpg"); !found {
+		t.Fatal("newer file rotated")
+	}
+	if !first.unlinked {
+		t.Fatal("rotated file not unlinked")
+	}
+}
+
+func TestRotateBytes(t *testing.T) {
+	filesys := CreateRamFS()
+	ctx := context.Background()
+	dir := filesys.root
+
+	if err := dir.Setxattr(ctx, &fuse.SetxattrRequest{Name: XattrKeepBytes, Xattr: []byte("ten")}); err != fuse.Errno(syscall.EINVAL) {
+		t.Fatalf("expected EINVAL for malformed limit, got %v", err)
+	}
+	dir.Setxattr(ctx, &fuse.SetxattrRequest{Name: XattrKeepBytes, Xattr: []byte("10")})
+
+	addTestFile(filesys, "s4.jpg", 4, time.Now())
+	addTestFile(filesys, "s5.jpg", 4, time.Now())
+	addTestFile(filesys, "s6.jpg", 4, time.Now())
+	filesys.rotate()
+
+	if _, found := filesys.root.findEntryByName("s4.jpg"); found {
+		t.Fatal("oldest file not rotated")
+	}
+	if metrics := filesys.Metrics(); metrics.Files != 2 || metrics.BytesStored != 8 {
+		t.Fatalf("wrong files/bytes after rotation: %d/%d", metrics.Files, metrics.BytesStored)
+	}
+}
+
+func TestRotateMounted(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{KeepFiles: 3})
+	mnt, mntErr := fstestutil.MountedT(t, filesys, nil)
+	if mntErr != nil {
+		t.Fatal("mount failed")
+	}
+	defer mnt.Close()
+	filesys.SetServer(mnt.Server)
+
+	for _, name := range []string{"001.jpg", "002.jpg", "003.jpg", "004.jpg", "005.jpg"} {
+		if err := ioutil.WriteFile(mnt.Dir+"/"+name, []byte("frame"), 0644); err != nil {
+			t.Fatalf("write of %s failed: %v", name, err)
+		}
+	}
+
+	infos, _ := ioutil.ReadDir(mnt.Dir)
+	if len(infos) != 3 || infos[0].Name() != "003.jpg" {
+		t.Fatalf("wrong files kept: %v", infos)
+	}
+}
@@ -0,0 +1,510 @@
+package ramdisk
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"bytes"
+	"compress/flate"
+	"errors"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// SnapshotsDirName is the directory in the root exposing snapshots read-only, with Options.SnapshotsDir
+const SnapshotsDirName = ".snapshots"
+
+// RemovedRolledBack is the reason of removals by Rollback, for files created after the snapshot
+const RemovedRolledBack = "rolled back"
+
+// ErrUnknownSnapshot is returned for snapshot IDs never taken or already dropped
+var ErrUnknownSnapshot = errors.New("unknown snapshot")
+
+// SnapshotID identifies a snapshot of the RAM disk
+type SnapshotID uint64
+
+// snapshot is the state of all files at one point in time
+type snapshot struct {
+	id     SnapshotID
+	taken  time.Time
+	files  []*fileState
+	perm   permissions       // of the root directory
+	xattrs map[string][]byte // of the root directory
+}
+
+// fileState is a file as captured by a snapshot. its data is shared with the file until either changes.
+// With encryption, the data of open files is captured as a sealed copy
+type fileState struct {
+	inode     uint64
+	name      string
+	size      uint64
+	created   time.Time
+	accessed  time.Time
+	modified  time.Time
+	changed   time.Time
+	perm      permissions
+	fileType  os.FileMode
+	rdev      uint32
+	xattrs    map[string][]byte
+	pinned    bool
+	ringSize  int64
+	discarded int64
+
+	// the data, held in one of these forms
+	lower      string // path in the lower layer of an overlay, the data is read from there if inLower
+	inLower    bool
+	blob       *sharedData
+	compressed []byte
+	sealed     [][]byte
+}
+
+// snapshotTable holds the snapshots of a ramdiskFS
+type snapshotTable struct {
+	mutex     sync.Mutex
+	last      SnapshotID
+	snapshots map[SnapshotID]*snapshot
+	dir       *snapshotsDir // node of SnapshotsDirName, for cache invalidation
+}
+
+// Snapshot records the state of all files. File data is not copied, but shared until changed
+func (f *ramdiskFS) Snapshot() SnapshotID {
+	s := f.capture()
+
+	t := &f.snapshots
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.snapshots == nil {
+		t.snapshots = make(map[SnapshotID]*snapshot)
+	}
+	t.last++
+	s.id = t.last
+	t.snapshots[s.id] = s
+	return s.id
+}
+
+// Snapshots returns the IDs of all snapshots, oldest first
+func (f *ramdiskFS) Snapshots() []SnapshotID {
+	t := &f.snapshots
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	ids := make([]SnapshotID, 0, len(t.snapshots))
+	for id := range t.snapshots {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// DropSnapshot discards a snapshot, data no longer used by files or other snapshots is freed
+func (f *ramdiskFS) DropSnapshot(id SnapshotID) error {
+	t := &f.snapshots
+	t.mutex.Lock()
+	s, found := t.snapshots[id]
+	delete(t.snapshots, id)
+	dir := t.dir
+	t.mutex.Unlock()
+	if !found {
+		return ErrUnknownSnapshot
+	}
+
+	f.release(s)
+	if dir != nil {
+		f.invalidateEntry(dir, id.String())
+	}
+	return nil
+}
+
+// Rollback restores all files to their state in a snapshot. Files created since are removed,
+// removed files are created again. The snapshot is kept, to roll back again
+func (f *ramdiskFS) Rollback(id SnapshotID) error {
+	s := f.snapshot(id)
+	if s == nil {
+		return ErrUnknownSnapshot
+	}
+
+	states := make(map[uint64]*fileState, len(s.files))
+	for _, state := range s.files {
+		states[state.inode] = state
+	}
+
+	d := f.root
+	var removed, restored, recreated []*FileEntry
+	d.mutex.Lock()
+	d.perm = s.perm
+	d.changed = time.Now()
+	for _, entry := range append([]*FileEntry{}, d.entries...) {
+		if entry.virtual != nil {
+			continue
+		}
+		if _, found := states[entry.Meta.inode]; !found && d.unlinkLocked(entry) {
+			removed = append(removed, entry)
+		}
+	}
+	renamed := make(map[*FileEntry]string)
+	for _, state := range s.files {
+		entry, found := d.findEntryByInodeLocked(state.inode)
+		if !found {
+			continue
+		}
+		entry.restore(state)
+		restored = append(restored, entry)
+		if name := entry.dirEntry.Name; name != state.name {
+			if other, conflict := d.findEntryLocked(state.name); conflict && other.virtual != nil {
+				// a virtual file took the name, the file keeps the new one
+				continue
+			}
+			d.whiteout(entry)
+			d.renameLocked(entry, state.name)
+			renamed[entry] = name
+		}
+	}
+	// files are recreated once all files kept have their names back
+	for _, state := range s.files {
+		if _, found := d.findEntryByInodeLocked(state.inode); found {
+			continue
+		}
+		if _, conflict := d.findEntryLocked(state.name); conflict {
+			// a virtual file took the name
+			continue
+		}
+		entry := createFileEntry(state.name, f, state.perm)
+		entry.lower = state.lower
+		entry.Meta.inode = state.inode
+		entry.dirEntry.Inode = state.inode
+		entry.setType(state.fileType, state.rdev)
+		entry.restore(state)
+		d.linkLocked(entry)
+		recreated = append(recreated, entry)
+	}
+	d.mutex.Unlock()
+	d.xattrs.replace(s.xattrs)
+
+	for _, entry := range removed {
+		d.removed(entry, RemovedRolledBack)
+		f.invalidateEntry(d, entry.Meta.Name())
+	}
+	for entry, name := range renamed {
+		f.invalidateEntry(d, name)
+		f.invalidateEntry(d, entry.Meta.Name())
+		f.backendEvents.FileRenamed <- EventFileRenamed{FSEvent{File: entry}, name}
+	}
+	for _, entry := range restored {
+		f.invalidate(entry)
+		f.backendEvents.FileWritten <- EventFileWritten{FSEvent{File: entry}}
+	}
+	for _, entry := range recreated {
+		f.metrics.addFiles(1)
+		f.backendEvents.FileCreated <- EventFileCreated{FSEvent{File: entry}}
+	}
+	f.evictIfNeeded()
+	return nil
+}
+
+// capture records the state of all files, without registering a snapshot
+func (f *ramdiskFS) capture() *snapshot {
+	s := &snapshot{taken: time.Now()}
+
+	d := f.root
+	d.mutex.RLock()
+	s.perm = d.perm
+	for _, entry := range d.entries {
+		if entry.virtual == nil {
+			s.files = append(s.files, entry.capture())
+		}
+	}
+	d.mutex.RUnlock()
+	s.xattrs = d.xattrs.copy()
+	return s
+}
+
+// release gives up the data shared by a snapshot
+func (f *ramdiskFS) release(s *snapshot) {
+	for _, state := range s.files {
+		if state.blob != nil {
+			f.dedup.drop(state.blob)
+		}
+	}
+}
+
+func (f *ramdiskFS) snapshot(id SnapshotID) *snapshot {
+	t := &f.snapshots
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.snapshots[id]
+}
+
+func (id SnapshotID) String() string {
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+// findEntryByInodeLocked looks up a file of the directory by inode, caller must hold the mutex
+func (d *Dir) findEntryByInodeLocked(inode uint64) (*FileEntry, bool) {
+	for _, entry := range d.entries {
+		if entry.Meta.inode == inode {
+			return entry, true
+		}
+	}
+	return nil, false
+}
+
+// capture records the state of the file, sharing its data
+func (e *FileEntry) capture() *fileState {
+	e.mutex.Lock()
+	state := &fileState{
+		inode:     e.Meta.inode,
+		size:      e.Meta.size,
+		pinned:    e.pinned,
+		ringSize:  e.ringSize,
+		discarded: e.discarded,
+		lower:     e.lower,
+	}
+	switch {
+	case e.isInLower():
+		state.inLower = true
+	case e.sealed != nil:
+		state.sealed = e.sealed
+	case e.compressed != nil:
+		state.compressed = e.compressed
+	default:
+		if e.fs.encryption.enabled {
+			// the file is open, its plaintext must not outlive it
+			state.sealed = e.fs.encryption.sealData(e.Meta.inode, e.Data)
+		}
+		if state.sealed == nil {
+			state.blob = e.fs.dedup.hold(e)
+		}
+	}
+	e.mutex.Unlock()
+
+	m := &e.Meta
+	m.mutex.RLock()
+	state.name = m.name
+	state.created = m.created
+	state.accessed = m.accessed
+	state.modified = m.modified
+	state.changed = m.changed
+	state.perm = m.perm
+	state.fileType = m.fileType
+	state.rdev = m.rdev
+	m.mutex.RUnlock()
+	state.xattrs = m.xattrs.copy()
+	return state
+}
+
+// restore sets the file to a state captured before
+func (e *FileEntry) restore(state *fileState) {
+	e.mutex.Lock()
+	if !e.released {
+		e.fs.metrics.addBytes(-int64(e.Meta.size))
+		e.fs.metrics.addPhysicalBytes(-e.physicalSize())
+	}
+	e.fs.dedup.unshare(e, false)
+	e.Data = nil
+	e.compressed = nil
+	e.sealed = nil
+	e.released = state.inLower
+	inLower := int32(0)
+	if state.inLower {
+		inLower = 1
+	}
+	atomic.StoreInt32(&e.inLower, inLower)
+	switch {
+	case state.inLower:
+	case state.sealed != nil:
+		e.sealed = state.sealed
+	case state.compressed != nil:
+		e.compressed = state.compressed
+	default:
+		e.fs.dedup.join(e, state.blob)
+	}
+	e.Meta.size = state.size
+	if !e.released {
+		e.fs.metrics.addBytes(int64(e.Meta.size))
+		e.fs.metrics.addPhysicalBytes(e.physicalSize())
+	}
+	e.pinned = state.pinned
+	e.ringSize = state.ringSize
+	e.discarded = state.discarded
+	e.incompressible = false
+	e.uncommitted = false
+	e.sealIfClosed()
+	e.mutex.Unlock()
+
+	m := &e.Meta
+	m.mutex.Lock()
+	m.created = state.created
+	m.accessed = state.accessed
+	m.modified = state.modified
+	m.changed = state.changed
+	m.perm = state.perm
+	m.rdev = state.rdev
+	m.mutex.Unlock()
+	m.xattrs.replace(state.xattrs)
+}
+
+// bytes returns the plaintext data of the file state
+func (state *fileState) bytes(f *ramdiskFS) ([]byte, error) {
+	switch {
+	case state.inLower:
+		return ioutil.ReadFile(state.lower)
+	case state.sealed != nil:
+		return f.encryption.openData(state.inode, state.sealed, state.size)
+	case state.compressed != nil:
+		return ioutil.ReadAll(flate.NewReader(bytes.NewReader(state.compressed)))
+	}
+	return state.blob.data, nil
+}
+
+// hold makes a snapshot share the data of entry, caller must hold entry.mutex
+func (t *dedupTable) hold(entry *FileEntry) *sharedData {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	blob := entry.shared
+	if blob == nil {
+		blob = &sharedData{data: entry.Data, refs: 1}
+		entry.shared = blob
+	}
+	blob.snapshots++
+	return blob
+}
+
+// drop releases the share of a dropped snapshot
+func (t *dedupTable) drop(blob *sharedData) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	blob.snapshots--
+	if blob.refs == 0 && blob.snapshots == 0 && t.blobs[blob.hash] == blob {
+		delete(t.blobs, blob.hash)
+	}
+}
+
+// join makes entry use the data of a snapshot, caller must hold entry.mutex
+func (t *dedupTable) join(entry *FileEntry, blob *sharedData) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if blob.refs > 0 {
+		atomic.AddInt64(&entry.fs.metrics.bytesDeduplicated, int64(len(blob.data)))
+	}
+	blob.refs++
+	entry.shared = blob
+	entry.Data = blob.data
+}
+
+// snapshotsDir lists the snapshots as directories, implements fs.Node, fs.NodeStringLookuper, fs.HandleReadDirAller
+type snapshotsDir struct {
+	fs *ramdiskFS
+}
+
+func (f *ramdiskFS) snapshotsDir() *snapshotsDir {
+	t := &f.snapshots
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.dir == nil {
+		t.dir = &snapshotsDir{fs: f}
+	}
+	return t.dir
+}
+
+func (sd *snapshotsDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0555
+	return nil
+}
+
+func (sd *snapshotsDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	id, err := strconv.ParseUint(name, 10, 64)
+	if err != nil {
+		return nil, fuse.ENOENT
+	}
+	s := sd.fs.snapshot(SnapshotID(id))
+	if s == nil {
+		return nil, fuse.ENOENT
+	}
+	return &snapshotDir{fs: sd.fs, snapshot: s}, nil
+}
+
+func (sd *snapshotsDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	ids := sd.fs.Snapshots()
+	entries := make([]fuse.Dirent, 0, len(ids))
+	for _, id := range ids {
+		entries = append(entries, fuse.Dirent{Name: id.String(), Type: fuse.DT_Dir})
+	}
+	return entries, nil
+}
+
+// snapshotDir holds the files of a snapshot, read-only. implements fs.Node, fs.NodeStringLookuper, fs.HandleReadDirAller
+type snapshotDir struct {
+	fs       *ramdiskFS
+	snapshot *snapshot
+}
+
+func (sd *snapshotDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0555
+	a.Atime = sd.snapshot.taken
+	a.Mtime = sd.snapshot.taken
+	a.Ctime = sd.snapshot.taken
+	return nil
+}
+
+func (sd *snapshotDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	for _, state := range sd.snapshot.files {
+		if state.name == name {
+			return &snapshotFile{fs: sd.fs, state: state}, nil
+		}
+	}
+	return nil, fuse.ENOENT
+}
+
+func (sd *snapshotDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	entries := make([]fuse.Dirent, 0, len(sd.snapshot.files))
+	for _, state := range sd.snapshot.files {
+		entries = append(entries, fuse.Dirent{Name: state.name, Type: direntType(state.fileType)})
+	}
+	return entries, nil
+}
+
+// snapshotFile is a file in a snapshot, read-only. implements fs.Node, fs.NodeOpener, fs.HandleReadAller
+type snapshotFile struct {
+	fs    *ramdiskFS
+	state *fileState
+}
+
+func (sf *snapshotFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	state := sf.state
+	a.Mode = state.fileType | state.perm.mode&^0222
+	a.Uid = state.perm.uid
+	a.Gid = state.perm.gid
+	a.Atime = state.accessed
+	a.Mtime = state.modified
+	a.Ctime = state.changed
+	a.Size = state.size
+	a.Rdev = state.rdev
+	return nil
+}
+
+func (sf *snapshotFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.Errno(syscall.EROFS)
+	}
+	if sf.fs.enforcePermissions() && !sf.state.perm.permits(req.Header, accessRead) {
+		return nil, fuse.Errno(syscall.EACCES)
+	}
+	return sf, nil
+}
+
+func (sf *snapshotFile) ReadAll(ctx context.Context) ([]byte, error) {
+	data, err := sf.state.bytes(sf.fs)
+	if err != nil {
+		return nil, fuse.Errno(syscall.EIO)
+	}
+	return data, nil
+}
@@ -0,0 +1,162 @@
+package ramdisk
+
+import (
+	"testing"
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs/fstestutil"
+	"bytes"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"time"
+)
+
+func TestSnapshotEncrypted(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{EncryptionKey: bytes.Repeat([]byte{7}, 32)})
+	entry := addTestFile(filesys, "k4.txt", 0, time.Now())
+	entry.Chmod(0600)
+	entry.opened()
+	entry.write([]byte("secret"), 0, false)
+
+	id := filesys.Snapshot()
+	state := filesys.snapshot(id).files[0]
+	if state.blob != nil || state.sealed == nil {
+		t.Fatal("plaintext of open file held by snapshot")
+	}
+	if data, err := state.bytes(filesys); err != nil || string(data) != "secret" {
+		t.Fatalf("wrong data of snapshot %q: %v", data, err)
+	}
+
+	file := &snapshotFile{fs: filesys, state: state}
+	req := &fuse.OpenRequest{Header: fuse.Header{Uid: 54321, Gid: 54321}}
+	if _, err := file.Open(context.Background(), req, &fuse.OpenResponse{}); err != fuse.Errno(syscall.EACCES) {
+		t.Fatalf("other user opened snapshot of private file: %v", err)
+	}
+}
+
+func TestSnapshotRootDir(t *testing.T) {
+	filesys := CreateRamFS()
+	d := filesys.root
+	d.xattrs.set("user.step", []byte("1"), 0)
+	id := filesys.Snapshot()
+
+	d.xattrs.set("user.step", []byte("2"), 0)
+	d.perm.mode = 0700
+	filesys.Rollback(id)
+	if step, _ := d.xattrs.get("user.step"); string(step) != "1" || d.perm.mode != 0755 {
+		t.Fatalf("root directory not rolled back: %q %o", step, d.perm.mode)
+	}
+}
+
+func TestSnapshotRollback(t *testing.T) {
+	filesys := CreateRamFS()
+	kept := addTestFile(filesys, "k1.txt", 0, time.Now())
+	kept.write([]byte("before"), 0, false)
+	kept.SetXattr("user.step", []byte("1"))
+	removed := addTestFile(filesys, "k2.txt", 0, time.Now())
+	removed.write([]byte("removed later"), 0, false)
+
+	id := filesys.Snapshot()
+	if metrics := filesys.Metrics(); metrics.BytesPhysical != metrics.BytesStored {
+		t.Fatalf("snapshot changed physical bytes %d/%d", metrics.BytesStored, metrics.BytesPhysical)
+	}
+
+	// data is copied on write only
+	kept.WriteAt([]byte("AFTER!"), 0)
+	kept.SetXattr("user.step", []byte("2"))
+	filesys.root.removeEntry(removed, RemovedUnlinked)
+	created := addTestFile(filesys, "k3.txt", 0, time.Now())
+	created.write([]byte("created later"), 0, false)
+
+	if err := filesys.Rollback(id); err != nil {
+		t.Fatalf("rollback failed: %v", err)
+	}
+	if !bytes.Equal(kept.Bytes(), []byte("before")) {
+		t.Fatalf("data not rolled back: %q", kept.Bytes())
+	}
+	if step, _ := kept.Xattr("user.step"); string(step) != "1" {
+		t.Fatalf("xattr not rolled back: %q", step)
+	}
+	if _, found := filesys.root.findEntryByName("k3.txt"); found {
+		t.Fatal("file created after snapshot not removed")
+	}
+	restored, found := filesys.root.findEntryByName("k2.txt")
+	if !found || restored.Meta.inode != removed.Meta.inode || !bytes.Equal(restored.Bytes(), []byte("removed later")) {
+		t.Fatal("removed file not restored")
+	}
+	metrics := filesys.Metrics()
+	if metrics.Files != 2 || metrics.BytesStored != 19 || metrics.BytesPhysical != 19 {
+		t.Fatalf("wrong files/logical/physical bytes %d/%d/%d", metrics.Files, metrics.BytesStored, metrics.BytesPhysical)
+	}
+
+	// rolled back files share data with the snapshot, and still copy on write
+	restored.WriteAt([]byte("R"), 0)
+	if err := filesys.Rollback(id); err != nil || !bytes.Equal(restored.Bytes(), []byte("removed later")) {
+		t.Fatalf("second rollback failed: %v", err)
+	}
+
+	if err := filesys.DropSnapshot(id); err != nil {
+		t.Fatalf("drop failed: %v", err)
+	}
+	if err := filesys.Rollback(id); err != ErrUnknownSnapshot {
+		t.Fatalf("rollback to dropped snapshot: %v", err)
+	}
+	if len(filesys.Snapshots()) != 0 {
+		t.Fatal("dropped snapshot listed")
+	}
+}
+
+func TestSnapshotRollbackRename(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{})
+	filesys.WriteFile("s7", []byte("seven"), 0644)
+	filesys.WriteFile("s8", []byte("eight"), 0644)
+	id := filesys.Snapshot()
+
+	// swap the names
+	filesys.RenameFile("s7", "s9")
+	filesys.RenameFile("s8", "s7")
+	filesys.RenameFile("s9", "s8")
+	if err := filesys.Rollback(id); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range map[string]string{"s7": "seven", "s8": "eight"} {
+		entry, found := filesys.File(name)
+		if !found || entry.Meta.Name() != name || string(entry.Bytes()) != content {
+			t.Fatalf("%s not restored", name)
+		}
+	}
+	if len(filesys.Files()) != 2 {
+		t.Fatalf("wrong files after rollback %d", len(filesys.Files()))
+	}
+}
+
+func TestSnapshotsDir(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{SnapshotsDir: true})
+	mnt, mntErr := fstestutil.MountedT(t, filesys, nil)
+	if mntErr != nil {
+		t.Fatal("mount failed")
+	}
+	defer mnt.Close()
+
+	ioutil.WriteFile(mnt.Dir+"/"+"k4.txt", []byte("version 1"), 0644)
+	id := filesys.Snapshot()
+	ioutil.WriteFile(mnt.Dir+"/"+"k4.txt", []byte("version 2"), 0644)
+
+	path := mnt.Dir + "/" + SnapshotsDirName + "/" + id.String() + "/" + "k4.txt"
+	byts, err := ioutil.ReadFile(path)
+	if err != nil || string(byts) != "version 1" {
+		t.Fatalf("wrong snapshot content %q: %v", byts, err)
+	}
+	if err := ioutil.WriteFile(path, []byte("changed"), 0644); err == nil {
+		t.Fatal("snapshot writable")
+	}
+	names, _ := ioutil.ReadDir(mnt.Dir + "/" + SnapshotsDirName)
+	if len(names) != 1 || names[0].Name() != id.String() {
+		t.Fatalf("wrong snapshot dirs %v", names)
+	}
+	if _, err := os.Stat(mnt.Dir + "/" + SnapshotsDirName + "/99"); !os.IsNotExist(err) {
+		t.Fatalf("unknown snapshot exists: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package ramdisk
+
+import (
+	"bazil.org/fuse"
+	"time"
+)
+
+// AtimeMode selects when the access time of a file is updated
+type AtimeMode int
+
+const (
+	// AtimeRelative updates atime on read only if it is older than mtime or ctime,
+	// or older than a day (like the Linux relatime mount option). This is the default.
+	AtimeRelative AtimeMode = iota
+	// AtimeStrict updates atime on every read (strictatime).
+	AtimeStrict
+	// AtimeNever does not update atime on read (noatime).
+	AtimeNever
+)
+
+// relatimeInterval is the maximum age of atime in AtimeRelative mode
+const relatimeInterval = 24 * time.Hour
+
+// needsAtimeUpdate decides if a read access at now updates atime, following mode
+func needsAtimeUpdate(mode AtimeMode, accessed, modified, changed, now time.Time) bool {
+	switch mode {
+	case AtimeStrict:
+		return true
+	case AtimeNever:
+		return false
+	default:
+		return !accessed.After(modified) ||
+			!accessed.After(changed) ||
+			now.Sub(accessed) >= relatimeInterval
+	}
+}
+
+// touchAccessed records a read access
+func (f *RamFile) touchAccessed(mode AtimeMode) {
+	now := time.Now()
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if needsAtimeUpdate(mode, f.accessed, f.modified, f.changed, now) {
+		f.accessed = now
+	}
+}
+
+// touchModified records a change of content
+func (f *RamFile) touchModified() {
+	now := time.Now()
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.modified = now
+	f.changed = now
+}
+
+// touchChanged records a change of metadata
+func (f *RamFile) touchChanged() {
+	now := time.Now()
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.changed = now
+}
+
+// touchChanged records a change of the directory's metadata
+func (d *Dir) touchChanged() {
+	now := time.Now()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.changed = now
+}
+
+// checkSetTimes verifies the caller of a utimes-style request may set atime and mtime.
+// Setting to the current time is allowed to writers, setting explicit times only to the owner.
+func checkSetTimes(perm permissions, req *fuse.SetattrRequest) error {
+	if !req.Valid.Atime() && !req.Valid.Mtime() {
+		return nil
+	}
+	if req.Header.Uid == 0 || req.Header.Uid == perm.uid {
+		return nil
+	}
+	explicit := (req.Valid.Atime() && !req.Valid.AtimeNow()) || (req.Valid.Mtime() && !req.Valid.MtimeNow())
+	if explicit || !perm.permits(req.Header, accessWrite) {
+		return fuse.EPERM
+	}
+	return nil
+}
+
+// setTimes applies atime and mtime of a utimes-style request
+func setTimes(req *fuse.SetattrRequest, now time.Time, accessed, modified *time.Time) {
+	if req.Valid.AtimeNow() {
+		*accessed = now
+	} else if req.Valid.Atime() {
+		*accessed = req.Atime
+	}
+	if req.Valid.MtimeNow() {
+		*modified = now
+	} else if req.Valid.Mtime() {
+		*modified = req.Mtime
+	}
+}
+
+// Created returns the birth time of the file
+func (f *RamFile) Created() time.Time {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.created
+}
+
+// Accessed returns the time of last access (atime)
+func (f *RamFile) Accessed() time.Time {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.accessed
+}
+
+// Modified returns the time of last change of content (mtime)
+func (f *RamFile) Modified() time.Time {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.modified
+}
+
+// Changed returns the time of last change of content or metadata (ctime)
+func (f *RamFile) Changed() time.Time {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.changed
+}
@@ -0,0 +1,87 @@
+package ramdisk
+
+import (
+	"testing"
+	"bazil.org/fuse/fs/fstestutil"
+	"os"
+	"syscall"
+	"time"
+)
+
+func TestAtimeModes(t *testing.T) {
+	now := time.Now()
+	hourAgo := now.Add(-time.Hour)
+	twoHoursAgo := now.Add(-2 * time.Hour)
+	twoDaysAgo := now.Add(-48 * time.Hour)
+
+	if !needsAtimeUpdate(AtimeStrict, hourAgo, twoHoursAgo, twoHoursAgo, now) {
+		t.Fatal("strictatime must always update")
+	}
+	if needsAtimeUpdate(AtimeNever, twoHoursAgo, hourAgo, hourAgo, now) {
+		t.Fatal("noatime must never update")
+	}
+	if needsAtimeUpdate(AtimeRelative, hourAgo, twoHoursAgo, twoHoursAgo, now) {
+		t.Fatal("relatime must not update recent atime newer than mtime")
+	}
+	if !needsAtimeUpdate(AtimeRelative, twoHoursAgo, hourAgo, twoHoursAgo, now) {
+		t.Fatal("relatime must update atime older than mtime")
+	}
+	if !needsAtimeUpdate(AtimeRelative, twoDaysAgo.Add(time.Hour), twoDaysAgo, twoDaysAgo, now) {
+		t.Fatal("relatime must update atime older than a day")
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{Atime: AtimeStrict})
+	mnt, mntErr := fstestutil.MountedT(t, filesys, nil)
+	if mntErr != nil {
+		t.Fatal("mount failed")
+	}
+	defer mnt.Close()
+
+	path := mnt.Dir + "/" + "t1.txt"
+	writer, createErr := os.Create(path)
+	if createErr != nil {
+		t.Fatal("create failed")
+	}
+	writer.WriteString("test")
+	writer.Close()
+
+	entry, _ := filesys.root.findEntryByName("t1.txt")
+	if entry.Meta.Created().IsZero() {
+		t.Fatal("creation time not set")
+	}
+	if entry.Meta.Modified().Before(entry.Meta.Created()) {
+		t.Fatal("mtime not updated on write")
+	}
+
+	changedBefore := entry.Meta.Changed()
+	time.Sleep(10 * time.Millisecond)
+	os.Chmod(path, 0600)
+	if !entry.Meta.Changed().After(changedBefore) {
+		t.Fatal("ctime not updated on chmod")
+	}
+
+	past := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	if err := os.Chtimes(path, past, past); err != nil {
+		t.Fatalf("chtimes failed: %v", err)
+	}
+	fileInfo, _ := os.Stat(path)
+	if !fileInfo.ModTime().Equal(past) {
+		t.Fatalf("mtime not set: %v", fileInfo.ModTime())
+	}
+	stat := fileInfo.Sys().(*syscall.Stat_t)
+	if stat.Atim.Sec != past.Unix() {
+		t.Fatalf("atime not set: %v", stat.Atim)
+	}
+	if !entry.Meta.Created().After(past) {
+		t.Fatal("creation time changed by chtimes")
+	}
+
+	reader, _ := os.Open(path)
+	reader.Read(make([]byte, 4))
+	reader.Close()
+	if !entry.Meta.Accessed().After(past) {
+		t.Fatal("atime not updated on read")
+	}
+}
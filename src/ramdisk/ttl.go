@@ -0,0 +1,128 @@
+package ramdisk
+
+import (
+	"bazil.org/fuse"
+	"syscall"
+	"time"
+)
+
+// TTLBase selects the timestamp the TTL of a file counts from
+type TTLBase int
+
+const (
+	// TTLModified counts from the last change of content (mtime). This is the default.
+	TTLModified TTLBase = iota
+	// TTLAccessed counts from the last read (atime), which depends on Options.Atime.
+	TTLAccessed
+)
+
+// Extended attributes of directories, overriding the TTL options for files in the directory
+const (
+	XattrTTL     = "user.ramdisk.ttl"      // a duration like "30s" (see time.ParseDuration), "0" disables expiry
+	XattrTTLBase = "user.ramdisk.ttl_base" // "mtime" or "atime"
+)
+
+// defaultReapInterval is used if Options.ReapInterval is zero
+const defaultReapInterval = time.Second
+
+// ttlPolicy decides when files expire
+type ttlPolicy struct {
+	ttl  time.Duration // no expiry if zero
+	base TTLBase
+}
+
+// expired tells if the file is older than the TTL at now
+func (p ttlPolicy) expired(f *RamFile, now time.Time) bool {
+	if p.ttl <= 0 {
+		return false
+	}
+	since := f.Modified()
+	if p.base == TTLAccessed {
+		since = f.Accessed()
+	}
+	return now.Sub(since) >= p.ttl
+}
+
+func parseTTL(value []byte) (time.Duration, error) {
+	ttl, err := time.ParseDuration(string(value))
+	if err != nil || ttl < 0 {
+		return 0, fuse.Errno(syscall.EINVAL)
+	}
+	return ttl, nil
+}
+
+func parseTTLBase(value []byte) (TTLBase, error) {
+	switch string(value) {
+	case "mtime":
+		return TTLModified, nil
+	case "atime":
+		return TTLAccessed, nil
+	}
+	return 0, fuse.Errno(syscall.EINVAL)
+}
+
+// checkDirXattr rejects malformed values of the policy attributes of directories
+func checkDirXattr(name string, value []byte) (err error) {
+	switch name {
+	case XattrTTL:
+		_, err = parseTTL(value)
+	case XattrTTLBase:
+		_, err = parseTTLBase(value)
+	case XattrKeepFiles, XattrKeepBytes, XattrVersions, XattrVersionBytes:
+		_, err = parseKeep(value)
+	}
+	return
+}
+
+// ttlPolicy returns the policy for files in the directory, its attributes override the inherited policy
+func (d *Dir) ttlPolicy(inherited ttlPolicy) ttlPolicy {
+	policy := inherited
+	if value, err := d.xattrs.get(XattrTTL); err == nil {
+		policy.ttl, _ = parseTTL(value)
+	}
+	if value, err := d.xattrs.get(XattrTTLBase); err == nil {
+		policy.base, _ = parseTTLBase(value)
+	}
+	return policy
+}
+
+// reaper periodically removes expired files, deduplicates and compresses cold files
+func (f *ramdiskFS) reaper() {
+	// TODO go routine termination
+	interval := f.options.ReapInterval
+	if interval <= 0 {
+		interval = defaultReapInterval
+	}
+	ticker := time.NewTicker(interval)
+	for now := range ticker.C {
+		f.reap(now)
+		f.deduplicate()
+		f.compressCold(now)
+	}
+}
+
+func (f *ramdiskFS) reap(now time.Time) {
+	f.root.reap(now, ttlPolicy{ttl: f.options.TTL, base: f.options.TTLBase})
+}
+
+// reap removes the regular files of the directory expired at now, unless they are open
+func (d *Dir) reap(now time.Time, inherited ttlPolicy) {
+	policy := d.ttlPolicy(inherited)
+	if policy.ttl <= 0 {
+		return
+	}
+
+	expired := make([]*FileEntry, 0)
+	d.mutex.Lock()
+	for _, entry := range append([]*FileEntry{}, d.entries...) {
+		if entry.regular() && policy.expired(&entry.Meta, now) && !entry.isOpen() && d.unlinkLocked(entry) {
+			expired = append(expired, entry)
+		}
+	}
+	d.mutex.Unlock()
+
+	for _, entry := range expired {
+		d.fs.invalidateEntry(d, entry.Meta.Name())
+		d.removed(entry, RemovedExpired)
+	}
+}
@@ -0,0 +1,78 @@
+package ramdisk
+
+import (
+	"testing"
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"syscall"
+	"time"
+)
+
+func TestReap(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{TTL: time.Minute, ReapInterval: time.Hour})
+	listener := NewFSEvents()
+	listener.FileRemoved = make(chan EventFileRemoved)
+	filesys.AddListener(&listener)
+
+	old := createFileEntry("e1.txt", filesys, permissions{mode: 0644})
+	old.write([]byte("1234"), 0, false)
+	old.Meta.modified = time.Now().Add(-2 * time.Minute)
+	open := createFileEntry("e2.txt", filesys, permissions{mode: 0644})
+	open.Meta.modified = old.Meta.modified
+	open.opened()
+	recent := createFileEntry("e3.txt", filesys, permissions{mode: 0644})
+	filesys.root.entries = append(filesys.root.entries, old, open, recent)
+	filesys.metrics.addFiles(3)
+
+	filesys.reap(time.Now())
+
+	select {
+	case event := <-listener.FileRemoved:
+		if event.File != old || event.Reason != RemovedExpired {
+			t.Fatalf("wrong removal event %q/%q", event.File.Meta.Name(), event.Reason)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("missing FileRemoved")
+	}
+	if _, found := filesys.root.findEntryByName("e1.txt"); found {
+		t.Fatal("expired file not removed")
+	}
+	if _, found := filesys.root.findEntryByName("e2.txt"); !found {
+		t.Fatal("open file removed")
+	}
+	if _, found := filesys.root.findEntryByName("e3.txt"); !found {
+		t.Fatal("recent file removed")
+	}
+	if metrics := filesys.Metrics(); metrics.Files != 2 || metrics.BytesStored != 0 {
+		t.Fatalf("wrong files/bytes after removal: %d/%d", metrics.Files, metrics.BytesStored)
+	}
+}
+
+func TestDirTTL(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{TTL: time.Hour, ReapInterval: time.Hour})
+	dir := filesys.root
+	ctx := context.Background()
+
+	err := dir.Setxattr(ctx, &fuse.SetxattrRequest{Name: XattrTTL, Xattr: []byte("soon")})
+	if err != fuse.Errno(syscall.EINVAL) {
+		t.Fatalf("expected EINVAL for malformed TTL, got %v", err)
+	}
+	dir.Setxattr(ctx, &fuse.SetxattrRequest{Name: XattrTTL, Xattr: []byte("10s")})
+	dir.Setxattr(ctx, &fuse.SetxattrRequest{Name: XattrTTLBase, Xattr: []byte("atime")})
+
+	policy := dir.ttlPolicy(ttlPolicy{ttl: time.Hour})
+	if policy.ttl != 10*time.Second || policy.base != TTLAccessed {
+		t.Fatalf("directory attributes not applied: %+v", policy)
+	}
+
+	entry := createFileEntry("e4.txt", filesys, permissions{mode: 0644})
+	entry.Meta.accessed = time.Now().Add(-time.Minute)
+	if !policy.expired(&entry.Meta, time.Now()) {
+		t.Fatal("file not expired by atime")
+	}
+
+	dir.Setxattr(ctx, &fuse.SetxattrRequest{Name: XattrTTL, Xattr: []byte("0")})
+	if dir.ttlPolicy(ttlPolicy{ttl: time.Hour}).expired(&entry.Meta, time.Now()) {
+		t.Fatal("zero TTL did not disable expiry")
+	}
+}
@@ -0,0 +1,211 @@
+package ramdisk
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+	"regexp"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Extended attributes of directories, overriding Options.Versions and Options.VersionBytes for the directory
+const (
+	XattrVersions     = "user.ramdisk.versions"      // number of versions kept per file (decimal), "0" keeps none
+	XattrVersionBytes = "user.ramdisk.version_bytes" // bytes of versions kept per file (decimal), "0" means no limit
+)
+
+// Version is a committed content of a file, see FileEntry.Versions
+type Version struct {
+	Number    int       // counts the commits of the file, from 1
+	Committed time.Time // when the file was closed after writing
+	Size      int64
+
+	// the data, shared with the file, or encrypted with Options.EncryptionKey
+	blob       *sharedData
+	sealed     [][]byte
+	encryption *encryption
+	inode      uint64
+}
+
+// Bytes returns the content of the version, it must not be modified.
+// nil if the version is encrypted and the key was wiped
+func (v *Version) Bytes() []byte {
+	data, _ := v.bytes()
+	return data
+}
+
+func (v *Version) bytes() ([]byte, error) {
+	if v.blob == nil {
+		return v.encryption.openData(v.inode, v.sealed, uint64(v.Size))
+	}
+	return v.blob.data, nil
+}
+
+// drop releases the data of a discarded version
+func (v *Version) drop(f *ramdiskFS) {
+	if v.blob != nil {
+		f.dedup.drop(v.blob)
+	}
+}
+
+// versionPolicy limits the versions kept per file, zero count keeps none, zero bytes means no limit
+type versionPolicy struct {
+	count int64
+	bytes int64
+}
+
+// versionPolicy returns the policy for files in the directory, its attributes override the inherited policy
+func (d *Dir) versionPolicy(inherited versionPolicy) versionPolicy {
+	policy := inherited
+	if value, err := d.xattrs.get(XattrVersions); err == nil {
+		policy.count, _ = parseKeep(value)
+	}
+	if value, err := d.xattrs.get(XattrVersionBytes); err == nil {
+		policy.bytes, _ = parseKeep(value)
+	}
+	return policy
+}
+
+// addVersion records the content of a committed file, sharing its data until either changes.
+// With encryption, the version keeps the sealed data, or a sealed copy while the file is open
+func (e *FileEntry) addVersion() {
+	f := e.fs
+	policy := f.root.versionPolicy(versionPolicy{count: int64(f.options.Versions), bytes: f.options.VersionBytes})
+	if policy.count <= 0 || !e.regular() {
+		return
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.unlinked {
+		return
+	}
+	e.inflate()
+	e.commits++
+	version := &Version{
+		Number:     e.commits,
+		Committed:  time.Now(),
+		Size:       int64(e.Meta.size),
+		encryption: f.encryption,
+		inode:      e.Meta.inode,
+	}
+	if f.encryption.enabled {
+		version.sealed = e.sealed
+		if version.sealed == nil {
+			version.sealed = f.encryption.sealData(e.Meta.inode, e.Data)
+		}
+	}
+	if version.sealed == nil {
+		version.blob = f.dedup.hold(e)
+	}
+	e.versions = append(e.versions, version)
+
+	// drop the oldest versions beyond the policy
+	bytes := int64(0)
+	for _, version := range e.versions {
+		bytes += version.Size
+	}
+	for len(e.versions) > 0 && (int64(len(e.versions)) > policy.count || policy.bytes > 0 && bytes > policy.bytes) {
+		bytes -= e.versions[0].Size
+		e.versions[0].drop(f)
+		e.versions = e.versions[1:]
+	}
+}
+
+// dropVersions discards all versions, caller must hold the mutex
+func (e *FileEntry) dropVersions() {
+	for _, version := range e.versions {
+		version.drop(e.fs)
+	}
+	e.versions = nil
+}
+
+// Versions returns the committed contents of the file kept, oldest first.
+// The newest is the current content, unless the file was written to since
+func (e *FileEntry) Versions() []*Version {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return append([]*Version{}, e.versions...)
+}
+
+// Version returns the version numbered number, if still kept
+func (e *FileEntry) Version(number int) (*Version, bool) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	for _, version := range e.versions {
+		if version.Number == number {
+			return version, true
+		}
+	}
+	return nil, false
+}
+
+// versionName matches the hidden names of versions, like "name@v3"
+var versionName = regexp.MustCompile(`^(.+)@v([0-9]+)$`)
+
+// lookupVersion finds the version of a file named like "name@v3"
+func (d *Dir) lookupVersion(name string) (fs.Node, bool) {
+	match := versionName.FindStringSubmatch(name)
+	if match == nil {
+		return nil, false
+	}
+	entry, found := d.findEntryByName(match[1])
+	if !found {
+		return nil, false
+	}
+	number, err := strconv.Atoi(match[2])
+	if err != nil {
+		return nil, false
+	}
+	version, found := entry.Version(number)
+	if !found {
+		return nil, false
+	}
+	return &versionFile{entry: entry, version: version}, true
+}
+
+// versionFile is a version of a file, read-only. implements fs.Node, fs.NodeOpener, fs.HandleReadAller
+type versionFile struct {
+	entry   *FileEntry
+	version *Version
+}
+
+func (vf *versionFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	m := &vf.entry.Meta
+	m.mutex.RLock()
+	a.Mode = m.perm.mode &^ 0222
+	a.Uid = m.perm.uid
+	a.Gid = m.perm.gid
+	m.mutex.RUnlock()
+
+	a.Atime = vf.version.Committed
+	a.Mtime = vf.version.Committed
+	a.Ctime = vf.version.Committed
+	a.Size = uint64(vf.version.Size)
+	return nil
+}
+
+func (vf *versionFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.Errno(syscall.EROFS)
+	}
+	m := &vf.entry.Meta
+	m.mutex.RLock()
+	permitted := m.perm.permits(req.Header, accessRead)
+	m.mutex.RUnlock()
+	if vf.entry.fs.enforcePermissions() && !permitted {
+		return nil, fuse.Errno(syscall.EACCES)
+	}
+	return vf, nil
+}
+
+func (vf *versionFile) ReadAll(ctx context.Context) ([]byte, error) {
+	data, err := vf.version.bytes()
+	if err != nil {
+		return nil, fuse.Errno(syscall.EIO)
+	}
+	return data, nil
+}
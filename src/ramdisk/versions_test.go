@@ -0,0 +1,104 @@
+package ramdisk
+
+import (
+	"testing"
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs/fstestutil"
+	"bytes"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"syscall"
+	"time"
+)
+
+// commitTestWrite writes data like a handle, and closes the file
+func commitTestWrite(t *testing.T, entry *FileEntry, data string) {
+	entry.truncate(0)
+	entry.write([]byte(data), 0, false)
+	entry.written()
+	if err := entry.commit(); err != nil {
+		t.Fatalf("commit failed: %v", err)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{Versions: 2})
+	entry := addTestFile(filesys, "c1.conf", 0, time.Now())
+	for _, content := range []string{"first", "second", "third"} {
+		commitTestWrite(t, entry, content)
+	}
+
+	versions := entry.Versions()
+	if len(versions) != 2 || versions[0].Number != 2 || string(versions[0].Bytes()) != "second" || string(versions[1].Bytes()) != "third" {
+		t.Fatalf("wrong versions %v", versions)
+	}
+
+	// versions keep their data when the file is written to
+	entry.write([]byte("THIRD"), 0, false)
+	if string(versions[1].Bytes()) != "third" {
+		t.Fatalf("version changed: %q", versions[1].Bytes())
+	}
+	if err := entry.commit(); err != nil || len(entry.Versions()) != 2 {
+		t.Fatal("commit without writing recorded a version")
+	}
+
+	// directories limit bytes
+	filesys.root.xattrs.set(XattrVersionBytes, []byte("10"), 0)
+	commitTestWrite(t, entry, "fourth")
+	if versions := entry.Versions(); len(versions) != 1 || versions[0].Number != 4 {
+		t.Fatalf("byte limit not applied: %v", versions)
+	}
+
+	filesys.root.removeEntry(entry, RemovedUnlinked)
+	if len(entry.Versions()) != 0 {
+		t.Fatal("versions of removed file kept")
+	}
+}
+
+func TestVersionsEncrypted(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{Versions: 2, EncryptionKey: bytes.Repeat([]byte{7}, 32)})
+	entry := addTestFile(filesys, "c2.conf", 0, time.Now())
+	entry.Chmod(0600)
+	entry.opened()
+	commitTestWrite(t, entry, "secret")
+	entry.closed()
+
+	versions := entry.Versions()
+	if len(versions) != 1 || versions[0].blob != nil || string(versions[0].Bytes()) != "secret" {
+		t.Fatal("version not kept encrypted")
+	}
+	for _, chunk := range versions[0].sealed {
+		if bytes.Contains(chunk, []byte("secret")) {
+			t.Fatal("plaintext in sealed version")
+		}
+	}
+
+	node, _ := filesys.root.lookupVersion("c2.conf@v1")
+	req := &fuse.OpenRequest{Header: fuse.Header{Uid: 54321, Gid: 54321}}
+	if _, err := node.(*versionFile).Open(context.Background(), req, &fuse.OpenResponse{}); err != fuse.Errno(syscall.EACCES) {
+		t.Fatalf("other user opened version of private file: %v", err)
+	}
+}
+
+func TestVersionPath(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{Versions: 3})
+	mnt, mntErr := fstestutil.MountedT(t, filesys, nil)
+	if mntErr != nil {
+		t.Fatal("mount failed")
+	}
+	defer mnt.Close()
+
+	path := mnt.Dir + "/" + "c2.conf"
+	ioutil.WriteFile(path, []byte("v1"), 0644)
+	ioutil.WriteFile(path, []byte("v2"), 0644)
+
+	if byts, err := ioutil.ReadFile(path + "@v1"); err != nil || string(byts) != "v1" {
+		t.Fatalf("wrong version content %q: %v", byts, err)
+	}
+	if _, err := ioutil.ReadFile(path + "@v3"); err == nil {
+		t.Fatal("version not committed yet readable")
+	}
+	if err := ioutil.WriteFile(path+"@v1", []byte("changed"), 0644); err == nil {
+		t.Fatal("version writable")
+	}
+}
@@ -0,0 +1,173 @@
+package ramdisk
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"bazil.org/fuse/fuseutil"
+	"golang.org/x/net/context"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// VirtualFile describes a file whose content is produced by Go code, e.g. to expose live process state
+type VirtualFile struct {
+	// Mode holds the permission bits, 0444 if zero, or 0644 if Write is set.
+	Mode os.FileMode
+
+	// Read returns the content of the file. It is called on every open, readers see the content of their open.
+	// An error is logged and reported as EIO to the caller of open(2).
+	Read func() ([]byte, error)
+
+	// Write receives the content written to the file when it is flushed, usually on close.
+	// An error is logged and reported as EIO to the caller of close(2). The file is read-only if nil.
+	Write func(data []byte) error
+}
+
+// AddVirtualFile adds a file called name to the root directory, with content produced by file
+func (f *ramdiskFS) AddVirtualFile(name string, file VirtualFile) (*FileEntry, error) {
+	if name == "" || file.Read == nil {
+		return nil, fuse.Errno(syscall.EINVAL)
+	}
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+
+	mode := file.Mode.Perm()
+	if mode == 0 {
+		mode = 0444
+		if file.Write != nil {
+			mode = 0644
+		}
+	}
+	entry := createFileEntry(name, f, permissions{mode: mode, uid: uint32(os.Getuid()), gid: uint32(os.Getgid())})
+	entry.virtual = &file
+	entry.released = true // content is produced, not stored
+
+	d := f.root
+	d.mutex.Lock()
+	if _, alreadyExists := d.findEntryLocked(name); alreadyExists {
+		d.mutex.Unlock()
+		return nil, fuse.EEXIST
+	}
+	d.linkLocked(entry)
+	d.mutex.Unlock()
+
+	f.metrics.addFiles(1)
+	f.backendEvents.FileCreated <- EventFileCreated{FSEvent{File: entry}}
+	return entry, nil
+}
+
+// RemoveVirtualFile removes the virtual file called name from the root directory
+func (f *ramdiskFS) RemoveVirtualFile(name string) bool {
+	entry, found := f.root.findEntryByName(name)
+	if !found || entry.virtual == nil {
+		return false
+	}
+	return f.root.removeEntry(entry, RemovedUnlinked)
+}
+
+// IsVirtual tells if the content of the file is produced by Go code, see AddVirtualFile
+func (e *FileEntry) IsVirtual() bool {
+	return e.virtual != nil
+}
+
+// openVirtual produces the content of a virtual file for a new handle
+func (e *FileEntry) openVirtual(flags fuse.OpenFlags) (fs.Handle, error) {
+	if !flags.IsReadOnly() && e.virtual.Write == nil {
+		return nil, fuse.Errno(syscall.EACCES)
+	}
+
+	handle := &virtualHandle{entry: e, flags: flags}
+	if flags.IsReadOnly() || flags&fuse.OpenTruncate == 0 {
+		data, err := e.virtual.Read()
+		if err != nil {
+			log.Printf("virtual file %q failed to produce content: %v", e.Meta.Name(), err)
+			return nil, fuse.Errno(syscall.EIO)
+		}
+		handle.data = data
+	}
+
+	// stat reports the size of the content produced last
+	e.mutex.Lock()
+	e.setSize(uint64(len(handle.data)))
+	e.mutex.Unlock()
+
+	return handle, nil
+}
+
+// virtualMaxSize bounds the content written to a virtual file, which is held in memory until flushed
+const virtualMaxSize = 64 << 20
+
+// virtualHandle holds the content of a virtual file for one open, implements fs.HandleReader, fs.HandleWriter, fs.HandleFlusher
+type virtualHandle struct {
+	entry *FileEntry
+	flags fuse.OpenFlags
+	mutex sync.Mutex // guards data and dirty
+	data  []byte
+	dirty bool // written, but not passed to the write handler yet
+}
+
+// maxSize returns how much content may be written to the virtual file, at most the capacity of the RAM disk
+func (h *virtualHandle) maxSize() int64 {
+	if capacity := h.entry.fs.options.Capacity; capacity > 0 && capacity < virtualMaxSize {
+		return capacity
+	}
+	return virtualMaxSize
+}
+
+func (h *virtualHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	if h.flags.IsWriteOnly() {
+		return fuse.Errno(syscall.EBADF)
+	}
+
+	h.mutex.Lock()
+	fuseutil.HandleRead(req, resp, h.data)
+	h.mutex.Unlock()
+	return nil
+}
+
+func (h *virtualHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if h.flags.IsReadOnly() {
+		return fuse.Errno(syscall.EBADF)
+	}
+
+	if req.Offset < 0 {
+		return fuse.Errno(syscall.EINVAL)
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	offset := req.Offset
+	if h.flags&fuse.OpenAppend != 0 {
+		offset = int64(len(h.data))
+	}
+	if offset+int64(len(req.Data)) > h.maxSize() {
+		return fuse.Errno(syscall.EFBIG)
+	}
+	if end := int(offset) + len(req.Data); end > len(h.data) {
+		h.data = append(h.data, make([]byte, end-len(h.data))...)
+	}
+	copy(h.data[offset:], req.Data)
+	h.dirty = true
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (h *virtualHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if !h.dirty {
+		return nil
+	}
+	h.dirty = false
+	if err := h.entry.virtual.Write(append([]byte{}, h.data...)); err != nil {
+		log.Printf("virtual file %q failed to take written content: %v", h.entry.Meta.Name(), err)
+		return fuse.Errno(syscall.EIO)
+	}
+	return nil
+}
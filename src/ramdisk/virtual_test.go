@@ -0,0 +1,127 @@
+package ramdisk
+
+import (
+	"testing"
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs/fstestutil"
+	"golang.org/x/net/context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"syscall"
+)
+
+func TestVirtualHandle(t *testing.T) {
+	filesys := CreateRamFS()
+	written := make([]string, 0)
+	entry, err := filesys.AddVirtualFile("status.json", VirtualFile{
+		Read: func() ([]byte, error) { return []byte(`{"ok":true}`), nil },
+		Write: func(data []byte) error {
+			written = append(written, string(data))
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("adding virtual file failed: %v", err)
+	}
+	if _, err := filesys.AddVirtualFile("status.json", VirtualFile{Read: entry.virtual.Read}); err != fuse.EEXIST {
+		t.Fatalf("expected EEXIST, got %v", err)
+	}
+	if entry.Meta.Mode() != 0644 || !entry.IsVirtual() {
+		t.Fatal("wrong default mode")
+	}
+
+	ctx := context.Background()
+	reader, _ := entry.openVirtual(fuse.OpenReadOnly)
+	resp := &fuse.ReadResponse{Data: make([]byte, 0, 100)}
+	reader.(*virtualHandle).Read(ctx, &fuse.ReadRequest{Size: 100}, resp)
+	if string(resp.Data) != `{"ok":true}` || entry.Meta.Size() != 11 {
+		t.Fatalf("wrong content %q", resp.Data)
+	}
+
+	writer, _ := entry.openVirtual(fuse.OpenWriteOnly | fuse.OpenTruncate)
+	writer.(*virtualHandle).Write(ctx, &fuse.WriteRequest{Data: []byte("reload")}, &fuse.WriteResponse{})
+	writer.(*virtualHandle).Flush(ctx, &fuse.FlushRequest{})
+	writer.(*virtualHandle).Flush(ctx, &fuse.FlushRequest{})
+	if len(written) != 1 || written[0] != "reload" {
+		t.Fatalf("wrong content passed to write handler: %q", written)
+	}
+	if filesys.Metrics().BytesStored != 0 {
+		t.Fatal("virtual content counted as stored")
+	}
+
+	if !filesys.RemoveVirtualFile("status.json") || filesys.RemoveVirtualFile("status.json") {
+		t.Fatal("wrong result removing virtual file")
+	}
+}
+
+func TestVirtualReadOnly(t *testing.T) {
+	filesys := CreateRamFS()
+	entry, _ := filesys.AddVirtualFile("counters", VirtualFile{
+		Read: func() ([]byte, error) { return nil, errors.New("unavailable") },
+	})
+
+	if _, err := entry.openVirtual(fuse.OpenWriteOnly); err != fuse.Errno(syscall.EACCES) {
+		t.Fatalf("expected EACCES writing read-only virtual file, got %v", err)
+	}
+	if _, err := entry.openVirtual(fuse.OpenReadOnly); err != fuse.Errno(syscall.EIO) {
+		t.Fatalf("expected EIO for failing content, got %v", err)
+	}
+}
+
+func TestVirtualLimits(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{Capacity: 100})
+	file := VirtualFile{
+		Read:  func() ([]byte, error) { return nil, nil },
+		Write: func(data []byte) error { return nil },
+	}
+	if _, err := filesys.AddVirtualFile("..", file); err != fuse.Errno(syscall.EINVAL) {
+		t.Fatalf("expected EINVAL, got %v", err)
+	}
+	entry, _ := filesys.AddVirtualFile("limits", file)
+
+	ctx := context.Background()
+	writer, _ := entry.openVirtual(fuse.OpenWriteOnly)
+	for _, offset := range []int64{1 << 40, 95} {
+		err := writer.(*virtualHandle).Write(ctx, &fuse.WriteRequest{Offset: offset, Data: []byte("beyond")}, &fuse.WriteResponse{})
+		if err != fuse.Errno(syscall.EFBIG) {
+			t.Fatalf("write at %d: expected EFBIG, got %v", offset, err)
+		}
+	}
+	if err := writer.(*virtualHandle).Write(ctx, &fuse.WriteRequest{Offset: 94, Data: []byte("within")}, &fuse.WriteResponse{}); err != nil {
+		t.Fatalf("write within the capacity failed: %v", err)
+	}
+}
+
+func TestVirtualMounted(t *testing.T) {
+	filesys := CreateRamFS()
+	count := 0
+	filesys.AddVirtualFile("count", VirtualFile{
+		Read: func() ([]byte, error) {
+			count++
+			return []byte{byte('0' + count)}, nil
+		},
+	})
+	mnt, mntErr := fstestutil.MountedT(t, filesys, nil)
+	if mntErr != nil {
+		t.Fatal("mount failed")
+	}
+	defer mnt.Close()
+
+	ioutil.WriteFile(mnt.Dir+"/"+"regular.txt", []byte("stored"), 0644)
+
+	for _, expected := range []string{"1", "2"} {
+		byts, err := ioutil.ReadFile(mnt.Dir + "/" + "count")
+		if err != nil || string(byts) != expected {
+			t.Fatalf("wrong content %q, %v", byts, err)
+		}
+	}
+	if err := ioutil.WriteFile(mnt.Dir+"/"+"count", []byte("x"), 0644); !os.IsPermission(err) {
+		t.Fatalf("expected permission error, got %v", err)
+	}
+
+	infos, _ := ioutil.ReadDir(mnt.Dir)
+	if len(infos) != 2 {
+		t.Fatalf("virtual and regular files not listed together: %v", infos)
+	}
+}
@@ -0,0 +1,434 @@
+package ramdisk
+
+import (
+	"bazil.org/fuse"
+	"errors"
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var errNoDirectories = errors.New("directories are not supported")
+
+// WebDAVHandler returns a WebDAV server for the files of the RAM disk, with URLs starting with prefix.
+// It has full access to all files, see WriteFile
+func (f *ramdiskFS) WebDAVHandler(prefix string) http.Handler {
+	return &webdav.Handler{
+		Prefix:     prefix,
+		FileSystem: f.WebDAVFileSystem(),
+		LockSystem: f.WebDAVLockSystem(),
+	}
+}
+
+// WebDAVFileSystem returns the files of the RAM disk as a webdav.FileSystem. Files are read and written
+// like through the mount: hooks run and listeners are notified
+func (f *ramdiskFS) WebDAVFileSystem() webdav.FileSystem {
+	return &webdavFS{fs: f}
+}
+
+// WebDAVLockSystem returns the lock system of the RAM disk for WebDAV. WebDAV locks are
+// held as exclusive flock(2) locks on the files too, so that they exclude processes using the mount
+func (f *ramdiskFS) WebDAVLockSystem() webdav.LockSystem {
+	f.webdavOnce.Do(func() {
+		f.webdavLocks = &webdavLocks{LockSystem: webdav.NewMemLS(), fs: f, held: make(map[string]*webdavLock)}
+	})
+	return f.webdavLocks
+}
+
+// osError turns errors of file operations into errors of package os, as expected by package webdav
+func osError(err error) error {
+	if errno, isErrno := err.(fuse.Errno); isErrno {
+		return syscall.Errno(errno)
+	}
+	return err
+}
+
+// webdavName returns the file name of a WebDAV path, empty for the root directory
+func webdavName(name string) (string, error) {
+	name = strings.TrimPrefix(name, "/")
+	if strings.Contains(name, "/") {
+		return "", os.ErrNotExist
+	}
+	return name, nil
+}
+
+// webdavFS implements webdav.FileSystem
+type webdavFS struct {
+	fs *ramdiskFS
+}
+
+func (w *webdavFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return errNoDirectories
+}
+
+func (w *webdavFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name, err := webdavName(name)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return &webdavFile{fs: w.fs, flag: flag}, nil
+	}
+
+	create := flag&os.O_CREATE != 0
+	entry, created, err := w.fs.openFile(name, perm, create)
+	if err != nil {
+		return nil, osError(err)
+	}
+	file := &webdavFile{fs: w.fs, entry: entry, flag: flag}
+	if !created && create && flag&os.O_EXCL != 0 {
+		file.Close()
+		return nil, os.ErrExist
+	}
+
+	writing := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	switch {
+	case entry.virtual != nil:
+		if writing && entry.virtual.Write == nil {
+			file.Close()
+			return nil, os.ErrPermission
+		}
+		if flag&os.O_TRUNC == 0 {
+			if file.virtual, err = entry.virtual.Read(); err != nil {
+				file.Close()
+				return nil, osError(hookError(name, err))
+			}
+		}
+	case entry.Meta.Type() != 0:
+		file.Close()
+		return nil, syscall.EINVAL
+	case writing && flag&os.O_TRUNC != 0:
+		if err := entry.copyUpChecked(); err != nil {
+			file.Close()
+			return nil, err
+		}
+		entry.truncate(0)
+		w.fs.invalidate(entry)
+		file.written = true
+	}
+	return file, nil
+}
+
+func (w *webdavFS) RemoveAll(ctx context.Context, name string) error {
+	name, err := webdavName(name)
+	if err != nil {
+		return nil
+	}
+	if name == "" {
+		return os.ErrPermission
+	}
+	if err := w.fs.RemoveFile(name); err != nil && err != fuse.ENOENT {
+		return osError(err)
+	}
+	return nil
+}
+
+func (w *webdavFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldName, err := webdavName(oldName)
+	if err != nil {
+		return err
+	}
+	newName, err = webdavName(newName)
+	if err != nil {
+		return errNoDirectories
+	}
+	if oldName == "" || newName == "" {
+		return os.ErrPermission
+	}
+	return osError(w.fs.RenameFile(oldName, newName))
+}
+
+func (w *webdavFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	name, err := webdavName(name)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return w.fs.root.webdavInfo(), nil
+	}
+	entry, found := w.fs.File(name)
+	if !found {
+		return nil, os.ErrNotExist
+	}
+	return entry.webdavInfo(), nil
+}
+
+// webdavFile is a file opened through WebDAV, or the root directory. implements webdav.File
+type webdavFile struct {
+	fs      *ramdiskFS
+	entry   *FileEntry // nil for the root directory
+	flag    int
+	offset  int64
+	listed  int    // files returned by Readdir
+	virtual []byte // content of a virtual file
+	written bool
+	closed  bool
+}
+
+func (w *webdavFile) Read(p []byte) (int, error) {
+	switch {
+	case w.entry == nil:
+		return 0, syscall.EISDIR
+	case w.flag&os.O_WRONLY != 0:
+		return 0, os.ErrPermission
+	case w.entry.virtual != nil:
+		if w.offset >= int64(len(w.virtual)) {
+			return 0, io.EOF
+		}
+		n := copy(p, w.virtual[w.offset:])
+		w.offset += int64(n)
+		return n, nil
+	}
+
+	n, err := w.entry.ReadAt(p, w.offset)
+	w.offset += int64(n)
+	if n > 0 {
+		w.entry.Meta.touchAccessed(w.fs.options.Atime)
+		w.fs.backendEvents.FileRead <- EventFileRead{FSEvent{File: w.entry}}
+	}
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (w *webdavFile) Write(p []byte) (int, error) {
+	switch {
+	case w.entry == nil:
+		return 0, syscall.EISDIR
+	case w.flag&(os.O_WRONLY|os.O_RDWR) == 0:
+		return 0, os.ErrPermission
+	case w.entry.virtual != nil:
+		end := w.offset + int64(len(p))
+		if end > int64(len(w.virtual)) {
+			w.virtual = append(w.virtual, make([]byte, end-int64(len(w.virtual)))...)
+		}
+		copy(w.virtual[w.offset:], p)
+		w.offset = end
+		w.written = true
+		return len(p), nil
+	}
+
+	appendMode := w.flag&os.O_APPEND != 0
+	if err := w.fs.writeThrough(w.entry, p, w.offset, appendMode); err != nil {
+		return 0, osError(err)
+	}
+	w.written = true
+	w.offset += int64(len(p))
+	if appendMode {
+		w.offset = w.entry.dataSize()
+	}
+	return len(p), nil
+}
+
+func (w *webdavFile) Seek(offset int64, whence int) (int64, error) {
+	size := int64(len(w.virtual))
+	if w.entry != nil && w.entry.virtual == nil {
+		size = w.entry.dataSize()
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += w.offset
+	case io.SeekEnd:
+		offset += size
+	}
+	if offset < 0 {
+		return w.offset, syscall.EINVAL
+	}
+	w.offset = offset
+	return offset, nil
+}
+
+func (w *webdavFile) Readdir(count int) ([]os.FileInfo, error) {
+	if w.entry != nil {
+		return nil, syscall.ENOTDIR
+	}
+	files := w.fs.Files()
+	if w.listed > len(files) {
+		w.listed = len(files)
+	}
+	files = files[w.listed:]
+	if count > 0 && len(files) == 0 {
+		return nil, io.EOF
+	}
+	if count > 0 && count < len(files) {
+		files = files[:count]
+	}
+	infos := make([]os.FileInfo, 0, len(files))
+	for _, entry := range files {
+		infos = append(infos, entry.webdavInfo())
+	}
+	w.listed += len(files)
+	return infos, nil
+}
+
+func (w *webdavFile) Stat() (os.FileInfo, error) {
+	if w.entry == nil {
+		return w.fs.root.webdavInfo(), nil
+	}
+	info := w.entry.webdavInfo()
+	if w.entry.virtual != nil {
+		info.info.Size = int64(len(w.virtual))
+	}
+	return info, nil
+}
+
+// Close commits a file written to, like closing it on the mount
+func (w *webdavFile) Close() (err error) {
+	if w.closed || w.entry == nil {
+		return nil
+	}
+	w.closed = true
+	defer w.fs.closeFile(w.entry)
+
+	if !w.written {
+		return nil
+	}
+	if w.entry.virtual != nil {
+		if err := w.entry.virtual.Write(w.virtual); err != nil {
+			return osError(hookError(w.entry.Meta.Name(), err))
+		}
+		return nil
+	}
+	if err := w.entry.commit(); err != nil {
+		return osError(err)
+	}
+	w.fs.backendEvents.FileFlushed <- EventFileFlushed{FSEvent{File: w.entry}}
+	return nil
+}
+
+// webdavInfo implements os.FileInfo and webdav.ETager
+type webdavInfo struct {
+	info  FileInfo
+	inode uint64 // zero for the directory and virtual files, which have no ETag
+}
+
+// webdavInfo describes the file for WebDAV
+func (e *FileEntry) webdavInfo() webdavInfo {
+	info := webdavInfo{info: e.Info()}
+	if e.virtual == nil {
+		info.inode = e.Meta.Inode()
+	}
+	return info
+}
+
+func (w webdavInfo) Name() string       { return w.info.Name }
+func (w webdavInfo) Size() int64        { return w.info.Size }
+func (w webdavInfo) Mode() os.FileMode  { return w.info.Mode }
+func (w webdavInfo) ModTime() time.Time { return w.info.Modified }
+func (w webdavInfo) IsDir() bool        { return w.info.Mode.IsDir() }
+func (w webdavInfo) Sys() interface{}   { return nil }
+
+// ETag returns the ETags of the HTTP handler
+func (w webdavInfo) ETag(ctx context.Context) (string, error) {
+	if w.inode == 0 {
+		return "", webdav.ErrNotImplemented
+	}
+	return etag(w.inode, w.info), nil
+}
+
+// webdavInfo describes the directory for WebDAV
+func (d *Dir) webdavInfo() os.FileInfo {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return webdavInfo{info: FileInfo{Name: "/", Mode: os.ModeDir | d.perm.mode, Modified: d.modified}}
+}
+
+// webdavLocks implements webdav.LockSystem, holding a flock on each locked file
+type webdavLocks struct {
+	webdav.LockSystem
+	fs    *ramdiskFS
+	mutex sync.Mutex
+	held  map[string]*webdavLock // by token, guarded by mutex
+}
+
+type webdavLock struct {
+	entry  *FileEntry
+	owner  LockOwner
+	expiry time.Time // zero for locks without timeout
+}
+
+func (l *webdavLocks) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	l.expire(now)
+	return l.LockSystem.Confirm(now, name0, name1, conditions...)
+}
+
+func (l *webdavLocks) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	l.expire(now)
+	token, err := l.LockSystem.Create(now, details)
+	if err != nil {
+		return "", err
+	}
+
+	name, _ := webdavName(details.Root)
+	entry, found := l.fs.File(name)
+	if !found {
+		// locks on unmapped names reserve them, there is nothing to flock yet
+		return token, nil
+	}
+	owner := NewLockOwner()
+	if err := entry.TryFlock(owner, true); err != nil {
+		l.LockSystem.Unlock(now, token)
+		return "", webdav.ErrLocked
+	}
+
+	l.mutex.Lock()
+	l.held[token] = &webdavLock{entry: entry, owner: owner, expiry: lockExpiry(now, details.Duration)}
+	l.mutex.Unlock()
+	return token, nil
+}
+
+func (l *webdavLocks) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	l.expire(now)
+	details, err := l.LockSystem.Refresh(now, token, duration)
+	if err != nil {
+		return details, err
+	}
+
+	l.mutex.Lock()
+	if lock, found := l.held[token]; found {
+		lock.expiry = lockExpiry(now, duration)
+	}
+	l.mutex.Unlock()
+	return details, nil
+}
+
+func (l *webdavLocks) Unlock(now time.Time, token string) error {
+	l.expire(now)
+	err := l.LockSystem.Unlock(now, token)
+
+	l.mutex.Lock()
+	lock, found := l.held[token]
+	delete(l.held, token)
+	l.mutex.Unlock()
+	if found {
+		lock.entry.Funlock(lock.owner)
+	}
+	return err
+}
+
+// expire releases the flocks of WebDAV locks timed out
+func (l *webdavLocks) expire(now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for token, lock := range l.held {
+		if !lock.expiry.IsZero() && !now.Before(lock.expiry) {
+			lock.entry.Funlock(lock.owner)
+			delete(l.held, token)
+		}
+	}
+}
+
+// lockExpiry returns when a WebDAV lock of duration times out, negative durations mean never
+func lockExpiry(now time.Time, duration time.Duration) time.Time {
+	if duration < 0 {
+		return time.Time{}
+	}
+	return now.Add(duration)
+}
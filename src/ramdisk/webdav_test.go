@@ -0,0 +1,140 @@
+package ramdisk
+
+import (
+	"bazil.org/fuse"
+	"testing"
+	"net/http"
+	"strings"
+)
+
+const lockBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`
+
+func TestWebDAV(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{})
+	handler := filesys.WebDAVHandler("/dav")
+
+	if response := serveTest(handler, "PUT", "/dav/d1.txt", "hello webdav", nil); response.Code != http.StatusCreated {
+		t.Fatalf("wrong status of put %d", response.Code)
+	}
+	entry, found := filesys.File("d1.txt")
+	if !found || string(entry.Bytes()) != "hello webdav" {
+		t.Fatal("file not written")
+	}
+	if response := serveTest(handler, "GET", "/dav/d1.txt", "", nil); response.Body.String() != "hello webdav" || response.Header().Get("ETag") != entry.etag() {
+		t.Fatalf("wrong content %q or ETag %q", response.Body.String(), response.Header().Get("ETag"))
+	}
+
+	response := serveTest(handler, "PROPFIND", "/dav/", "", map[string]string{"Depth": "1"})
+	if response.Code != http.StatusMultiStatus || !strings.Contains(response.Body.String(), "/dav/d1.txt") {
+		t.Fatalf("wrong listing %d %s", response.Code, response.Body.String())
+	}
+
+	if response := serveTest(handler, "MOVE", "/dav/d1.txt", "", map[string]string{"Destination": "/dav/d2.txt"}); response.Code != http.StatusCreated {
+		t.Fatalf("wrong status of move %d", response.Code)
+	}
+	if _, found := filesys.File("d1.txt"); found {
+		t.Fatal("old name still present")
+	}
+	renamed, found := filesys.File("d2.txt")
+	if !found || string(renamed.Bytes()) != "hello webdav" || renamed.Meta.Inode() != entry.Meta.Inode() {
+		t.Fatal("file not renamed")
+	}
+
+	if response := serveTest(handler, "MKCOL", "/dav/dir", "", nil); response.Code < 400 {
+		t.Fatalf("directory created: %d", response.Code)
+	}
+	if response := serveTest(handler, "DELETE", "/dav/d2.txt", "", nil); response.Code != http.StatusNoContent {
+		t.Fatalf("wrong status of delete %d", response.Code)
+	}
+	if len(filesys.Files()) != 0 {
+		t.Fatal("file not removed")
+	}
+}
+
+func TestWebDAVLocks(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{})
+	handler := filesys.WebDAVHandler("")
+	entry, _, err := filesys.WriteFile("l1.txt", []byte("locked"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := serveTest(handler, "LOCK", "/l1.txt", lockBody, map[string]string{"Timeout": "Second-60"})
+	token := response.Header().Get("Lock-Token")
+	if response.Code != http.StatusOK || token == "" {
+		t.Fatalf("wrong status of lock %d", response.Code)
+	}
+	if err := entry.TryFlock(NewLockOwner(), false); err == nil {
+		t.Fatal("WebDAV lock doesn't hold a flock")
+	}
+	if response := serveTest(handler, "PUT", "/l1.txt", "unlocked", nil); response.Code != http.StatusLocked {
+		t.Fatalf("write without token not refused: %d", response.Code)
+	}
+	if response := serveTest(handler, "PUT", "/l1.txt", "with token", map[string]string{"If": "(" + token + ")"}); response.Code >= 300 {
+		t.Fatalf("write with token refused: %d", response.Code)
+	}
+
+	if response := serveTest(handler, "UNLOCK", "/l1.txt", "", map[string]string{"Lock-Token": token}); response.Code != http.StatusNoContent {
+		t.Fatalf("wrong status of unlock %d", response.Code)
+	}
+	owner := NewLockOwner()
+	if err := entry.TryFlock(owner, true); err != nil {
+		t.Fatal("flock not released on unlock")
+	}
+
+	// a flock taken through the mount excludes WebDAV locks
+	if response := serveTest(handler, "LOCK", "/l1.txt", lockBody, nil); response.Code != http.StatusLocked {
+		t.Fatalf("lock granted on a flocked file: %d", response.Code)
+	}
+	entry.Funlock(owner)
+}
+
+func TestRenameFile(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{})
+	filesys.WriteFile("r1", []byte("one"), 0640)
+	filesys.WriteFile("r2", []byte("two"), 0644)
+
+	if err := filesys.RenameFile("r1", "r2"); err != nil {
+		t.Fatal(err)
+	}
+	entry, found := filesys.File("r2")
+	if !found || string(entry.Bytes()) != "one" || entry.Meta.Mode().Perm() != 0640 || len(filesys.Files()) != 1 {
+		t.Fatal("file not renamed over the other")
+	}
+	if metrics := filesys.Metrics(); metrics.BytesStored != 3 || metrics.BytesPhysical != 3 || metrics.Files != 1 {
+		t.Fatalf("wrong accounting after rename: %+v", metrics)
+	}
+	if err := filesys.RenameFile("r1", "r3"); err != fuse.ENOENT {
+		t.Fatalf("renamed a missing file: %v", err)
+	}
+}
+
+func TestRenameInPlace(t *testing.T) {
+	filesys := CreateRamFSWithOptions(Options{Versions: 2})
+	filesys.WriteFile("r4", []byte("one"), 0644)
+	filesys.WriteFile("r4", []byte("two"), 0644)
+	entry, _, _ := filesys.openFile("r4", 0, false)
+	owner := LockOwner(1)
+	if err := entry.TryFlock(owner, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := filesys.RenameFile("r4", "r5"); err != nil {
+		t.Fatal(err)
+	}
+	renamed, found := filesys.File("r5")
+	if !found || renamed != entry || entry.Meta.Name() != "r5" || len(entry.Versions()) != 2 {
+		t.Fatal("file not renamed in place")
+	}
+	if err := entry.TryFlock(LockOwner(2), true); err == nil {
+		t.Fatal("lock lost by the rename")
+	}
+
+	// a handle opened before the rename writes to the renamed file
+	filesys.writeThrough(entry, []byte("three"), 0, false)
+	filesys.closeFile(entry)
+	if data, _, _ := filesys.ReadFile("r5"); string(data) != "three" {
+		t.Fatalf("write through the old handle lost: %q", data)
+	}
+}
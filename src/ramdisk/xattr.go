@@ -0,0 +1,290 @@
+package ramdisk
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"sort"
+	"sync"
+	"syscall"
+)
+
+// limits for extended attributes, same as the Linux VFS enforces
+const (
+	XattrNameMax = 255       // max length of a single attribute name
+	XattrSizeMax = 64 * 1024 // max length of a single attribute value
+	XattrListMax = 64 * 1024 // max length of the name list of one inode
+)
+
+// flags passed to setxattr(2)
+const (
+	xattrCreate  = 1 // XATTR_CREATE: fail if attribute already exists
+	xattrReplace = 2 // XATTR_REPLACE: fail if attribute does not exist
+)
+
+// xattrControlPrefix starts the names of attributes controlling the RAM disk, like XattrRing
+const xattrControlPrefix = "user.ramdisk."
+
+// xattrStore holds the extended attributes of a single inode
+type xattrStore struct {
+	mutex sync.RWMutex
+	attrs map[string][]byte
+}
+
+func (x *xattrStore) get(name string) ([]byte, error) {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+
+	value, found := x.attrs[name]
+	if !found {
+		return nil, fuse.ErrNoXattr
+	}
+	return value, nil
+}
+
+func (x *xattrStore) set(name string, value []byte, flags uint32) error {
+	if name == "" {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	if len(name) > XattrNameMax {
+		return fuse.Errno(syscall.ERANGE)
+	}
+	if len(value) > XattrSizeMax {
+		return fuse.Errno(syscall.E2BIG)
+	}
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	_, exists := x.attrs[name]
+	if exists && flags&xattrCreate != 0 {
+		return fuse.EEXIST
+	}
+	if !exists && flags&xattrReplace != 0 {
+		return fuse.ErrNoXattr
+	}
+	if !exists && x.listSize()+len(name)+1 > XattrListMax {
+		return fuse.Errno(syscall.ENOSPC)
+	}
+
+	if x.attrs == nil {
+		x.attrs = make(map[string][]byte)
+	}
+	// never keep a reference to the caller's (or the kernel's) buffer
+	x.attrs[name] = append([]byte{}, value...)
+	return nil
+}
+
+func (x *xattrStore) remove(name string) error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if _, found := x.attrs[name]; !found {
+		return fuse.ErrNoXattr
+	}
+	delete(x.attrs, name)
+	return nil
+}
+
+// list returns all attribute names, sorted
+func (x *xattrStore) list() []string {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+
+	names := make([]string, 0, len(x.attrs))
+	for name := range x.attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// replace sets all attributes to a copy of attrs
+func (x *xattrStore) replace(attrs map[string][]byte) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	x.attrs = make(map[string][]byte, len(attrs))
+	for name, value := range attrs {
+		x.attrs[name] = append([]byte{}, value...)
+	}
+}
+
+// copy returns a deep copy of all attributes
+func (x *xattrStore) copy() map[string][]byte {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+
+	attrs := make(map[string][]byte, len(x.attrs))
+	for name, value := range x.attrs {
+		attrs[name] = append([]byte{}, value...)
+	}
+	return attrs
+}
+
+// listSize is the size of the NUL separated name list, caller must hold the mutex
+func (x *xattrStore) listSize() (size int) {
+	for name := range x.attrs {
+		size += len(name) + 1
+	}
+	return
+}
+
+func getxattr(x *xattrStore, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	value, err := x.get(req.Name)
+	if err != nil {
+		return err
+	}
+	if req.Size != 0 && int(req.Size) < len(value) {
+		return fuse.Errno(syscall.ERANGE)
+	}
+	resp.Xattr = append(resp.Xattr, value...)
+	return nil
+}
+
+func listxattr(x *xattrStore, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	resp.Append(x.list()...)
+	if req.Size != 0 && int(req.Size) < len(resp.Xattr) {
+		return fuse.Errno(syscall.ERANGE)
+	}
+	return nil
+}
+
+// implements fs.NodeGetxattrer
+func (f *RamFile) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	return getxattr(&f.xattrs, req, resp)
+}
+
+// implements fs.NodeListxattrer
+func (f *RamFile) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	return listxattr(&f.xattrs, req, resp)
+}
+
+// checkXattr checks if the caller may change the extended attribute name of the file
+func (f *RamFile) checkXattr(header fuse.Header, name string) error {
+	if !f.entry.fs.enforcePermissions() {
+		return nil
+	}
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.perm.permitsXattr(header, name)
+}
+
+// implements fs.NodeSetxattrer
+func (f *RamFile) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	if err := f.checkXattr(req.Header, req.Name); err != nil {
+		return err
+	}
+	entry := f.entry
+	return entry.setXattr(req.Name, req.Xattr, req.Flags)
+}
+
+// implements fs.NodeRemovexattrer
+func (f *RamFile) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	if err := f.checkXattr(req.Header, req.Name); err != nil {
+		return err
+	}
+	entry := f.entry
+	return entry.RemoveXattr(req.Name)
+}
+
+// implements fs.NodeGetxattrer
+func (d *Dir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	return getxattr(&d.xattrs, req, resp)
+}
+
+// implements fs.NodeListxattrer
+func (d *Dir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	return listxattr(&d.xattrs, req, resp)
+}
+
+// checkXattr checks if the caller may change the extended attribute name of the directory
+func (d *Dir) checkXattr(header fuse.Header, name string) error {
+	if !d.fs.enforcePermissions() {
+		return nil
+	}
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.perm.permitsXattr(header, name)
+}
+
+// implements fs.NodeSetxattrer
+func (d *Dir) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	if err := d.checkXattr(req.Header, req.Name); err != nil {
+		return err
+	}
+	if err := checkDirXattr(req.Name, req.Xattr); err != nil {
+		return err
+	}
+	if err := d.xattrs.set(req.Name, req.Xattr, req.Flags); err != nil {
+		return err
+	}
+	d.touchChanged()
+	d.fs.backendEvents.DirXattrChanged <- EventDirXattrChanged{d, req.Name, false}
+	return nil
+}
+
+// implements fs.NodeRemovexattrer
+func (d *Dir) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	if err := d.checkXattr(req.Header, req.Name); err != nil {
+		return err
+	}
+	if err := d.xattrs.remove(req.Name); err != nil {
+		return err
+	}
+	d.touchChanged()
+	d.fs.backendEvents.DirXattrChanged <- EventDirXattrChanged{d, req.Name, true}
+	return nil
+}
+
+// Xattr returns the value of the extended attribute name
+func (e *FileEntry) Xattr(name string) ([]byte, bool) {
+	value, err := e.Meta.xattrs.get(name)
+	if err != nil {
+		return nil, false
+	}
+	return append([]byte{}, value...), true
+}
+
+// Xattrs returns a snapshot of all extended attributes of the file
+func (e *FileEntry) Xattrs() map[string][]byte {
+	return e.Meta.xattrs.copy()
+}
+
+// SetXattr creates or replaces the extended attribute name
+func (e *FileEntry) SetXattr(name string, value []byte) error {
+	return e.setXattr(name, value, 0)
+}
+
+// RemoveXattr deletes the extended attribute name
+func (e *FileEntry) RemoveXattr(name string) error {
+	if err := e.Meta.xattrs.remove(name); err != nil {
+		return err
+	}
+	if name == XattrRing {
+		e.setRingSize(0)
+	}
+	e.Meta.touchChanged()
+	e.fs.backendEvents.FileXattrChanged <- EventFileXattrChanged{FSEvent{File: e}, name, true}
+	return nil
+}
+
+func (e *FileEntry) setXattr(name string, value []byte, flags uint32) error {
+	var ringSize int64
+	if name == XattrRing {
+		var err error
+		if ringSize, err = parseRingSize(value); err != nil {
+			return err
+		}
+	}
+	if err := e.Meta.xattrs.set(name, value, flags); err != nil {
+		return err
+	}
+	if name == XattrRing {
+		e.setRingSize(ringSize)
+		// the content may be trimmed. setxattr is served for the file, invalidate asynchronously
+		go e.fs.invalidate(e)
+	}
+	e.Meta.touchChanged()
+	e.fs.backendEvents.FileXattrChanged <- EventFileXattrChanged{FSEvent{File: e}, name, false}
+	return nil
+}
@@ -0,0 +1,170 @@
+package ramdisk
+
+import (
+	"testing"
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs/fstestutil"
+	"golang.org/x/net/context"
+	"os"
+	"syscall"
+	"strings"
+	"time"
+)
+
+func TestXattrSetGet(t *testing.T) {
+	filesys := CreateRamFS()
+	mnt, mntErr := fstestutil.MountedT(t, filesys, nil)
+	if mntErr != nil {
+		t.Fatal("mount failed")
+	}
+	defer mnt.Close()
+
+	path := mnt.Dir + "/" + "x1.txt"
+	writer, createErr := os.Create(path)
+	if createErr != nil {
+		t.Fatal("create failed")
+	}
+	writer.Close()
+
+	if err := syscall.Setxattr(path, "user.color", []byte("blue"), 0); err != nil {
+		t.Fatalf("setxattr failed: %v", err)
+	}
+
+	value := make([]byte, 64)
+	size, err := syscall.Getxattr(path, "user.color", value)
+	if err != nil {
+		t.Fatalf("getxattr failed: %v", err)
+	}
+	if string(value[:size]) != "blue" {
+		t.Fatalf("wrong xattr value %q", value[:size])
+	}
+
+	entry, found := filesys.root.findEntryByName("x1.txt")
+	if !found {
+		t.Fatal("entry not found in-process")
+	}
+	inProcess, found := entry.Xattr("user.color")
+	if !found || string(inProcess) != "blue" {
+		t.Fatalf("wrong in-process xattr value %q", inProcess)
+	}
+}
+
+func TestXattrErrors(t *testing.T) {
+	mnt, mntErr := fstestutil.MountedT(t, CreateRamFS(), nil)
+	if mntErr != nil {
+		t.Fatal("mount failed")
+	}
+	defer mnt.Close()
+
+	path := mnt.Dir + "/" + "x2.txt"
+	writer, createErr := os.Create(path)
+	if createErr != nil {
+		t.Fatal("create failed")
+	}
+	writer.Close()
+
+	_, err := syscall.Getxattr(path, "user.missing", make([]byte, 16))
+	if err != syscall.ENODATA {
+		t.Fatalf("expected ENODATA, got %v", err)
+	}
+
+	syscall.Setxattr(path, "user.long", []byte("0123456789"), 0)
+	_, err = syscall.Getxattr(path, "user.long", make([]byte, 4))
+	if err != syscall.ERANGE {
+		t.Fatalf("expected ERANGE, got %v", err)
+	}
+
+	// size query with empty buffer
+	size, err := syscall.Getxattr(path, "user.long", nil)
+	if err != nil || size != 10 {
+		t.Fatalf("expected size 10, got %d, %v", size, err)
+	}
+
+	err = syscall.Setxattr(path, "user.long", []byte("x"), xattrCreate)
+	if err != syscall.EEXIST {
+		t.Fatalf("expected EEXIST, got %v", err)
+	}
+
+	err = syscall.Removexattr(path, "user.missing")
+	if err != syscall.ENODATA {
+		t.Fatalf("expected ENODATA on remove, got %v", err)
+	}
+}
+
+func TestXattrListRemove(t *testing.T) {
+	mnt, mntErr := fstestutil.MountedT(t, CreateRamFS(), nil)
+	if mntErr != nil {
+		t.Fatal("mount failed")
+	}
+	defer mnt.Close()
+
+	path := mnt.Dir + "/" + "x3.txt"
+	writer, createErr := os.Create(path)
+	if createErr != nil {
+		t.Fatal("create failed")
+	}
+	writer.Close()
+
+	syscall.Setxattr(path, "user.a", []byte("1"), 0)
+	syscall.Setxattr(path, "user.b", []byte("2"), 0)
+
+	list := make([]byte, 128)
+	size, err := syscall.Listxattr(path, list)
+	if err != nil {
+		t.Fatalf("listxattr failed: %v", err)
+	}
+	if string(list[:size]) != "user.a\x00user.b\x00" {
+		t.Fatalf("wrong xattr list %q", list[:size])
+	}
+
+	if err := syscall.Removexattr(path, "user.a"); err != nil {
+		t.Fatalf("removexattr failed: %v", err)
+	}
+	size, _ = syscall.Listxattr(path, list)
+	if string(list[:size]) != "user.b\x00" {
+		t.Fatalf("wrong xattr list after remove %q", list[:size])
+	}
+}
+
+func TestXattrLimits(t *testing.T) {
+	store := xattrStore{}
+
+	if err := store.set(strings.Repeat("n", XattrNameMax+1), []byte("v"), 0); err != fuse.Errno(syscall.ERANGE) {
+		t.Fatalf("expected ERANGE for long name, got %v", err)
+	}
+	if err := store.set("user.big", make([]byte, XattrSizeMax+1), 0); err != fuse.Errno(syscall.E2BIG) {
+		t.Fatalf("expected E2BIG for large value, got %v", err)
+	}
+	if err := store.set("user.missing", []byte("v"), xattrReplace); err != fuse.ErrNoXattr {
+		t.Fatalf("expected ENODATA on replace, got %v", err)
+	}
+
+	value := []byte("abc")
+	store.set("user.copy", value, 0)
+	value[0] = 'x'
+	stored, _ := store.get("user.copy")
+	if string(stored) != "abc" {
+		t.Fatalf("store keeps reference to caller's buffer: %q", stored)
+	}
+}
+
+func TestDirXattrEvents(t *testing.T) {
+	filesys := CreateRamFS()
+	listener := NewFSEvents()
+	listener.DirXattrChanged = make(chan EventDirXattrChanged)
+	filesys.AddListener(&listener)
+
+	ctx := context.Background()
+	filesys.root.Setxattr(ctx, &fuse.SetxattrRequest{Name: "user.color", Xattr: []byte("blue")})
+	filesys.root.Removexattr(ctx, &fuse.RemovexattrRequest{Name: "user.color"})
+	for _, removed := range []bool{false, true} {
+		select {
+		case event := <-listener.DirXattrChanged:
+			if event.Dir != filesys.root || event.Name != "user.color" || event.Removed != removed {
+				t.Fatalf("wrong event %+v", event)
+			}
+		case <-time.After(time.Minute):
+			t.Fatal("missing DirXattrChanged")
+		}
+	}
+}